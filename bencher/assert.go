@@ -0,0 +1,231 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/faas-facts/fact/fact"
+)
+
+//ErrorTag marks a trace as failed, the value describes the failure
+const ErrorTag = "Error"
+
+//Assertions validate the response of an invocation, configured under assert: of an invoker.
+type Assertions struct {
+	Status   []int                  //expected status codes, any if empty
+	Contains []string               //body must contain all of these
+	Regex    []*regexp.Regexp       //body must match all of these
+	JSON     map[string]interface{} //dotted json path (e.g. result.items.0.id) to the expected value
+	MaxSize  int64                  //max body size in bytes, unlimited if 0
+	Headers  map[string]string      //required headers, a non empty value must match exactly
+}
+
+func newAssertionsFromConfig(options map[string]interface{}) (*Assertions, error) {
+	val, ok := options["assert"]
+	if !ok || val == nil {
+		return nil, nil
+	}
+	config, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("assert must be a map")
+	}
+
+	a := &Assertions{
+		JSON:    make(map[string]interface{}),
+		Headers: make(map[string]string),
+	}
+
+	for _, status := range listValue("status", config) {
+		code, err := strconv.Atoi(fmt.Sprint(status))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %+v", status)
+		}
+		a.Status = append(a.Status, code)
+	}
+	for _, contains := range listValue("contains", config) {
+		a.Contains = append(a.Contains, fmt.Sprint(contains))
+	}
+	for _, expr := range listValue("regex", config) {
+		re, err := regexp.Compile(fmt.Sprint(expr))
+		if err != nil {
+			return nil, err
+		}
+		a.Regex = append(a.Regex, re)
+	}
+	if val, ok := config["json"]; ok {
+		paths, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("assert json must be a map of paths to values")
+		}
+		a.JSON = paths
+	}
+	if val, ok := config["maxSize"]; ok {
+		size, err := strconv.ParseInt(fmt.Sprint(val), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxSize %+v", val)
+		}
+		a.MaxSize = size
+	}
+	//headers are either a list of names or a map of names to values
+	if val, ok := config["headers"]; ok {
+		switch headers := val.(type) {
+		case []interface{}:
+			for _, name := range headers {
+				a.Headers[fmt.Sprint(name)] = ""
+			}
+		case map[string]interface{}:
+			for name, value := range headers {
+				a.Headers[name] = fmt.Sprint(value)
+			}
+		default:
+			return nil, fmt.Errorf("assert headers must be a list or map")
+		}
+	}
+
+	return a, nil
+}
+
+//listValue reads a list option, single values are treated as a list of one
+func listValue(key string, options map[string]interface{}) []interface{} {
+	val, ok := options[key]
+	if !ok || val == nil {
+		return nil
+	}
+	if list, ok := val.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{val}
+}
+
+//Check returns an error describing the first failed assertion.
+func (a *Assertions) Check(status int, header http.Header, body []byte) error {
+	if len(a.Status) > 0 {
+		found := false
+		for _, s := range a.Status {
+			if s == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("status %d not in %v", status, a.Status)
+		}
+	}
+
+	if a.MaxSize > 0 && int64(len(body)) > a.MaxSize {
+		return fmt.Errorf("body size %d exceeds %d", len(body), a.MaxSize)
+	}
+
+	for name, expected := range a.Headers {
+		value := header.Get(name)
+		if value == "" {
+			return fmt.Errorf("missing header %s", name)
+		}
+		if expected != "" && value != expected {
+			return fmt.Errorf("header %s is %s, expected %s", name, value, expected)
+		}
+	}
+
+	for _, contains := range a.Contains {
+		if !bytes.Contains(body, []byte(contains)) {
+			return fmt.Errorf("body does not contain %q", contains)
+		}
+	}
+
+	for _, re := range a.Regex {
+		if !re.Match(body) {
+			return fmt.Errorf("body does not match %s", re)
+		}
+	}
+
+	if len(a.JSON) > 0 {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("body is not json - %+v", err)
+		}
+		for path, expected := range a.JSON {
+			value, ok := jsonPath(doc, path)
+			if !ok {
+				return fmt.Errorf("json path %s not found", path)
+			}
+			if !jsonEqual(value, expected) {
+				return fmt.Errorf("json path %s is %+v, expected %+v", path, value, expected)
+			}
+		}
+	}
+
+	return nil
+}
+
+//jsonPath resolves a dotted path, numeric segments index into arrays
+func jsonPath(doc interface{}, path string) (interface{}, bool) {
+	current := doc
+	for _, segment := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			val, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			current = val
+		case []interface{}:
+			idx, err := strconv.Atoi(segment)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return nil, false
+			}
+			current = node[idx]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+//jsonEqual compares the json representation, so yaml ints match json numbers
+func jsonEqual(a, b interface{}) bool {
+	left, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	right, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(left, right)
+}
+
+//markFailed tags the trace with the failure message
+func markFailed(t *fact.Trace, err error) {
+	if t.Tags == nil {
+		t.Tags = make(map[string]string)
+	}
+	t.Tags[ErrorTag] = err.Error()
+}
+
+//isFailed reports if the trace was marked as failed
+func isFailed(t *fact.Trace) bool {
+	_, failed := t.Tags[ErrorTag]
+	return failed
+}
@@ -0,0 +1,446 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//AuthProvider adds credentials to each request of an invoker, configured under auth: of an invoker.
+type AuthProvider interface {
+	//Authorize is called with the final request and its body right before it is send
+	Authorize(req *http.Request, body []byte) error
+}
+
+var _authTypes = []string{"bearer", "basic", "apikey", "oauth2", "sigv4"}
+
+//newAuthProviderFromConfig creates the provider of the auth option, secrets are never read from the workload
+//itself, instead each secret field x is read from the environment variable xEnv or the file xFile.
+func newAuthProviderFromConfig(options map[string]interface{}) (AuthProvider, error) {
+	val, ok := options["auth"]
+	if !ok || val == nil {
+		return nil, nil
+	}
+	config, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("auth must be a map")
+	}
+
+	_type := strings.TrimSpace(strings.ToLower(stringValue("type", config, "")))
+	switch _type {
+	case "bearer":
+		token, err := secretValue("token", config)
+		if err != nil {
+			return nil, err
+		}
+		return &BearerAuth{Token: token}, nil
+	case "basic":
+		username, err := credentialValue("username", config)
+		if err != nil {
+			return nil, err
+		}
+		password, err := secretValue("password", config)
+		if err != nil {
+			return nil, err
+		}
+		return &BasicAuth{Username: username, Password: password}, nil
+	case "apikey":
+		key, err := secretValue("key", config)
+		if err != nil {
+			return nil, err
+		}
+		return &APIKeyAuth{
+			Header: stringValue("header", config, "X-API-Key"),
+			Query:  stringValue("query", config, ""),
+			Key:    key,
+		}, nil
+	case "oauth2":
+		return newOAuth2FromConfig(config)
+	case "sigv4":
+		return newSigV4FromConfig(config)
+	}
+	return nil, fmt.Errorf("unknown auth type %s, use one of %v", _type, _authTypes)
+}
+
+//secretValue reads a secret from the environment (keyEnv) or a file (keyFile), inline values are rejected
+func secretValue(key string, config map[string]interface{}) (string, error) {
+	if _, ok := config[key]; ok {
+		return "", fmt.Errorf("auth %s must not be part of the workload, use %sEnv or %sFile", key, key, key)
+	}
+	return credentialValue(key, config)
+}
+
+//credentialValue reads a value inline (key), from the environment (keyEnv) or a file (keyFile)
+func credentialValue(key string, config map[string]interface{}) (string, error) {
+	if val, ok := config[key]; ok {
+		return fmt.Sprint(val), nil
+	}
+	if name, ok := config[key+"Env"]; ok {
+		value, found := os.LookupEnv(fmt.Sprint(name))
+		if !found {
+			return "", fmt.Errorf("auth %s: environment variable %s is not set", key, name)
+		}
+		return value, nil
+	}
+	if filename, ok := config[key+"File"]; ok {
+		data, err := ioutil.ReadFile(fmt.Sprint(filename))
+		if err != nil {
+			return "", fmt.Errorf("auth %s - %+v", key, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", fmt.Errorf("auth needs %sEnv or %sFile", key, key)
+}
+
+//credentialOrEnv reads a secret like secretValue, falling back to the environment variable env
+func credentialOrEnv(key string, config map[string]interface{}, env string) (string, error) {
+	if checkFields(config, key) || checkFields(config, key+"Env") || checkFields(config, key+"File") {
+		return secretValue(key, config)
+	}
+	value, found := os.LookupEnv(env)
+	if !found {
+		return "", fmt.Errorf("auth needs %sEnv, %sFile or %s", key, key, env)
+	}
+	return value, nil
+}
+
+//BearerAuth sends a static token as Authorization: Bearer <token>
+type BearerAuth struct {
+	Token string
+}
+
+func (a *BearerAuth) Authorize(req *http.Request, body []byte) error {
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	return nil
+}
+
+//BasicAuth sends the username and password as basic authentication
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+func (a *BasicAuth) Authorize(req *http.Request, body []byte) error {
+	req.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+//APIKeyAuth sends a key as header or, if Query is set, as query parameter
+type APIKeyAuth struct {
+	Header string
+	Query  string
+	Key    string
+}
+
+func (a *APIKeyAuth) Authorize(req *http.Request, body []byte) error {
+	if a.Query != "" {
+		target := *req.URL
+		query := target.Query()
+		query.Set(a.Query, a.Key)
+		target.RawQuery = query.Encode()
+		req.URL = &target
+		return nil
+	}
+	req.Header.Set(a.Header, a.Key)
+	return nil
+}
+
+//OAuth2Auth fetches a token with the client credentials grant and caches it until shortly before it expires
+type OAuth2Auth struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	Audience     string
+	//Refresh is how long before the expiry a new token is fetched
+	Refresh time.Duration
+
+	client  *http.Client
+	token   string
+	expires time.Time
+	sync.Mutex
+}
+
+func newOAuth2FromConfig(config map[string]interface{}) (AuthProvider, error) {
+	if !checkFields(config, "tokenUrl") {
+		return nil, fmt.Errorf("oauth2 needs a tokenUrl")
+	}
+	clientID, err := credentialValue("clientId", config)
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := secretValue("clientSecret", config)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := time.ParseDuration(stringValue("refresh", config, "30s"))
+	if err != nil {
+		return nil, err
+	}
+
+	var scopes []string
+	for _, scope := range listValue("scopes", config) {
+		scopes = append(scopes, fmt.Sprint(scope))
+	}
+
+	return &OAuth2Auth{
+		TokenURL:     stringValue("tokenUrl", config, ""),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       scopes,
+		Audience:     stringValue("audience", config, ""),
+		Refresh:      refresh,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (a *OAuth2Auth) Authorize(req *http.Request, body []byte) error {
+	token, err := a.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+//Token returns the cached token or fetches a new one if it expires within the refresh window
+func (a *OAuth2Auth) Token() (string, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a.token != "" && time.Now().Add(a.Refresh).Before(a.expires) {
+		return a.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(a.Scopes) > 0 {
+		form.Set("scope", strings.Join(a.Scopes, " "))
+	}
+	if a.Audience != "" {
+		form.Set("audience", a.Audience)
+	}
+	req, err := http.NewRequest(http.MethodPost, a.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch oauth2 token - %+v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch oauth2 token - status %d", resp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("failed to read oauth2 token - %+v", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("oauth2 response contains no access_token")
+	}
+
+	a.token = token.AccessToken
+	if token.ExpiresIn > 0 {
+		a.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	} else {
+		//tokens without expiry are kept for the whole run
+		a.expires = time.Now().Add(24 * 365 * time.Hour)
+	}
+	return a.token, nil
+}
+
+//SigV4Auth signs requests with AWS signature version 4
+type SigV4Auth struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Region          string
+	Service         string
+
+	now func() time.Time
+}
+
+func newSigV4FromConfig(config map[string]interface{}) (AuthProvider, error) {
+	//credentials default to the usual aws environment variables
+	accessKey, err := credentialOrEnv("accessKeyId", config, "AWS_ACCESS_KEY_ID")
+	if err != nil {
+		return nil, err
+	}
+	secretKey, err := credentialOrEnv("secretAccessKey", config, "AWS_SECRET_ACCESS_KEY")
+	if err != nil {
+		return nil, err
+	}
+	//the session token is optional, only temporary credentials have one
+	sessionToken := os.Getenv("AWS_SESSION_TOKEN")
+	if checkFields(config, "sessionToken") || checkFields(config, "sessionTokenEnv") || checkFields(config, "sessionTokenFile") {
+		sessionToken, err = secretValue("sessionToken", config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	region := stringValue("region", config, os.Getenv("AWS_REGION"))
+	if region == "" {
+		return nil, fmt.Errorf("sigv4 needs a region")
+	}
+	if !checkFields(config, "service") {
+		return nil, fmt.Errorf("sigv4 needs a service, e.g. lambda or execute-api")
+	}
+
+	return &SigV4Auth{
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		SessionToken:    sessionToken,
+		Region:          region,
+		Service:         stringValue("service", config, ""),
+		now:             time.Now,
+	}, nil
+}
+
+const sigV4Algorithm = "AWS4-HMAC-SHA256"
+
+//Authorize signs the host, content-type and all x-amz-* headers of the request
+func (a *SigV4Auth) Authorize(req *http.Request, body []byte) error {
+	now := a.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if a.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.SessionToken)
+	}
+	payloadHash := sha256Hex(body)
+	if a.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			headers[lower] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	//all services but s3 encode the path segments twice
+	if a.Service != "s3" {
+		path = sigV4Escape(path, false)
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, a.Region, a.Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+a.SecretAccessKey), date)
+	key = hmacSHA256(key, a.Region)
+	key = hmacSHA256(key, a.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, a.AccessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+//canonicalQuery sorts and escapes the query as required by sigv4
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, sigV4Escape(k, true)+"="+sigV4Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+//sigV4Escape escapes all but the unreserved characters, slashes are kept unless encodeSlash is set
+func sigV4Escape(value string, encodeSlash bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthProviders(t *testing.T) {
+	server, record := newRecordingServer(t, 200, "{}")
+
+	os.Setenv("BENCH_TEST_TOKEN", "t0k3n")
+	defer os.Unsetenv("BENCH_TEST_TOKEN")
+	invoker := setupInvoker(t, `
+type: http
+timeout: 1s
+auth:
+  type: bearer
+  tokenEnv: BENCH_TEST_TOKEN
+`, server.URL).(*HTTPInvoker)
+	invokeOnce(t, invoker, 0)
+	assert.Equal(t, "Bearer t0k3n", record.Header.Get("Authorization"))
+
+	password := filepath.Join(t.TempDir(), "password")
+	if err := ioutil.WriteFile(password, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invoker = setupInvoker(t, `
+type: http
+timeout: 1s
+auth:
+  type: basic
+  username: bench
+  passwordFile: `+password+`
+`, server.URL).(*HTTPInvoker)
+	invokeOnce(t, invoker, 0)
+	req := &http.Request{Header: record.Header}
+	user, pass, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "bench", user)
+	assert.Equal(t, "s3cret", pass)
+
+	invoker = setupInvoker(t, `
+type: http
+timeout: 1s
+auth:
+  type: apikey
+  query: api_key
+  keyEnv: BENCH_TEST_TOKEN
+`, server.URL).(*HTTPInvoker)
+	invokeOnce(t, invoker, 0)
+	assert.Equal(t, "t0k3n", record.Query["api_key"][0])
+
+	//secrets must not be part of the workload
+	_, err := newAuthProviderFromConfig(map[string]interface{}{
+		"auth": map[string]interface{}{"type": "bearer", "token": "inline"},
+	})
+	assert.Error(t, err)
+	_, err = newAuthProviderFromConfig(map[string]interface{}{
+		"auth": map[string]interface{}{"type": "bearer", "tokenEnv": "BENCH_TEST_MISSING"},
+	})
+	assert.Error(t, err)
+}
+
+func TestOAuth2Auth(t *testing.T) {
+	fetched := 0
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id, secret, _ := req.BasicAuth()
+		if id != "bench" || secret != "s3cret" || req.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fetched++
+		_, _ = w.Write([]byte(`{"access_token":"access-` + req.FormValue("scope") + `","expires_in":3600}`))
+	}))
+	defer tokens.Close()
+
+	os.Setenv("BENCH_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("BENCH_TEST_SECRET")
+	provider, err := newAuthProviderFromConfig(map[string]interface{}{
+		"auth": map[string]interface{}{
+			"type":            "oauth2",
+			"tokenUrl":        tokens.URL,
+			"clientId":        "bench",
+			"clientSecretEnv": "BENCH_TEST_SECRET",
+			"scopes":          []interface{}{"invoke"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost", nil)
+		assert.NoError(t, provider.Authorize(req, nil))
+		assert.Equal(t, "Bearer access-invoke", req.Header.Get("Authorization"))
+	}
+	assert.Equal(t, 1, fetched)
+
+	//tokens are refreshed before they expire
+	provider.(*OAuth2Auth).expires = time.Now().Add(10 * time.Second)
+	token, err := provider.(*OAuth2Auth).Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "access-invoke", token)
+	assert.Equal(t, 2, fetched)
+}
+
+func TestSigV4Auth(t *testing.T) {
+	//get-vanilla of the aws signature v4 test suite
+	auth := &SigV4Auth{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:          "us-east-1",
+		Service:         "service",
+		now: func() time.Time {
+			return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+		},
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	assert.NoError(t, auth.Authorize(req, nil))
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, "+
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+
+	//signed requests through the invoker carry the session token
+	server, record := newRecordingServer(t, 200, "{}")
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	os.Setenv("AWS_SESSION_TOKEN", "session")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	defer os.Unsetenv("AWS_SESSION_TOKEN")
+	invoker := setupInvoker(t, `
+type: http
+timeout: 1s
+method: post
+body: "{}"
+auth:
+  type: sigv4
+  region: eu-central-1
+  service: lambda
+`, server.URL+"/2015-03-31/functions/echo/invocations").(*HTTPInvoker)
+	invokeOnce(t, invoker, 0)
+	assert.Equal(t, "session", record.Header.Get("X-Amz-Security-Token"))
+	assert.Contains(t, record.Header.Get("Authorization"), "/eu-central-1/lambda/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token,")
+}
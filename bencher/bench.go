@@ -21,6 +21,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"sync"
 	"time"
@@ -32,9 +33,35 @@ type Bencher struct {
 	//Some sort of Logger/Writer
 	//Worker pool
 	Work       Workload
+	Config     BenchmarkConfig //the resolved config, written to the run metadata
+	Build      string          //version of the bench binary, written to the run metadata
+	Seed       int64           //seed of the random generator, a random seed is picked if unset
 	outputfile io.WriteCloser
-	results    *fact.ResultCollector
+	outputName string
+	results    *ResultPipeline
 	Strict     bool
+	Pipeline   PipelineConfig //bounds the memory used for results
+
+	Clock       NTPConfig  //if a server is set, the clock is synced before and after the run
+	ClockBefore *ClockSync //clock offset measured before the first phase
+	ClockAfter  *ClockSync //clock offset measured after the last phase
+
+	timeline     []PhaseRecord
+	timelineLock sync.RWMutex
+	overheads    *overheadCollector
+	pending      sync.WaitGroup //async invocations still awaiting their results
+}
+
+//PhaseRecord marks when a phase was running, in local time.
+type PhaseRecord struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+//TraceObserver can be implemented by a HatchRate to receive every trace collected during a run.
+type TraceObserver interface {
+	Observe(trace *fact.Trace)
 }
 
 func (b *Bencher) openOutput() io.WriteCloser {
@@ -61,31 +88,48 @@ func (b *Bencher) Run() {
 		panic("output file not present!")
 	}
 
-	b.results = fact.NewCollector()
-	writer := fact.NewCSVWriter()
-	writer.Open(resultFile, false)
+	start := time.Now()
+	if b.Seed == 0 {
+		b.Seed = start.UnixNano()
+	}
+	rand.Seed(b.Seed)
 
-	//start periodic write to relax memory needs
-	ticker := time.NewTicker(time.Second * 30)
-	go func() {
-		for range ticker.C {
-			err := b.results.Write(writer)
-			if err != nil {
-				log.Errorf("failed to write results! %f", err)
-			}
+	b.ClockBefore = b.syncClock()
+
+	observers := make([]TraceObserver, 0)
+	for _, phase := range b.Work.Phases {
+		if observer, ok := phase.HatchRate.(TraceObserver); ok {
+			observers = append(observers, observer)
 		}
-	}()
+	}
+	b.overheads = newOverheadCollector()
+	writer := &resultWriter{newTraceCSVWriter(), b}
+	writer.Open(resultFile, false)
+
+	results, err := NewResultPipeline(b.Pipeline, writer, observers...)
+	if err != nil {
+		//the config is checked when the bencher is created, only a changed pipeline ends up here
+		log.Errorf("failed to create result pipeline, aborting - %+v", err)
+		return
+	}
+	b.results = results
+	defer b.results.Close()
 
 	if b.Work.PreRun != nil {
 		err := b.Work.PreRun()
 		if err != nil {
-			log.Error("failed to perform pre run")
+			//phases against a missing deployment only measure errors, the post run cleans up what was deployed
+			log.Errorf("failed to perform pre run, aborting - %+v", err)
+			b.postRun()
+			return
 		}
 	}
 
 	for i, phase := range b.Work.Phases {
 		log.Infof("running phase %d", i)
+		b.startPhase(phase.Name)
 		err := phase.run(b)
+		b.endPhase()
 		if err != nil {
 			log.Errorf("error in phase %d - %f", i, err)
 			if b.Strict {
@@ -94,19 +138,108 @@ func (b *Bencher) Run() {
 		}
 
 	}
+	b.postRun()
+
+	b.ClockAfter = b.syncClock()
+	if b.ClockBefore != nil && b.ClockAfter != nil {
+		log.Infof("clock drifted by %s during the run", b.ClockAfter.Offset-b.ClockBefore.Offset)
+	}
+
+	b.pending.Wait()
+	b.results.Close()
+	stats := b.results.Stats()
+	log.Infof("wrote %d of %d results, dropped %d, failed %d", stats.Written, stats.Added, stats.Dropped, stats.Failed)
+	if stats.WriteFailures > 0 {
+		log.Errorf("failed to write results to disk %d times", stats.WriteFailures)
+	}
+
+	err = b.writeMeta(start, time.Now())
+	if err != nil {
+		log.Errorf("failed to write run metadata - %+v", err)
+	}
+
+	for _, o := range b.Overheads() {
+		log.Infof("phase %s overhead ingress p50:%s p95:%s egress p50:%s p95:%s platform p50:%s p95:%s (n=%d)",
+			o.Phase, o.Ingress.P50, o.Ingress.P95, o.Egress.P50, o.Egress.P95,
+			o.Platform.P50, o.Platform.P95, o.Platform.Count)
+	}
+
+}
+
+func (b *Bencher) postRun() {
 	if b.Work.PostRun != nil {
 		err := b.Work.PostRun()
 		if err != nil {
-			log.Error("failed to perform post run")
+			log.Errorf("failed to perform post run - %+v", err)
 		}
 	}
+}
 
-	err := b.results.Write(writer)
-	if err != nil {
-		log.Errorf("failed to write results to disk - %f", err)
-		log.Error(b.results.GetTraces())
+//Overheads returns the aggregated overheads of each phase of the last run.
+func (b *Bencher) Overheads() []PhaseOverhead {
+	if b.overheads == nil {
+		return nil
 	}
+	return b.overheads.summary()
+}
 
+//Timeline returns the start and end of all phases of the last run.
+func (b *Bencher) Timeline() []PhaseRecord {
+	b.timelineLock.RLock()
+	defer b.timelineLock.RUnlock()
+	dump := make([]PhaseRecord, len(b.timeline))
+	copy(dump, b.timeline)
+	return dump
+}
+
+func (b *Bencher) startPhase(name string) {
+	b.timelineLock.Lock()
+	defer b.timelineLock.Unlock()
+	b.timeline = append(b.timeline, PhaseRecord{Name: name, Start: time.Now()})
+}
+
+func (b *Bencher) endPhase() {
+	b.timelineLock.Lock()
+	defer b.timelineLock.Unlock()
+	if len(b.timeline) > 0 {
+		b.timeline[len(b.timeline)-1].End = time.Now()
+	}
+}
+
+//phaseAt returns the name of the phase running at the given local time
+func (b *Bencher) phaseAt(t time.Time) string {
+	b.timelineLock.RLock()
+	defer b.timelineLock.RUnlock()
+	for i := len(b.timeline) - 1; i >= 0; i-- {
+		record := b.timeline[i]
+		if !t.Before(record.Start) && (record.End.IsZero() || t.Before(record.End)) {
+			return record.Name
+		}
+	}
+	return ""
+}
+
+//resultWriter post-processes all traces before they are written to the output:
+//traces are assigned to their phase, client timestamps are corrected and overheads derived
+type resultWriter struct {
+	fact.TraceWriter
+	b *Bencher
+}
+
+func (w *resultWriter) Write(traces []*fact.Trace) error {
+	for _, t := range traces {
+		var phase string
+		if t.RequestStartTime != nil {
+			phase = w.b.phaseAt(t.RequestStartTime.AsTime())
+		}
+		if w.b.Clock.Correct && w.b.ClockBefore != nil {
+			correctClientTime(t, w.b.ClockBefore.Offset)
+		}
+		overhead := DeriveOverhead(t)
+		overhead.Tag(t)
+		w.b.overheads.add(phase, overhead)
+	}
+	return w.TraceWriter.Write(traces)
 }
 
 func (p *Phase) run(b *Bencher) error {
@@ -114,7 +247,8 @@ func (p *Phase) run(b *Bencher) error {
 		log.Infof("run pre-phase %s", p.Name)
 		err := p.PreRun()
 		if err != nil {
-			log.Errorf("failed to perform pre run in phase %s", p.Name)
+			log.Errorf("failed to perform pre run in phase %s, skipping it", p.Name)
+			return err
 		}
 	}
 
@@ -122,24 +256,32 @@ func (p *Phase) run(b *Bencher) error {
 	signal, err := p.HatchRate.Setup(ctx, p)
 	if err != nil {
 		log.Errorf("failed to setup hatch rate for phase %s", p.Name)
+		cancel()
 		return err
 	}
 
 	err = p.Invocation.Setup(ctx, p, b)
 	if err != nil {
 		log.Errorf("failed to setup invoker for phase %s", p.Name)
+		cancel()
 		return err
 	}
 
 	for i := 0; i < p.Threads; i++ {
 
-		go func(invoker Invoker) {
+		go func(worker int, invoker Invoker) {
+			exec := invoker.Exec
+			if workerInvoker, ok := invoker.(WorkerInvoker); ok {
+				exec = func(rate HatchRate) error {
+					return workerInvoker.ExecAs(worker, rate)
+				}
+			}
 			for {
 				select {
 				case <-ctx.Done():
 					return
 				default:
-					err := invoker.Exec(p.HatchRate)
+					err := exec(p.HatchRate)
 					if err != nil {
 						if b.Strict {
 							p.HatchRate.Close()
@@ -150,7 +292,7 @@ func (p *Phase) run(b *Bencher) error {
 				}
 
 			}
-		}(p.Invocation)
+		}(i, p.Invocation)
 	}
 
 	waitOn(signal, &p.Timeout)
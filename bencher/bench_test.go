@@ -19,15 +19,23 @@ package bencher
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/faas-facts/fact/fact"
 	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
@@ -139,4 +147,289 @@ func TestBencherRun(t *testing.T) {
 	bencher.Run()
 
 	logfile.Print()
+
+	overheads := bencher.Overheads()
+	if assert.Len(t, overheads, 1) {
+		assert.Equal(t, "30trps", overheads[0].Phase)
+		assert.True(t, overheads[0].Platform.Count > 0)
+	}
+}
+
+func TestBencherPreRunFailed(t *testing.T) {
+	var phaseRan, cleanedUp bool
+	bencher := Bencher{
+		outputfile: newOutput(),
+		Work: Workload{
+			Name: "test",
+			PreRun: func() error {
+				return fmt.Errorf("deploy failed")
+			},
+			Phases: []Phase{
+				{
+					Name:       "steady",
+					Threads:    1,
+					HatchRate:  &NoopRate{},
+					Timeout:    time.Second,
+					Invocation: &countingInvoker{},
+					PreRun: func() error {
+						phaseRan = true
+						return nil
+					},
+				},
+			},
+			PostRun: func() error {
+				cleanedUp = true
+				return nil
+			},
+		},
+	}
+
+	bencher.Run()
+	assert.False(t, phaseRan)
+	assert.True(t, cleanedUp)
+}
+
+func TestDeriveOverhead(t *testing.T) {
+	start := time.Now()
+	trace := &fact.Trace{
+		RequestStartTime:       timestamppb.New(start),
+		StartTime:              timestamppb.New(start.Add(time.Millisecond * 20)),
+		EndTime:                timestamppb.New(start.Add(time.Millisecond * 120)),
+		RequestEndTime:         timestamppb.New(start.Add(time.Millisecond * 150)),
+		RequestResponseLatency: durationpb.New(time.Millisecond * 150),
+		ExecutionLatency:       durationpb.New(time.Millisecond * 100),
+	}
+
+	overhead := DeriveOverhead(trace)
+	assert.Equal(t, time.Millisecond*20, overhead.Ingress)
+	assert.Equal(t, time.Millisecond*30, overhead.Egress)
+	assert.Equal(t, time.Millisecond*50, overhead.Platform)
+
+	overhead.Tag(trace)
+	assert.Equal(t, strconv.FormatInt(int64(time.Millisecond*50), 10), trace.Tags[PlatformOverheadTag])
+
+	assert.False(t, DeriveOverhead(&fact.Trace{}).HasPlatform)
+}
+
+func TestOverheadCollector(t *testing.T) {
+	collector := newOverheadCollector()
+	n := 3 * overheadReservoirSize
+	for i := 1; i <= n; i++ {
+		collector.add("phase", Overhead{Platform: time.Duration(i) * time.Microsecond, HasPlatform: true})
+	}
+	//memory is bounded, count, min, mean and max stay exact
+	assert.Len(t, collector.phases["phase"].platform.samples, overheadReservoirSize)
+	summary := collector.summary()
+	if assert.Len(t, summary, 1) {
+		platform := summary[0].Platform
+		assert.Equal(t, n, platform.Count)
+		assert.Equal(t, time.Microsecond, platform.Min)
+		assert.Equal(t, time.Duration(n)*time.Microsecond, platform.Max)
+		assert.Equal(t, time.Duration(n+1)*time.Microsecond/2, platform.Mean)
+		assert.InDelta(t, float64(n/2), float64(platform.P50/time.Microsecond), float64(n)/20)
+		assert.Equal(t, 0, summary[0].Ingress.Count)
+	}
+}
+
+func TestDeriveOverheadHTTP(t *testing.T) {
+	//the platform holds the request before the function reports 10ms of execution
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		data, _ := json.Marshal(fact.Trace{ExecutionLatency: durationpb.New(10 * time.Millisecond)})
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+
+	invoker := setupInvoker(t, `
+type: http
+timeout: 1s
+`, server.URL).(*HTTPInvoker)
+	overhead := DeriveOverhead(invokeOnce(t, invoker, 0))
+	assert.True(t, overhead.HasPlatform)
+	assert.GreaterOrEqual(t, overhead.Platform, 40*time.Millisecond)
+}
+
+//serveNTP answers ntp client requests with the local time shifted by skew
+func serveNTP(t *testing.T, skew time.Duration) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	ntpTime := func(t time.Time) uint64 {
+		sec := uint64(t.Unix() + 2208988800)
+		frac := uint64(t.Nanosecond()) << 32 / 1e9
+		return sec<<32 | frac
+	}
+
+	go func() {
+		buf := make([]byte, 48)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 48 {
+				continue
+			}
+			now := time.Now().Add(skew)
+			resp := make([]byte, 48)
+			resp[0] = 4<<3 | 4 //version 4, server mode
+			resp[1] = 1        //stratum
+			binary.BigEndian.PutUint64(resp[16:], ntpTime(now))
+			copy(resp[24:32], buf[40:48])
+			binary.BigEndian.PutUint64(resp[32:], ntpTime(now))
+			binary.BigEndian.PutUint64(resp[40:], ntpTime(now))
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestQueryClock(t *testing.T) {
+	skew := time.Second * 3
+	server := serveNTP(t, skew)
+
+	clock, err := QueryClock(NTPConfig{Server: server, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.InDelta(t, float64(skew), float64(clock.Offset), float64(time.Millisecond*50))
+
+	start := time.Now()
+	trace := &fact.Trace{
+		RequestStartTime: timestamppb.New(start),
+		RequestEndTime:   timestamppb.New(start.Add(time.Second)),
+	}
+	correctClientTime(trace, clock.Offset)
+	assert.Equal(t, start.Add(clock.Offset).UnixNano(), trace.RequestStartTime.AsTime().UnixNano())
+	assert.Equal(t, time.Second, trace.RequestEndTime.AsTime().Sub(trace.RequestStartTime.AsTime()))
+}
+
+func TestWriteMeta(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "run.csv")
+	bencher := &Bencher{
+		Config: BenchmarkConfig{
+			OutputFile: output,
+			Workload: WorkloadConfig{
+				Name: "meta",
+				Invocation: InvokerConfig{
+					Type: "ow",
+					Options: map[string]interface{}{
+						"host":  "localhost",
+						"token": "23bc46b1-71f6-4ed5-8c54",
+						"headers": map[string]interface{}{
+							"Authorization": "Bearer abc",
+						},
+					},
+				},
+			},
+		},
+		Build:      "test",
+		Seed:       42,
+		outputName: output,
+	}
+
+	err := bencher.writeMeta(time.Now(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(output), "run.meta.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(data), "23bc46b1")
+	assert.NotContains(t, string(data), "Bearer abc")
+	assert.Contains(t, string(data), "localhost")
+
+	var meta RunMeta
+	assert.NoError(t, json.Unmarshal(data, &meta))
+	assert.Equal(t, int64(42), meta.Seed)
+	assert.Equal(t, "test", meta.Build)
+	assert.Equal(t, "23bc46b1-71f6-4ed5-8c54", bencher.Config.Workload.Invocation.Options["token"])
+}
+
+//slowWriter counts written traces and simulates a slow disk
+type slowWriter struct {
+	delay   time.Duration
+	written int
+}
+
+func (w *slowWriter) Name() string         { return "slow" }
+func (w *slowWriter) Open(io.Writer, bool) {}
+func (w *slowWriter) Write(traces []*fact.Trace) error {
+	<-time.After(w.delay)
+	w.written += len(traces)
+	return nil
+}
+
+func TestResultPipeline(t *testing.T) {
+	config := PipelineConfig{
+		QueueSize:     10,
+		BatchSize:     5,
+		FlushInterval: time.Millisecond * 10,
+		Overflow:      OverflowDrop,
+	}
+
+	writer := &slowWriter{delay: time.Millisecond * 20}
+	pipeline, err := NewResultPipeline(config, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		pipeline.Add(&fact.Trace{ID: strconv.Itoa(i)})
+	}
+	pipeline.Close()
+
+	stats := pipeline.Stats()
+	assert.Equal(t, uint64(200), stats.Added)
+	assert.True(t, stats.Dropped > 0)
+	assert.Equal(t, stats.Added, stats.Written+stats.Dropped)
+	assert.Equal(t, int(stats.Written), writer.written)
+	assert.LessOrEqual(t, stats.MaxQueueDepth, config.QueueSize)
+
+	config.Overflow = OverflowBlock
+	writer = &slowWriter{delay: time.Millisecond}
+	pipeline, err = NewResultPipeline(config, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		pipeline.Add(&fact.Trace{ID: strconv.Itoa(i)})
+	}
+	pipeline.Close()
+	assert.Equal(t, 200, writer.written)
+
+	_, err = NewResultPipeline(PipelineConfig{Overflow: OverflowSample}, writer)
+	assert.Error(t, err)
+}
+
+func TestBencherPipelineConfig(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "run.csv")
+	config := BenchmarkConfig{
+		OutputFile: output,
+		Pipeline:   PipelineConfig{Overflow: "drops"},
+	}
+
+	//invalid pipelines are rejected before the output is created
+	_, err := BencherFromConfig(config, Workload{Name: "pipeline"})
+	assert.Error(t, err)
+	_, err = os.Stat(output)
+	assert.True(t, os.IsNotExist(err))
+
+	config.Pipeline = PipelineConfig{Overflow: OverflowSample, SampleRate: 2}
+	_, err = BencherFromConfig(config, Workload{Name: "pipeline"})
+	assert.Error(t, err)
+
+	config.Pipeline = PipelineConfig{Overflow: " Drop "}
+	bencher, err := BencherFromConfig(config, Workload{Name: "pipeline"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bencher.outputfile.Close()
+	assert.Equal(t, OverflowDrop, bencher.Pipeline.Overflow)
+	assert.Equal(t, defaultQueueSize, bencher.Pipeline.QueueSize)
 }
@@ -0,0 +1,330 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/runtime/protoimpl"
+)
+
+//Tags set on traces of invocations that complete with a callback
+const (
+	CorrelationIDTag     = "CorrelationID"
+	SubmitLatencyTag     = "SubmitLatency"     //time until the invocation was accepted, in ns
+	CompletionLatencyTag = "CompletionLatency" //time until the callback arrived, in ns
+	CallbackLostTag      = "CallbackLost"      //true if no callback arrived within the timeout
+)
+
+//CorrelationHeader carries the correlation id in requests and callbacks
+const CorrelationHeader = "X-Correlation-ID"
+
+//maxCallbackBody limits how much of a callback is read, larger bodies are not parsed as a trace
+const maxCallbackBody = 1 << 20
+
+//CallbackReceiver runs an embedded http server during a phase that matches callbacks of async invocations to their requests.
+//Callbacks are posted to <URL>/<correlation id>, the id can also be sent in the X-Correlation-ID header or the id query parameter.
+type CallbackReceiver struct {
+	Listen  string        //address of the embedded server, e.g. :9000
+	URL     string        //base url the platform reaches the server at, derived from the hostname if empty
+	Timeout time.Duration //callbacks arriving later are counted as lost
+
+	base    string
+	pending map[string]*pendingCallback
+	early   map[string]*earlyCallback
+	results *ResultPipeline
+	done    chan struct{}
+	closed  bool
+	sync.Mutex
+}
+
+type pendingCallback struct {
+	trace     *fact.Trace
+	submitted time.Time
+}
+
+//earlyCallback arrived before the response of its invocation was submitted, fast functions may call back first
+type earlyCallback struct {
+	arrived time.Time
+	header  http.Header
+	body    []byte
+}
+
+func newCallbackReceiverFromConfig(options map[string]interface{}) (*CallbackReceiver, error) {
+	val, ok := options["callback"]
+	if !ok || val == nil {
+		return nil, nil
+	}
+	config, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("callback must be a map")
+	}
+
+	timeout, err := time.ParseDuration(stringValue("timeout", config, "60s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid callback timeout - %+v", err)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("callback timeout must be positive")
+	}
+
+	return &CallbackReceiver{
+		Listen:  stringValue("listen", config, ":9000"),
+		URL:     strings.TrimRight(stringValue("url", config, ""), "/"),
+		Timeout: timeout,
+	}, nil
+}
+
+//Start serves callbacks until the phase is done, outstanding callbacks are awaited for up to the timeout afterwards.
+func (c *CallbackReceiver) Start(ctx context.Context, bencher *Bencher) error {
+	//the previous phase releases the address once its callbacks are drained
+	if c.done != nil {
+		<-c.done
+	}
+
+	listener, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to start callback receiver - %+v", err)
+	}
+
+	base := c.URL
+	if base == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "localhost"
+		}
+		base = fmt.Sprintf("http://%s:%d", hostname, listener.Addr().(*net.TCPAddr).Port)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(c.receive)}
+	done := make(chan struct{})
+
+	c.Lock()
+	c.base = base
+	c.pending = make(map[string]*pendingCallback)
+	c.early = make(map[string]*earlyCallback)
+	c.results = bencher.results
+	c.done = done
+	c.closed = false
+	c.Unlock()
+
+	bencher.pending.Add(1)
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("callback receiver failed - %+v", err)
+		}
+	}()
+	go func() {
+		defer bencher.pending.Done()
+		defer close(done)
+		c.watch(ctx)
+
+		shutdown, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdown)
+	}()
+
+	log.Infof("receiving callbacks at %s", base)
+	return nil
+}
+
+//watch expires pending callbacks until the phase is done and all of them completed or expired
+func (c *CallbackReceiver) watch(ctx context.Context) {
+	interval := c.Timeout / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for !c.drained() {
+				c.expire(<-ticker.C)
+			}
+			return
+		case now := <-ticker.C:
+			c.expire(now)
+		}
+	}
+}
+
+//drained closes the receiver once no callbacks are pending, later submits are lost
+func (c *CallbackReceiver) drained() bool {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.pending) == 0 {
+		c.closed = true
+	}
+	return c.closed
+}
+
+func (c *CallbackReceiver) expire(now time.Time) {
+	var lost []*fact.Trace
+	c.Lock()
+	for id, p := range c.pending {
+		if now.Sub(p.submitted) >= c.Timeout {
+			delete(c.pending, id)
+			lost = append(lost, p.trace)
+		}
+	}
+	for id, e := range c.early {
+		if now.Sub(e.arrived) >= c.Timeout {
+			//duplicate or foreign callbacks
+			log.Debugf("no pending invocation for callback %s", id)
+			delete(c.early, id)
+		}
+	}
+	results := c.results
+	c.Unlock()
+
+	for _, trace := range lost {
+		c.markLost(trace)
+		results.Add(trace)
+	}
+}
+
+func (c *CallbackReceiver) markLost(trace *fact.Trace) {
+	if trace.Tags == nil {
+		trace.Tags = make(map[string]string)
+	}
+	trace.Tags[CallbackLostTag] = "true"
+	markFailed(trace, fmt.Errorf("no callback within %s", c.Timeout))
+}
+
+//URLFor returns the url the invocation with the correlation id calls back to
+func (c *CallbackReceiver) URLFor(id string) string {
+	c.Lock()
+	defer c.Unlock()
+	return c.base + "/" + url.PathEscape(id)
+}
+
+//Submit holds the trace of an accepted invocation until its callback arrives or it times out
+func (c *CallbackReceiver) Submit(trace *fact.Trace) {
+	id := trace.Tags[CorrelationIDTag]
+	if id != "" && trace.RequestResponseLatency != nil {
+		trace.Tags[SubmitLatencyTag] = strconv.FormatInt(trace.RequestResponseLatency.AsDuration().Nanoseconds(), 10)
+	}
+
+	c.Lock()
+	results := c.results
+	if id == "" {
+		c.Unlock()
+		results.Add(trace)
+		return
+	}
+	if e, ok := c.early[id]; ok {
+		delete(c.early, id)
+		c.Unlock()
+		completeCallback(trace, e.arrived, e.header, e.body)
+		results.Add(trace)
+		return
+	}
+	if c.closed {
+		c.Unlock()
+		c.markLost(trace)
+		results.Add(trace)
+		return
+	}
+	c.pending[id] = &pendingCallback{trace: trace, submitted: time.Now()}
+	c.Unlock()
+}
+
+func (c *CallbackReceiver) receive(w http.ResponseWriter, req *http.Request) {
+	arrived := time.Now()
+
+	id := path.Base(req.URL.Path)
+	if id == "/" || id == "." {
+		id = req.Header.Get(CorrelationHeader)
+	}
+	if id == "" {
+		id = req.URL.Query().Get("id")
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(req.Body, maxCallbackBody))
+
+	c.Lock()
+	p, ok := c.pending[id]
+	if ok {
+		delete(c.pending, id)
+	} else if !c.closed && id != "" {
+		//held until the invocation is submitted or the timeout passed
+		c.early[id] = &earlyCallback{arrived: arrived, header: req.Header, body: body}
+	}
+	closed := c.closed
+	results := c.results
+	c.Unlock()
+
+	if !ok {
+		if closed || id == "" {
+			//late or foreign callbacks
+			log.Debugf("no pending invocation for callback %s", id)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	completeCallback(p.trace, arrived, req.Header, body)
+	results.Add(p.trace)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//completeCallback adds the callback to the trace, functions instrumented with fact can post their trace as the body
+func completeCallback(trace *fact.Trace, arrived time.Time, header http.Header, body []byte) {
+	var reported fact.Trace
+	if len(body) > 0 && json.Unmarshal(body, &reported) == nil {
+		//the request side of the trace was measured by the bench
+		reported.ID = ""
+		reported.Status = 0
+		reported.RequestStartTime = nil
+		reported.RequestEndTime = nil
+		reported.RequestResponseLatency = nil
+		proto.Merge(protoimpl.X.ProtoMessageV2Of(trace), protoimpl.X.ProtoMessageV2Of(&reported))
+	}
+
+	if trace.Tags == nil {
+		trace.Tags = make(map[string]string)
+	}
+	if trace.RequestStartTime != nil {
+		trace.Tags[CompletionLatencyTag] = strconv.FormatInt(arrived.Sub(trace.RequestStartTime.AsTime()).Nanoseconds(), 10)
+	}
+
+	//the OpenFaaS queue worker reports the status of the function
+	if status := header.Get("X-Function-Status"); status != "" {
+		if code, err := strconv.Atoi(status); err == nil && code >= 400 {
+			markFailed(trace, fmt.Errorf("function failed with status %d", code))
+		}
+	}
+}
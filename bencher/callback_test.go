@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallbackReceiver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		callback := req.Header.Get("X-Callback-Url")
+		w.WriteHeader(http.StatusAccepted)
+		if string(body) == "lost" {
+			return
+		}
+		status := "200"
+		if string(body) == "fail" {
+			status = "500"
+		}
+		go func() {
+			post, _ := http.NewRequest(http.MethodPost, callback, strings.NewReader(`{"ContainerID":"c1"}`))
+			post.Header.Set("X-Function-Status", status)
+			resp, err := http.DefaultClient.Do(post)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}))
+	defer server.Close()
+
+	writer := &collectingWriter{}
+	results, err := NewResultPipeline(PipelineConfig{}, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bencher := &Bencher{results: results}
+
+	rate := &outcomeRate{}
+	for _, body := range []string{"ok", "fail", "lost"} {
+		invoker, err := NewInvokerFromConfig(InvokerConfig{Type: "http", Options: map[string]interface{}{
+			"timeout": "5s",
+			"method":  "POST",
+			"body":    body,
+			"assert":  map[string]interface{}{"status": []interface{}{202}},
+			"callback": map[string]interface{}{
+				"listen":  "127.0.0.1:0",
+				"timeout": "200ms",
+			},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		assert.NoError(t, invoker.Setup(ctx, &Phase{Threads: 1, Target: server.URL}, bencher))
+		assert.NoError(t, invoker.Exec(rate))
+		cancel()
+	}
+	bencher.pending.Wait()
+	results.Close()
+
+	//submitting counts as success, the outcome is in the traces
+	assert.Equal(t, 3, rate.success)
+	assert.Len(t, writer.traces, 3)
+	outcomes := make(map[string]int)
+	for _, trace := range writer.traces {
+		assert.NotEmpty(t, trace.Tags[CorrelationIDTag])
+		assert.NotEmpty(t, trace.Tags[SubmitLatencyTag])
+		switch {
+		case trace.Tags[CallbackLostTag] == "true":
+			outcomes["lost"]++
+			assert.True(t, isFailed(trace))
+			assert.Empty(t, trace.Tags[CompletionLatencyTag])
+		case isFailed(trace):
+			outcomes["fail"]++
+		default:
+			outcomes["ok"]++
+			assert.Equal(t, "c1", trace.ContainerID)
+			assert.NotEmpty(t, trace.Tags[CompletionLatencyTag])
+		}
+	}
+	assert.Equal(t, map[string]int{"ok": 1, "fail": 1, "lost": 1}, outcomes)
+}
+
+func TestCallbackBeforeSubmit(t *testing.T) {
+	writer := &collectingWriter{}
+	results, err := NewResultPipeline(PipelineConfig{}, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bencher := &Bencher{results: results}
+
+	receiver := &CallbackReceiver{Listen: "127.0.0.1:0", Timeout: time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, receiver.Start(ctx, bencher))
+	callback, err := url.Parse(receiver.URLFor("early"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback.Host = "127.0.0.1:" + callback.Port()
+
+	//the function calls back before the response of its invocation is handled
+	resp, err := http.Post(callback.String(), "application/json", strings.NewReader(`{"ContainerID":"c1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	receiver.Submit(&fact.Trace{ID: "early", Tags: map[string]string{CorrelationIDTag: "early"}})
+	cancel()
+	bencher.pending.Wait()
+	results.Close()
+
+	if assert.Len(t, writer.traces, 1) {
+		assert.False(t, isFailed(writer.traces[0]))
+		assert.Equal(t, "c1", writer.traces[0].ContainerID)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/beevik/ntp"
+	"github.com/faas-facts/fact/fact"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//NTPConfig configures the clock alignment between the bench and the platform.
+type NTPConfig struct {
+	Server  string        `json:"server" yaml:"server"`   //ntp server, either host or host:port
+	Timeout time.Duration `json:"timeout" yaml:"timeout"` //max time to wait for the server, defaults to 5s
+	Correct bool          `json:"correct" yaml:"correct"` //if set, all client timestamps are shifted by the measured offset
+}
+
+//ClockSync is a single measurement of the local clock against a ntp server.
+type ClockSync struct {
+	Server string        `json:"server"`
+	Time   time.Time     `json:"time"`   //local time of the measurement
+	Offset time.Duration `json:"offset"` //add to the local clock to get the server time
+	RTT    time.Duration `json:"rtt"`
+}
+
+//QueryClock measures the offset of the local clock to the configured ntp server.
+func QueryClock(config NTPConfig) (*ClockSync, error) {
+	if config.Server == "" {
+		return nil, fmt.Errorf("no ntp server configured")
+	}
+
+	host := config.Server
+	port := 0
+	if h, p, err := net.SplitHostPort(config.Server); err == nil {
+		host = h
+		port, err = strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ntp port %s", p)
+		}
+	}
+
+	start := time.Now()
+	resp, err := ntp.QueryWithOptions(host, ntp.QueryOptions{
+		Timeout: config.Timeout,
+		Port:    port,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = resp.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &ClockSync{
+		Server: config.Server,
+		Time:   start,
+		Offset: resp.ClockOffset,
+		RTT:    resp.RTT,
+	}, nil
+}
+
+//syncClock queries the ntp server if configured, failures are logged but never stop a run
+func (b *Bencher) syncClock() *ClockSync {
+	if b.Clock.Server == "" {
+		return nil
+	}
+	clock, err := QueryClock(b.Clock)
+	if err != nil {
+		log.Warnf("failed to query ntp server %s - %+v", b.Clock.Server, err)
+		return nil
+	}
+	log.Infof("clock offset to %s is %s (rtt %s)", clock.Server, clock.Offset, clock.RTT)
+	return clock
+}
+
+func correctClientTime(t *fact.Trace, offset time.Duration) {
+	if t.RequestStartTime != nil {
+		t.RequestStartTime = timestamppb.New(t.RequestStartTime.AsTime().Add(offset))
+	}
+	if t.RequestEndTime != nil {
+		t.RequestEndTime = timestamppb.New(t.RequestEndTime.AsTime().Add(offset))
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"encoding/csv"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/faas-facts/fact/fact"
+)
+
+//csvFixedTags always get a column, they are derived for every trace but may be missing in the first batch
+var csvFixedTags = []string{IngressOverheadTag, EgressOverheadTag, PlatformOverheadTag}
+
+//Overflow columns of env and tag keys first seen after the header was written, url encoded
+const (
+	csvOtherEnv  = "E_Other"
+	csvOtherTags = "T_Other"
+)
+
+//traceCSVWriter writes the columns of fact.CSVWriter, but keeps the env and tag columns of the first batch for all batches.
+//The pipeline flushes many batches into one file with a single header, keys of later batches go to the overflow columns.
+type traceCSVWriter struct {
+	sink   io.Writer
+	append bool
+
+	header    []string
+	env       map[string]int
+	tags      map[string]int
+	otherEnv  int
+	otherTags int
+}
+
+func newTraceCSVWriter() fact.TraceWriter {
+	return &traceCSVWriter{}
+}
+
+func (c *traceCSVWriter) Name() string {
+	return "CSV"
+}
+
+func (c *traceCSVWriter) Open(writer io.Writer, append bool) {
+	c.sink = writer
+	c.append = append
+}
+
+//columns fixes the env and tag columns from the keys of the first batch
+func (c *traceCSVWriter) columns(traces []*fact.Trace) {
+	envKeys := make(map[string]bool)
+	tagKeys := make(map[string]bool)
+	for _, k := range csvFixedTags {
+		tagKeys[k] = true
+	}
+	for _, t := range traces {
+		for k := range t.Env {
+			envKeys[k] = true
+		}
+		for k := range t.Tags {
+			tagKeys[k] = true
+		}
+	}
+
+	c.header = []string{
+		"ID", "ChildOf", "Timestamp", "CId", "HId", "CStart",
+		"ECost", "RStart", "EStart", "ECode", "EEnd", "REnd",
+		"Version", "CVersion", "Provider", "Region",
+		"COs", "CMem", "ELat", "RLat", "DLat", "TLat",
+	}
+	c.env = make(map[string]int)
+	for _, k := range sortedKeys(envKeys) {
+		c.env[k] = len(c.header)
+		c.header = append(c.header, "E_"+k)
+	}
+	c.otherEnv = len(c.header)
+	c.header = append(c.header, csvOtherEnv)
+	c.tags = make(map[string]int)
+	for _, k := range sortedKeys(tagKeys) {
+		c.tags[k] = len(c.header)
+		c.header = append(c.header, "T_"+k)
+	}
+	c.otherTags = len(c.header)
+	c.header = append(c.header, csvOtherTags)
+}
+
+func sortedKeys(keys map[string]bool) []string {
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+//Write does not output Logs or Args, as fact.CSVWriter
+func (c *traceCSVWriter) Write(traces []*fact.Trace) error {
+	if c.header == nil {
+		c.columns(traces)
+	}
+
+	w := csv.NewWriter(c.sink)
+	if !c.append {
+		if err := w.Write(c.header); err != nil {
+			return err
+		}
+		c.append = true
+	}
+
+	for _, t := range traces {
+		record := make([]string, len(c.header))
+		record[0] = t.ID
+		record[1] = t.ChildOf
+		record[2] = strconv.FormatInt(t.StartTime.GetSeconds(), 10)
+		record[3] = t.ContainerID
+		record[4] = t.HostID
+		record[5] = strconv.FormatInt(t.BootTime.GetSeconds(), 10)
+		record[6] = strconv.FormatFloat(float64(t.Cost), 'E', -1, 32)
+		record[7] = strconv.FormatInt(t.RequestStartTime.GetSeconds(), 10)
+		record[8] = strconv.FormatInt(t.StartTime.GetSeconds(), 10)
+		record[9] = strconv.Itoa(int(t.Status))
+		record[10] = strconv.FormatInt(t.EndTime.GetSeconds(), 10)
+		record[11] = strconv.FormatInt(t.RequestEndTime.GetSeconds(), 10)
+		record[12] = t.CodeVersion
+		record[13] = t.ConfigVersion
+		record[14] = t.Platform
+		record[15] = t.Region
+		record[16] = t.Runtime
+		record[17] = strconv.Itoa(int(t.Memory))
+		record[18] = strconv.FormatInt(int64(t.ExecutionLatency.AsDuration()), 10)
+		record[19] = strconv.FormatInt(int64(t.RequestResponseLatency.AsDuration()), 10)
+		record[20] = strconv.FormatInt(int64(t.ExecutionDelay.AsDuration()), 10)
+		record[21] = strconv.FormatInt(int64(t.TransportDelay.AsDuration()), 10)
+
+		record[c.otherEnv] = overflow(t.Env, c.env)
+		for k, v := range t.Env {
+			if idx, ok := c.env[k]; ok {
+				record[idx] = v
+			}
+		}
+		record[c.otherTags] = overflow(t.Tags, c.tags)
+		for k, v := range t.Tags {
+			if idx, ok := c.tags[k]; ok {
+				record[idx] = v
+			}
+		}
+
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+//overflow encodes the values without a column
+func overflow(values map[string]string, columns map[string]int) string {
+	other := url.Values{}
+	for k, v := range values {
+		if _, ok := columns[k]; !ok {
+			other.Set(k, v)
+		}
+	}
+	return other.Encode()
+}
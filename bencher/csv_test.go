@@ -0,0 +1,60 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+
+	"github.com/faas-facts/fact/fact"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceCSVWriter(t *testing.T) {
+	var out bytes.Buffer
+	writer := newTraceCSVWriter()
+	writer.Open(&out, false)
+
+	assert.NoError(t, writer.Write([]*fact.Trace{
+		{ID: "a", Status: 200, Tags: map[string]string{"Zone": "a"}},
+	}))
+	//later batches keep the columns, even with more tags
+	assert.NoError(t, writer.Write([]*fact.Trace{
+		{ID: "b", Status: 503, Tags: map[string]string{PlatformOverheadTag: "42", "Zone": "b", "Late": "x"}},
+		{ID: "c", Env: map[string]string{"Region": "eu"}},
+	}))
+
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, records, 4) {
+		return
+	}
+	column := make(map[string]int)
+	for i, name := range records[0] {
+		column[name] = i
+	}
+	assert.Equal(t, "200", records[1][column["ECode"]])
+	assert.Equal(t, "a", records[1][column["T_Zone"]])
+	assert.Equal(t, "b", records[2][column["T_Zone"]])
+	assert.Equal(t, "42", records[2][column["T_"+PlatformOverheadTag]])
+	assert.Equal(t, "Late=x", records[2][column[csvOtherTags]])
+	assert.Equal(t, "Region=eu", records[3][column[csvOtherEnv]])
+}
@@ -68,6 +68,11 @@ func BencherFromConfig(config BenchmarkConfig, workload Workload) (*Bencher, err
 		outfile = strings.Replace(outfile, "$name", workload.Name, -1)
 	}
 
+	pipeline, err := config.Pipeline.withDefaults()
+	if err != nil {
+		return nil, fmt.Errorf("invalid pipeline config - %+v", err)
+	}
+
 	//check if file exsist or can be created
 	out, err := os.OpenFile(outfile, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0664)
 	if err != nil {
@@ -76,8 +81,13 @@ func BencherFromConfig(config BenchmarkConfig, workload Workload) (*Bencher, err
 
 	return &Bencher{
 		Work:       workload,
+		Config:     config,
+		Seed:       config.Seed,
 		outputfile: out,
+		outputName: outfile,
 		Strict:     false,
+		Clock:      config.NTP,
+		Pipeline:   pipeline,
 	}, nil
 }
 
@@ -0,0 +1,202 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//Tags set from platform response headers
+const (
+	CallIDTag              = "CallID"              //X-Call-Id of the OpenFaaS gateway
+	UpstreamServiceTimeTag = "UpstreamServiceTime" //X-Envoy-Upstream-Service-Time of the Knative ingress, in ms
+)
+
+//OpenFaaSInvoker calls functions through the OpenFaaS gateway, the target of the phase is the function name.
+//Async invocations are queued with /async-function/, the result is sent to the CallbackURL.
+type OpenFaaSInvoker struct {
+	*HTTPInvoker
+	Gateway     string
+	Function    string
+	Async       bool
+	CallbackURL string
+}
+
+func newOpenFaaSInvoker(config InvokerConfig) (Invoker, error) {
+	options := make(map[string]interface{})
+	for k, v := range config.Options {
+		options[k] = v
+	}
+	//functions are usually invoked with a body, async invocations need a POST
+	if _, ok := options["method"]; !ok {
+		options["method"] = http.MethodPost
+	}
+
+	invoker, err := newHttpInvoker(InvokerConfig{Type: "http", Options: options})
+	if err != nil {
+		return nil, err
+	}
+
+	gateway := os.Getenv("OPENFAAS_URL")
+	if gateway == "" {
+		gateway = "http://127.0.0.1:8080"
+	}
+
+	o := &OpenFaaSInvoker{
+		HTTPInvoker: invoker.(*HTTPInvoker),
+		Gateway:     strings.TrimRight(stringValue("gateway", config.Options, gateway), "/"),
+		Function:    stringValue("function", config.Options, ""),
+		Async:       flagValue("async", config.Options, false),
+		CallbackURL: stringValue("callbackUrl", config.Options, ""),
+	}
+	if o.Async && o.Method != http.MethodPost {
+		return nil, fmt.Errorf("async invocations need the POST method")
+	}
+	if o.Async {
+		if o.CallbackURL != "" {
+			o.Header.Set("X-Callback-Url", o.CallbackURL)
+		}
+		//the gateway only accepts the request, so 202 counts as a success
+		if o.Assertions == nil {
+			o.Assertions = &Assertions{
+				Status:  []int{http.StatusAccepted},
+				JSON:    make(map[string]interface{}),
+				Headers: make(map[string]string),
+			}
+		}
+	}
+	o.onResponse = readOpenFaaSHeaders
+	return o, nil
+}
+
+func (o *OpenFaaSInvoker) Setup(ctx context.Context, phase *Phase, bencher *Bencher) error {
+	function := o.Function
+	if function == "" {
+		function = phase.Target
+	}
+	path := "/function/"
+	if o.Async {
+		path = "/async-function/"
+	}
+
+	gatewayPhase := *phase
+	gatewayPhase.Target = o.Gateway + path + function
+	return o.HTTPInvoker.Setup(ctx, &gatewayPhase, bencher)
+}
+
+//readOpenFaaSHeaders maps the gateway headers onto the trace, values reported by the function itself are kept
+func readOpenFaaSHeaders(result *fact.Trace, header http.Header) {
+	if result.Tags == nil {
+		result.Tags = make(map[string]string)
+	}
+	if result.Platform == "" {
+		result.Platform = "openfaas"
+	}
+	if callID := header.Get("X-Call-Id"); callID != "" {
+		result.Tags[CallIDTag] = callID
+	}
+
+	var duration time.Duration
+	if val := header.Get("X-Duration-Seconds"); val != "" {
+		if seconds, err := strconv.ParseFloat(val, 64); err == nil {
+			duration = time.Duration(seconds * float64(time.Second))
+			if result.ExecutionLatency == nil {
+				result.ExecutionLatency = durationpb.New(duration)
+			}
+		}
+	}
+	if val := header.Get("X-Start-Time"); val != "" {
+		if nanos, err := strconv.ParseInt(val, 10, 64); err == nil && result.StartTime == nil {
+			start := time.Unix(0, nanos)
+			result.StartTime = timestamppb.New(start)
+			if duration > 0 && result.EndTime == nil {
+				result.EndTime = timestamppb.New(start.Add(duration))
+			}
+		}
+	}
+}
+
+//KnativeInvoker calls a Knative service through the ingress, the target of the phase is the service name.
+//Requests are routed with the host header <service>.<namespace>.<domain>.
+type KnativeInvoker struct {
+	*HTTPInvoker
+	Ingress   string
+	Path      string
+	Service   string
+	Namespace string
+	Domain    string
+}
+
+func newKnativeInvoker(config InvokerConfig) (Invoker, error) {
+	if !checkFields(config.Options, "ingress") {
+		return nil, fmt.Errorf("knative needs the address of the ingress")
+	}
+	invoker, err := newHttpInvoker(InvokerConfig{Type: "http", Options: config.Options})
+	if err != nil {
+		return nil, err
+	}
+
+	k := &KnativeInvoker{
+		HTTPInvoker: invoker.(*HTTPInvoker),
+		Ingress:     strings.TrimRight(stringValue("ingress", config.Options, ""), "/"),
+		Path:        stringValue("path", config.Options, "/"),
+		Service:     stringValue("service", config.Options, ""),
+		Namespace:   stringValue("namespace", config.Options, "default"),
+		Domain:      stringValue("domain", config.Options, "example.com"),
+	}
+	k.onResponse = readKnativeHeaders
+	return k, nil
+}
+
+func (k *KnativeInvoker) Setup(ctx context.Context, phase *Phase, bencher *Bencher) error {
+	service := k.Service
+	if service == "" {
+		service = phase.Target
+	}
+	//an explicit host option wins over the generated one
+	if k.Host == "" {
+		k.Host = fmt.Sprintf("%s.%s.%s", service, k.Namespace, k.Domain)
+	}
+
+	ingressPhase := *phase
+	ingressPhase.Target = k.Ingress + k.Path
+	return k.HTTPInvoker.Setup(ctx, &ingressPhase, bencher)
+}
+
+//readKnativeHeaders maps the ingress headers onto the trace
+func readKnativeHeaders(result *fact.Trace, header http.Header) {
+	if result.Tags == nil {
+		result.Tags = make(map[string]string)
+	}
+	if result.Platform == "" {
+		result.Platform = "knative"
+	}
+	if val := header.Get("X-Envoy-Upstream-Service-Time"); val != "" {
+		result.Tags[UpstreamServiceTimeTag] = val
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenFaaSInvoker(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	var path, method, callback string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+		method = req.Method
+		callback = req.Header.Get("X-Callback-Url")
+		w.Header().Set("X-Call-Id", "call-1")
+		if callback != "" {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("X-Duration-Seconds", "0.250000")
+		w.Header().Set("X-Start-Time", strconv.FormatInt(start.UnixNano(), 10))
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	invoker := setupInvoker(t, `
+type: openfaas
+timeout: 5s
+gateway: `+server.URL+`/
+`, "echo").(*OpenFaaSInvoker)
+	trace, _, err := invoker.call(context.Background(), 0, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "/function/echo", path)
+	assert.Equal(t, http.MethodPost, method)
+	assert.Equal(t, int32(200), trace.Status)
+	assert.Equal(t, "openfaas", trace.Platform)
+	assert.Equal(t, "call-1", trace.Tags[CallIDTag])
+	assert.Equal(t, 250*time.Millisecond, trace.ExecutionLatency.AsDuration())
+	assert.Equal(t, start, trace.StartTime.AsTime().Local())
+	assert.Equal(t, start.Add(250*time.Millisecond), trace.EndTime.AsTime().Local())
+
+	invoker = setupInvoker(t, `
+type: openfaas
+timeout: 5s
+gateway: `+server.URL+`
+async: true
+callbackUrl: http://callback:9000/
+`, "echo").(*OpenFaaSInvoker)
+	trace, _, err = invoker.call(context.Background(), 0, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "/async-function/echo", path)
+	assert.Equal(t, "http://callback:9000/", callback)
+	assert.Equal(t, int32(202), trace.Status)
+	assert.False(t, isFailed(trace))
+	assert.Nil(t, trace.ExecutionLatency)
+
+	_, err = NewInvokerFromConfig(InvokerConfig{Type: "openfaas", Options: map[string]interface{}{
+		"timeout": "5s",
+		"async":   true,
+		"method":  "GET",
+	}})
+	assert.Error(t, err)
+}
+
+func TestKnativeInvoker(t *testing.T) {
+	var host, path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host = req.Host
+		path = req.URL.Path
+		w.Header().Set("X-Envoy-Upstream-Service-Time", "12")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	invoker := setupInvoker(t, `
+type: knative
+timeout: 5s
+ingress: `+server.URL+`
+namespace: bench
+domain: knative.local
+path: /hello
+`, "echo").(*KnativeInvoker)
+	trace, _, err := invoker.call(context.Background(), 0, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "echo.bench.knative.local", host)
+	assert.Equal(t, "/hello", path)
+	assert.Equal(t, "knative", trace.Platform)
+	assert.Equal(t, "12", trace.Tags[UpstreamServiceTimeTag])
+
+	invoker = setupInvoker(t, `
+type: knative
+timeout: 5s
+ingress: `+server.URL+`
+host: echo.example.org
+`, "echo").(*KnativeInvoker)
+	_, _, err = invoker.call(context.Background(), 0, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "echo.example.org", host)
+	assert.Equal(t, "/", path)
+
+	_, err = NewInvokerFromConfig(InvokerConfig{Type: "knative", Options: map[string]interface{}{"timeout": "5s"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,487 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/runtime/protoimpl"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//GRPCStatusTag holds the grpc status code of a call, the trace status is the matching http status
+const GRPCStatusTag = "GRPCStatus"
+
+//GRPCInvoker calls a unary grpc method, the target of the phase is the address (host:port) of the server.
+//The method is resolved from a descriptor set or, if none is configured, with server reflection.
+type GRPCInvoker struct {
+	//Method is the full name of the method, e.g. helloworld.Greeter/SayHello
+	Method string
+	//DescriptorSet is a file created with protoc --descriptor_set_out --include_imports
+	DescriptorSet string
+	//Request is the json representation of the request message
+	Request []byte
+	//Metadata is send with each call
+	Metadata metadata.MD
+	//TraceField names the field of the response holding a fact.Trace, if empty responses of type fact.Trace are read
+	TraceField string
+	//TLS of the connection, plaintext if nil
+	TLS *TLSConfig
+	//Assertions validate the json representation of each response
+	Assertions *Assertions
+	//Retry decides if throttled calls (ResourceExhausted, Unavailable) are retried, by default they are only counted
+	Retry *RetryPolicy
+
+	Timeout time.Duration
+
+	payload         *payloadTemplate
+	requestTemplate *template.Template
+
+	method  protoreflect.MethodDescriptor
+	conn    *grpc.ClientConn
+	results *ResultPipeline
+	ctx     context.Context
+}
+
+func newGRPCInvoker(config InvokerConfig) (Invoker, error) {
+	if !checkFields(config.Options, "timeout", "method") {
+		return nil, fmt.Errorf("grpc needs a timeout and a method")
+	}
+	timeout, err := time.ParseDuration(stringValue("timeout", config.Options, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	//the request is either a map or a json string, both can contain templates
+	var request []byte
+	switch val := config.Options["request"].(type) {
+	case nil:
+		request = []byte("{}")
+	case string:
+		request = []byte(val)
+	default:
+		request, err = json.Marshal(val)
+		if err != nil {
+			return nil, fmt.Errorf("could not read request %+v form config", val)
+		}
+	}
+
+	headers, err := stringMap("metadata", config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	assertions, err := newAssertionsFromConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := newRetryPolicyFromConfig(config.Options, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &GRPCInvoker{
+		Method:        strings.TrimPrefix(stringValue("method", config.Options, ""), "/"),
+		DescriptorSet: stringValue("descriptorSet", config.Options, ""),
+		Request:       request,
+		Metadata:      metadata.New(headers),
+		TraceField:    stringValue("trace", config.Options, ""),
+		Assertions:    assertions,
+		Retry:         retry,
+		Timeout:       timeout,
+	}
+
+	if _, ok := config.Options["tls"]; ok {
+		g.TLS, err = newTLSConfigFromConfig(config.Options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if isTemplate(string(request)) {
+		g.requestTemplate, err = parseTemplate("request", string(request))
+		if err != nil {
+			return nil, err
+		}
+		g.payload, err = newPayloadTemplate(config.Options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+func (g *GRPCInvoker) Setup(ctx context.Context, phase *Phase, bencher *Bencher) error {
+	service, method, err := splitGRPCMethod(g.Method)
+	if err != nil {
+		return err
+	}
+
+	options := []grpc.DialOption{grpc.WithBlock()}
+	if g.TLS != nil {
+		tlsConfig, err := g.TLS.Build(phase.Threads)
+		if err != nil {
+			return err
+		}
+		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		options = append(options, grpc.WithInsecure())
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, g.Timeout)
+	defer cancel()
+	conn, err := grpc.DialContext(dialCtx, phase.Target, options...)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s - %+v", phase.Target, err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	var files *protoregistry.Files
+	if g.DescriptorSet != "" {
+		files, err = readDescriptorSet(g.DescriptorSet)
+	} else {
+		files, err = resolveWithReflection(dialCtx, conn, service)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s - %+v", g.Method, err)
+	}
+
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return fmt.Errorf("unknown service %s - %+v", service, err)
+	}
+	serviceDesc, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return fmt.Errorf("%s is not a service", service)
+	}
+	g.method = serviceDesc.Methods().ByName(protoreflect.Name(method))
+	if g.method == nil {
+		return fmt.Errorf("unknown method %s of %s", method, service)
+	}
+	if g.method.IsStreamingClient() || g.method.IsStreamingServer() {
+		return fmt.Errorf("only unary methods are supported, %s is streaming", g.Method)
+	}
+
+	//fail early on requests that do not match the method
+	if g.requestTemplate == nil {
+		if _, err := g.newMessage(g.Request); err != nil {
+			return err
+		}
+	} else {
+		g.payload.setup(phase)
+	}
+
+	g.conn = conn
+	g.results = bencher.results
+	g.ctx = ctx
+	if g.Retry == nil {
+		g.Retry, _ = newRetryPolicyFromConfig(nil, 0)
+	}
+	g.Retry.reset()
+	return nil
+}
+
+//splitGRPCMethod splits package.Service/Method into the service and method name
+func splitGRPCMethod(fullName string) (string, string, error) {
+	idx := strings.LastIndex(fullName, "/")
+	if idx <= 0 || idx == len(fullName)-1 {
+		return "", "", fmt.Errorf("method must be package.Service/Method, got %s", fullName)
+	}
+	return fullName[:idx], fullName[idx+1:], nil
+}
+
+//readDescriptorSet reads a FileDescriptorSet, it needs to include all imports
+func readDescriptorSet(filename string) (*protoregistry.Files, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	return protodesc.NewFiles(&set)
+}
+
+//resolveWithReflection fetches the file of the service and all its imports from the reflection service
+func resolveWithReflection(ctx context.Context, conn *grpc.ClientConn, service string) (*protoregistry.Files, error) {
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CloseSend()
+
+	files := make(map[string]*descriptorpb.FileDescriptorProto)
+	fetch := func(req *rpb.ServerReflectionRequest) error {
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return fmt.Errorf("reflection failed - %s", e.ErrorMessage)
+		}
+		for _, raw := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			var fd descriptorpb.FileDescriptorProto
+			if err := proto.Unmarshal(raw, &fd); err != nil {
+				return err
+			}
+			files[fd.GetName()] = &fd
+		}
+		return nil
+	}
+
+	err = fetch(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: service},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//servers may not send all imports at once
+	for missing := true; missing; {
+		missing = false
+		for _, fd := range files {
+			for _, dep := range fd.GetDependency() {
+				if _, ok := files[dep]; ok {
+					continue
+				}
+				missing = true
+				err = fetch(&rpb.ServerReflectionRequest{
+					MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: dep},
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, fd := range files {
+		set.File = append(set.File, fd)
+	}
+	return protodesc.NewFiles(set)
+}
+
+func (g *GRPCInvoker) newMessage(request []byte) (*dynamicpb.Message, error) {
+	msg := dynamicpb.NewMessage(g.method.Input())
+	if err := protojson.Unmarshal(request, msg); err != nil {
+		return nil, fmt.Errorf("request does not match %s - %+v", g.method.Input().FullName(), err)
+	}
+	return msg, nil
+}
+
+func (g *GRPCInvoker) Exec(rate HatchRate) error {
+	return g.ExecAs(0, rate)
+}
+
+func (g *GRPCInvoker) ExecAs(worker int, rate HatchRate) error {
+	err := rate.Take()
+	if err != nil {
+		return err
+	}
+
+	result, _, err := g.call(context.Background(), worker, nil, rate)
+	if err != nil {
+		rate.OnFailed()
+		return err
+	}
+
+	if isFailed(result) || result.Status != http.StatusOK {
+		rate.OnFailed()
+	} else {
+		rate.OnSuccess()
+	}
+	g.results.Add(result)
+
+	return nil
+}
+
+//call sends a single request without waiting on a hatch rate
+//throttled calls are retried with the same request as the retry policy allows, throttles are signaled to the rate
+func (g *GRPCInvoker) call(ctx context.Context, worker int, vars map[string]string, rate HatchRate) (*fact.Trace, *invocationResponse, error) {
+	request := g.Request
+	if g.requestTemplate != nil {
+		tpl := g.payload.next(worker)
+		tpl.Vars = vars
+		rendered, err := renderTemplate(g.requestTemplate, tpl)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to render request - %+v", err)
+		}
+		request = rendered
+	}
+	msg, err := g.newMessage(request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//ResourceExhausted and Unavailable are mapped to the throttled statuses of the policy
+	throttles := signalThrottles(rate)
+	retry := g.Retry.start(g.ctx)
+	for {
+		result, response := g.invoke(ctx, msg)
+		if !g.Retry.isThrottled(response.Status) || ctx.Err() != nil || !retry.retry(throttles, response.Status, response.Header) {
+			retry.tag(result)
+			return result, response, nil
+		}
+	}
+}
+
+func (g *GRPCInvoker) invoke(ctx context.Context, msg *dynamicpb.Message) (*fact.Trace, *invocationResponse) {
+	id := uuid.New().String()
+	ctx, cancel := context.WithTimeout(ctx, g.Timeout)
+	defer cancel()
+	md := g.Metadata.Copy()
+	md.Set("x-request-id", id)
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	response := dynamicpb.NewMessage(g.method.Output())
+	var header metadata.MD
+	path := fmt.Sprintf("/%s/%s", g.method.Parent().FullName(), g.method.Name())
+
+	start := time.Now()
+	err := g.conn.Invoke(ctx, path, msg, response, grpc.Header(&header))
+	end := time.Now()
+
+	code := status.Code(err)
+	result := g.readTrace(response)
+	if result.ID == "" {
+		result.ID = id
+	}
+	if result.Timestamp == nil || !result.Timestamp.IsValid() || result.Timestamp.GetSeconds() <= 1 {
+		result.Timestamp = timestamppb.New(start)
+	}
+	result.RequestStartTime = timestamppb.New(start)
+	result.RequestEndTime = timestamppb.New(end)
+	result.RequestResponseLatency = durationpb.New(end.Sub(start))
+	result.Status = int32(grpcToHTTPStatus(code))
+	if result.Tags == nil {
+		result.Tags = make(map[string]string)
+	}
+	result.Tags[GRPCStatusTag] = code.String()
+
+	var body []byte
+	if err == nil {
+		body, _ = protojson.Marshal(response)
+	}
+	httpHeader := make(http.Header)
+	for k, v := range header {
+		httpHeader[http.CanonicalHeaderKey(k)] = v
+	}
+
+	if err != nil {
+		markFailed(result, err)
+	} else if g.Assertions != nil {
+		if err := g.Assertions.Check(int(result.Status), httpHeader, body); err != nil {
+			markFailed(result, err)
+		}
+	}
+
+	return result, &invocationResponse{
+		Status: int(result.Status),
+		Header: httpHeader,
+		Body:   body,
+	}
+}
+
+//readTrace reads the fact.Trace from the configured field, or the response itself if it is a fact.Trace
+func (g *GRPCInvoker) readTrace(response *dynamicpb.Message) *fact.Trace {
+	var result fact.Trace
+	//fact.Trace is generated with the old protobuf api
+	trace := protoimpl.X.ProtoMessageV2Of(&result)
+	var msg protoreflect.Message = response
+	if g.TraceField == "" {
+		if response.Descriptor().FullName() != trace.ProtoReflect().Descriptor().FullName() {
+			return &result
+		}
+	} else {
+		field := response.Descriptor().Fields().ByName(protoreflect.Name(g.TraceField))
+		if field == nil || field.Message() == nil || !response.Has(field) {
+			return &result
+		}
+		msg = response.Get(field).Message()
+	}
+	data, err := proto.Marshal(msg.Interface())
+	if err != nil {
+		return &result
+	}
+	if err := proto.Unmarshal(data, trace); err != nil {
+		log.Debugf("response is no trace - %+v", err)
+		return &fact.Trace{}
+	}
+	return &result
+}
+
+//grpcToHTTPStatus maps grpc codes to http status codes as done by grpc gateways
+func grpcToHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/faas-facts/fact/fact"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/runtime/protoimpl"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+//echoDescriptorSet describes benchtest.Echo/Run which returns a reply with a fact.Trace
+func echoDescriptorSet() *descriptorpb.FileDescriptorSet {
+	set := &descriptorpb.FileDescriptorSet{}
+	var add func(file protoreflect.FileDescriptor)
+	add = func(file protoreflect.FileDescriptor) {
+		for i := 0; i < file.Imports().Len(); i++ {
+			add(file.Imports().Get(i).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(file))
+	}
+	add(protoimpl.X.ProtoMessageV2Of(&fact.Trace{}).ProtoReflect().Descriptor().ParentFile())
+
+	set.File = append(set.File, &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("benchtest/echo.proto"),
+		Package:    proto.String("benchtest"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"trace.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Request"),
+				Field: []*descriptorpb.FieldDescriptorProto{{
+					Name: proto.String("name"), JsonName: proto.String("name"), Number: proto.Int32(1),
+					Type:  descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+					Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				}},
+			},
+			{
+				Name: proto.String("Reply"),
+				Field: []*descriptorpb.FieldDescriptorProto{{
+					Name: proto.String("trace"), JsonName: proto.String("trace"), Number: proto.Int32(1),
+					Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+					TypeName: proto.String(".fact.Trace"),
+					Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				}},
+			},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Echo"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Run"),
+				InputType:  proto.String(".benchtest.Request"),
+				OutputType: proto.String(".benchtest.Reply"),
+			}},
+		}},
+	})
+	return set
+}
+
+//serveGRPC starts a server with the health, reflection and echo service, the echo of busy is throttled
+func serveGRPC(t *testing.T, set *descriptorpb.FileDescriptorSet) string {
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, _ := files.FindDescriptorByName("benchtest.Echo")
+	method := desc.(protoreflect.ServiceDescriptor).Methods().ByName("Run")
+
+	server := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	reflection.Register(server)
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "benchtest.Echo",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Run",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				request := dynamicpb.NewMessage(method.Input())
+				if err := dec(request); err != nil {
+					return nil, err
+				}
+				md, _ := metadata.FromIncomingContext(ctx)
+				name := request.Get(method.Input().Fields().ByName("name")).String()
+				if name == "busy" {
+					return nil, status.Error(codes.ResourceExhausted, "concurrency limit reached")
+				}
+				reply := dynamicpb.NewMessage(method.Output())
+				err := protojson.Unmarshal([]byte(`{"trace":{"ID":"`+name+`","ContainerID":"`+md.Get("x-container")[0]+`"}}`), reply)
+				return reply, err
+			},
+		}},
+	}, struct{}{})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func TestGRPCInvoker(t *testing.T) {
+	set := echoDescriptorSet()
+	target := serveGRPC(t, set)
+
+	//resolved with server reflection
+	invoker := setupInvoker(t, `
+type: grpc
+timeout: 1s
+method: grpc.health.v1.Health/Check
+request:
+  service: ""
+assert:
+  json:
+    status: SERVING
+`, target).(*GRPCInvoker)
+	trace, response, err := invoker.call(context.Background(), 0, nil, nil)
+	assert.NoError(t, err)
+	assert.False(t, isFailed(trace), trace.Tags[ErrorTag])
+	assert.Equal(t, int32(200), trace.Status)
+	assert.Equal(t, "OK", trace.Tags[GRPCStatusTag])
+	assert.JSONEq(t, `{"status":"SERVING"}`, string(response.Body))
+
+	invoker = setupInvoker(t, `
+type: grpc
+timeout: 1s
+method: grpc.health.v1.Health/Check
+request: '{"service":"unknown"}'
+`, target).(*GRPCInvoker)
+	trace, _, err = invoker.call(context.Background(), 0, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, isFailed(trace))
+	assert.Equal(t, int32(404), trace.Status)
+
+	//resolved with a descriptor set, the trace is read from the response
+	data, _ := proto.Marshal(set)
+	descriptors := filepath.Join(t.TempDir(), "echo.pb")
+	_ = ioutil.WriteFile(descriptors, data, 0600)
+	invoker = setupInvoker(t, `
+type: grpc
+timeout: 1s
+method: /benchtest.Echo/Run
+descriptorSet: `+descriptors+`
+request: '{"name":"call-{{.Seq}}"}'
+metadata:
+  x-container: c1
+trace: trace
+`, target).(*GRPCInvoker)
+	trace, _, err = invoker.call(context.Background(), 0, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "call-0", trace.ID)
+	assert.Equal(t, "c1", trace.ContainerID)
+	assert.NotNil(t, trace.RequestResponseLatency)
+
+	//exhausted resources are throttles
+	invoker = setupInvoker(t, `
+type: grpc
+timeout: 1s
+method: /benchtest.Echo/Run
+descriptorSet: `+descriptors+`
+request: '{"name":"busy"}'
+retry:
+  maxRetries: 2
+  backoff: 1ms
+`, target).(*GRPCInvoker)
+	rate := &outcomeRate{}
+	trace, _, err = invoker.call(context.Background(), 0, nil, rate)
+	assert.NoError(t, err)
+	assert.True(t, isFailed(trace))
+	assert.Equal(t, int32(429), trace.Status)
+	assert.Equal(t, "2", trace.Tags[RetriesTag])
+	assert.Equal(t, "3", trace.Tags[ThrottledTag])
+	assert.Equal(t, 3, rate.throttled)
+
+	//unknown fields are rejected during setup
+	var cnf InvokerConfig
+	cnf.Type = "grpc"
+	cnf.Options = map[string]interface{}{"timeout": "1s", "method": "benchtest.Echo/Run", "descriptorSet": descriptors, "request": `{"id":1}`}
+	g, err := NewInvokerFromConfig(cnf)
+	assert.NoError(t, err)
+	assert.Error(t, g.Setup(context.Background(), &Phase{Threads: 1, Target: target}, &Bencher{}))
+}
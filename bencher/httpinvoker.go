@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/faas-facts/fact/fact"
@@ -28,11 +29,15 @@ import (
 	"golang.org/x/net/http2"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
 	"io/ioutil"
 	"math"
 	"net/http"
 	"net/http/httptrace"
-	"os"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
 )
 
@@ -41,6 +46,37 @@ type HTTPInvoker struct {
 	Request     *http.Request
 	RequestBody []byte
 
+	// Method of the request, defaults to GET
+	Method string
+
+	// Header is added to each request
+	Header http.Header
+
+	// Query parameters are added to the target url
+	Query url.Values
+
+	// ContentType of the request body, defaults to text/plain
+	ContentType string
+
+	// Host overrides the host of the request, e.g. for host based routing
+	Host string
+
+	// Assertions validate each response, failed assertions mark the trace as failed
+	Assertions *Assertions
+
+	// Auth adds credentials to each request
+	Auth AuthProvider
+
+	// TLS of the connections, certificates are verified by default
+	TLS *TLSConfig
+
+	// templates rendered for each request, see TemplateContext
+	payload         *payloadTemplate
+	urlTemplate     *template.Template
+	bodyTemplate    *template.Template
+	headerTemplates map[string]*template.Template
+	queryTemplates  map[string]*template.Template
+
 	// DisableCompression is an option to disable compression in response
 	DisableCompression bool
 
@@ -56,11 +92,22 @@ type HTTPInvoker struct {
 	// Timeout in seconds.
 	Timeout int
 	client  *http.Client
-	results *fact.ResultCollector
+	results *ResultPipeline
+	ctx     context.Context
+
+	// Retry decides if throttled requests are retried, by default they are only counted
+	Retry *RetryPolicy
+
+	// Callback receives the completion of async invocations, requests carry the correlation id and callback url
+	Callback *CallbackReceiver
+
+	// onResponse lets platform invokers read their response headers into the trace
+	onResponse func(result *fact.Trace, header http.Header)
 }
 
-//TODO: needs testing
-//TODO: needs documentation
+//newHttpInvoker creates the http invoker, timeout is required. The request is configured with
+//method (GET by default), headers and query as maps, and the body inline (body), from a file (bodyFile)
+//or base64 encoded (bodyBase64). Header, query and body values can be templates rendered for each request.
 func newHttpInvoker(config InvokerConfig) (Invoker, error) {
 	valid := checkFields(config.Options, "timeout")
 	if !valid {
@@ -72,13 +119,100 @@ func newHttpInvoker(config InvokerConfig) (Invoker, error) {
 		return nil, err
 	}
 
-	var body []byte = nil
-	if val, ok := config.Options["body"]; ok {
-		body = []byte(val.(string))
+	body, err := readRequestBody(config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := stringMap("headers", config.Options)
+	if err != nil {
+		return nil, err
+	}
+	params, err := stringMap("query", config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := newPayloadTemplate(config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header)
+	headerTemplates := make(map[string]*template.Template)
+	for k, v := range headers {
+		if isTemplate(v) {
+			headerTemplates[k], err = parseTemplate(k, v)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			header.Set(k, v)
+		}
+	}
+
+	query := make(url.Values)
+	queryTemplates := make(map[string]*template.Template)
+	for k, v := range params {
+		if isTemplate(v) {
+			queryTemplates[k], err = parseTemplate(k, v)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			query.Set(k, v)
+		}
+	}
+
+	var bodyTemplate *template.Template
+	if isTemplate(string(body)) {
+		bodyTemplate, err = parseTemplate("body", string(body))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	assertions, err := newAssertionsFromConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := newAuthProviderFromConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := newTLSConfigFromConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	callback, err := newCallbackReceiverFromConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	retry, err := newRetryPolicyFromConfig(config.Options, 0)
+	if err != nil {
+		return nil, err
 	}
 
 	return &HTTPInvoker{
 		RequestBody:        body,
+		Assertions:         assertions,
+		Auth:               auth,
+		TLS:                tlsConfig,
+		Callback:           callback,
+		Retry:              retry,
+		payload:            payload,
+		bodyTemplate:       bodyTemplate,
+		headerTemplates:    headerTemplates,
+		queryTemplates:     queryTemplates,
+		Method:             strings.ToUpper(stringValue("method", config.Options, http.MethodGet)),
+		Header:             header,
+		Query:              query,
+		ContentType:        stringValue("contentType", config.Options, ""),
+		Host:               stringValue("host", config.Options, ""),
 		DisableCompression: flagValue("compression", config.Options, false),
 		DisableKeepAlive:   flagValue("keep_alive", config.Options, true),
 		DisableRedirects:   flagValue("redirects", config.Options, false),
@@ -87,6 +221,36 @@ func newHttpInvoker(config InvokerConfig) (Invoker, error) {
 	}, nil
 }
 
+//readRequestBody reads the body either inline (body), from a file (bodyFile) or base64 encoded (bodyBase64)
+func readRequestBody(options map[string]interface{}) ([]byte, error) {
+	var body []byte
+	sources := 0
+	if val, ok := options["body"]; ok {
+		body = []byte(fmt.Sprint(val))
+		sources++
+	}
+	if val, ok := options["bodyFile"]; ok {
+		data, err := ioutil.ReadFile(fmt.Sprint(val))
+		if err != nil {
+			return nil, err
+		}
+		body = data
+		sources++
+	}
+	if val, ok := options["bodyBase64"]; ok {
+		data, err := base64.StdEncoding.DecodeString(fmt.Sprint(val))
+		if err != nil {
+			return nil, err
+		}
+		body = data
+		sources++
+	}
+	if sources > 1 {
+		return nil, fmt.Errorf("only one of body, bodyFile or bodyBase64 can be set")
+	}
+	return body, nil
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -95,17 +259,15 @@ func min(a, b int) int {
 }
 
 func (h *HTTPInvoker) Setup(ctx context.Context, phase *Phase, bencher *Bencher) error {
-	var ServerName string
-	if h.Request != nil {
-		ServerName = h.Request.Host
-	} else {
-		ServerName, _ = os.Hostname()
+	if h.TLS == nil {
+		h.TLS = &TLSConfig{}
+	}
+	tlsConfig, err := h.TLS.Build(phase.Threads)
+	if err != nil {
+		return err
 	}
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-			ServerName:         ServerName,
-		},
+		TLSClientConfig:     tlsConfig,
 		MaxIdleConnsPerHost: min(phase.Threads, maxIdleConn),
 		DisableCompression:  h.DisableCompression,
 		DisableKeepAlives:   h.DisableKeepAlive,
@@ -117,19 +279,56 @@ func (h *HTTPInvoker) Setup(ctx context.Context, phase *Phase, bencher *Bencher)
 	}
 	h.client = &http.Client{Transport: tr, Timeout: time.Duration(h.Timeout) * time.Second}
 	h.results = bencher.results
+	h.ctx = ctx
+	if h.Retry == nil {
+		h.Retry, _ = newRetryPolicyFromConfig(nil, 0)
+	}
+	h.Retry.reset()
 
 	if h.Request == nil {
-		// set content-type
-		header := make(http.Header)
-
-		header.Set("Content-Type", "text/plain")
-		header.Set("X-Benchmark", "true")
+		rawTarget := phase.Target
+		if isTemplate(rawTarget) {
+			tpl, err := parseTemplate("url", rawTarget)
+			if err != nil {
+				return err
+			}
+			h.urlTemplate = tpl
+			//replaced for each request
+			rawTarget = "http://localhost"
+		}
+		target, err := url.Parse(rawTarget)
+		if err != nil {
+			return err
+		}
+		if len(h.Query) > 0 {
+			query := target.Query()
+			for k, v := range h.Query {
+				query[k] = v
+			}
+			target.RawQuery = query.Encode()
+		}
 
-		req, err := http.NewRequest("GET", phase.Target, nil)
+		method := h.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		req, err := http.NewRequest(method, target.String(), nil)
 		if err != nil {
 			return err
 		}
 
+		// set content-type
+		header := make(http.Header)
+		contentType := h.ContentType
+		if contentType == "" {
+			contentType = "text/plain"
+		}
+		header.Set("Content-Type", contentType)
+		header.Set("X-Benchmark", "true")
+		for k, v := range h.Header {
+			header[k] = v
+		}
+
 		ua := req.UserAgent()
 		if ua == "" {
 			ua = doomUserAgent
@@ -138,50 +337,195 @@ func (h *HTTPInvoker) Setup(ctx context.Context, phase *Phase, bencher *Bencher)
 		}
 		header.Set("User-Agent", ua)
 		req.Header = header
+		if h.Host != "" {
+			req.Host = h.Host
+		}
 
 		h.Request = req
 	}
 
-	if phase.PayloadFunc == nil {
-		h.RequestBody = []byte{}
-	} else {
+	if phase.PayloadFunc != nil {
 		h.RequestBody = phase.PayloadFunc(h)
 	}
 
+	if h.Callback != nil {
+		if err := h.Callback.Start(ctx, bencher); err != nil {
+			return err
+		}
+	}
+
+	if h.templated() || h.Callback != nil {
+		if h.payload == nil {
+			h.payload = &payloadTemplate{}
+		}
+		h.payload.setup(phase)
+	}
+
 	return nil
 }
 
+//templated reports if any part of the request is rendered per request
+func (h *HTTPInvoker) templated() bool {
+	return h.urlTemplate != nil || h.bodyTemplate != nil ||
+		len(h.headerTemplates) > 0 || len(h.queryTemplates) > 0
+}
+
+//newRequest renders all templates of the request for the worker, vars are set by scenarios
+func (h *HTTPInvoker) newRequest(worker int, vars map[string]string) (*http.Request, []byte, error) {
+	if !h.templated() && h.Callback == nil {
+		return h.Request, h.RequestBody, nil
+	}
+	ctx := h.payload.next(worker)
+	ctx.Vars = vars
+	req := cloneRequest(h.Request, nil)
+
+	if h.Callback != nil {
+		ctx.CorrelationID = ctx.UUID
+		ctx.CallbackURL = h.Callback.URLFor(ctx.CorrelationID)
+		req.Header.Set(CorrelationHeader, ctx.CorrelationID)
+		req.Header.Set("X-Callback-Url", ctx.CallbackURL)
+	}
+
+	if h.urlTemplate != nil {
+		raw, err := renderTemplate(h.urlTemplate, ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		target, err := url.Parse(string(raw))
+		if err != nil {
+			return nil, nil, err
+		}
+		query := target.Query()
+		for k, v := range h.Query {
+			query[k] = v
+		}
+		target.RawQuery = query.Encode()
+		req.URL = target
+		if h.Host == "" {
+			req.Host = target.Host
+		}
+	}
+
+	if len(h.queryTemplates) > 0 {
+		target := *req.URL
+		query := target.Query()
+		for k, tpl := range h.queryTemplates {
+			value, err := renderTemplate(tpl, ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+			query.Set(k, string(value))
+		}
+		target.RawQuery = query.Encode()
+		req.URL = &target
+	}
+
+	for k, tpl := range h.headerTemplates {
+		value, err := renderTemplate(tpl, ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set(k, string(value))
+	}
+
+	body := h.RequestBody
+	if h.bodyTemplate != nil {
+		rendered, err := renderTemplate(h.bodyTemplate, ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		body = rendered
+	}
+	return req, body, nil
+}
+
 func (h *HTTPInvoker) Exec(rate HatchRate) error {
+	return h.ExecAs(0, rate)
+}
+
+func (h *HTTPInvoker) ExecAs(worker int, rate HatchRate) error {
 	err := rate.Take()
 	if err != nil {
 		return err
 	}
 
-	result := h.makeRequest(h.client)
+	result, _, err := h.call(context.Background(), worker, nil, rate)
+	if err != nil {
+		rate.OnFailed()
+		return err
+	}
 
-	if result.Status == 200 {
+	if isFailed(result) {
+		rate.OnFailed()
+	} else if result.Status == 200 {
 		rate.OnSuccess()
 	} else if result.Status >= 400 {
 		rate.OnFailed()
+	} else if h.Assertions != nil {
+		rate.OnSuccess()
 	}
 
-	h.results.Add(result)
+	//accepted invocations are written once their callback arrived or timed out
+	if h.Callback != nil && !isFailed(result) && result.Status > 0 && result.Status < 400 {
+		h.Callback.Submit(result)
+	} else {
+		h.results.Add(result)
+	}
 
 	return nil
 }
 
-func (b *HTTPInvoker) makeRequest(c *http.Client) *fact.Trace {
+//completesLater reports if traces are written after the call, see CallInvoker
+func (h *HTTPInvoker) completesLater() bool {
+	return h.Callback != nil
+}
+
+//call sends a single request without waiting on a hatch rate
+//throttled requests are retried with the same request as the retry policy allows, throttles are signaled to the rate
+func (h *HTTPInvoker) call(ctx context.Context, worker int, vars map[string]string, rate HatchRate) (*fact.Trace, *invocationResponse, error) {
+	req, body, err := h.newRequest(worker, vars)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to render request - %+v", err)
+	}
+
+	throttles := signalThrottles(rate)
+	retry := h.Retry.start(h.ctx)
+	for {
+		result, response := h.makeRequest(ctx, h.client, req, body)
+		if !h.Retry.isThrottled(response.Status) || ctx.Err() != nil || !retry.retry(throttles, response.Status, response.Header) {
+			retry.tag(result)
+			return result, response, nil
+		}
+	}
+}
+
+func (b *HTTPInvoker) makeRequest(ctx context.Context, c *http.Client, request *http.Request, body []byte) (*fact.Trace, *invocationResponse) {
 	id := uuid.New().String()
 
 	var size int64
 	var code int
 	var resStart, RStart time.Time
 	var reqDuration time.Duration
-	var req = cloneRequest(b.Request, b.RequestBody)
+	var tlsStart time.Time
+	var tlsDuration time.Duration
+	var tlsResumed bool
+	var req = cloneRequest(request, body)
 
 	req.Header.Add("X-Request-ID", id)
 	req.Header.Add("X-Benchmark", "doom")
 
+	if b.Auth != nil {
+		if err := b.Auth.Authorize(req, body); err != nil {
+			result := &fact.Trace{
+				ID:               id,
+				Timestamp:        timestamppb.Now(),
+				RequestStartTime: timestamppb.Now(),
+			}
+			markFailed(result, fmt.Errorf("failed to authorize - %+v", err))
+			return result, &invocationResponse{Header: http.Header{}}
+		}
+	}
+
 	trace := &httptrace.ClientTrace{
 
 		GotConn: func(connInfo httptrace.GotConnInfo) {
@@ -193,17 +537,32 @@ func (b *HTTPInvoker) makeRequest(c *http.Client) *fact.Trace {
 		GotFirstResponseByte: func() {
 			resStart = time.Now()
 		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				tlsDuration = time.Since(tlsStart)
+				tlsResumed = state.DidResume
+			}
+		},
 	}
 
-	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
 	resp, err := c.Do(req)
 	log.Debugf("%s done transport delay:%s first byte:%s", id, reqDuration, RStart.Sub(resStart))
 	var result fact.Trace
+	var respBody []byte
+	var respHeader http.Header
 	if err == nil {
+		respHeader = resp.Header
 		size = resp.ContentLength
 		code = resp.StatusCode
 		log.Debugf("got %d with %d bytes", code, size)
-		result = readTraceFromHttpResponse(resp)
+		result, respBody = readHttpResponse(resp, b.maxBodySize())
+		if b.onResponse != nil {
+			b.onResponse(&result, respHeader)
+		}
 	}
 	REnd := time.Now()
 	resDuration := REnd.Sub(resStart)
@@ -218,23 +577,65 @@ func (b *HTTPInvoker) makeRequest(c *http.Client) *fact.Trace {
 	result.Status = int32(code)
 	result.RequestEndTime = timestamppb.New(REnd)
 	result.RequestResponseLatency = durationpb.New(resDuration)
+	if correlationID := req.Header.Get(CorrelationHeader); correlationID != "" {
+		if result.Tags == nil {
+			result.Tags = make(map[string]string)
+		}
+		result.Tags[CorrelationIDTag] = correlationID
+	}
+	if !tlsStart.IsZero() {
+		if result.Tags == nil {
+			result.Tags = make(map[string]string)
+		}
+		result.Tags[TLSHandshakeTag] = strconv.FormatInt(tlsDuration.Nanoseconds(), 10)
+		result.Tags[TLSResumedTag] = strconv.FormatBool(tlsResumed)
+	}
+
+	if b.Assertions != nil {
+		if err != nil {
+			markFailed(&result, err)
+		} else if err := b.Assertions.Check(code, resp.Header, respBody); err != nil {
+			markFailed(&result, err)
+		}
+	}
+
+	return &result, &invocationResponse{
+		Status: code,
+		Header: respHeader,
+		Body:   respBody,
+	}
+}
 
-	return &result
+//maxBodySize limits how much of a response is read, one byte more than allowed to detect oversized responses
+func (b *HTTPInvoker) maxBodySize() int64 {
+	if b.Assertions != nil && b.Assertions.MaxSize > 0 {
+		return b.Assertions.MaxSize + 1
+	}
+	return 0
 }
 
-func readTraceFromHttpResponse(resp *http.Response) fact.Trace {
+//readHttpResponse reads at most limit bytes (all if 0) of the body and parses the trace from it
+func readHttpResponse(resp *http.Response, limit int64) (fact.Trace, []byte) {
 	var result fact.Trace
-	body, err := ioutil.ReadAll(resp.Body)
+	var reader io.Reader = resp.Body
+	if limit > 0 {
+		reader = io.LimitReader(resp.Body, limit)
+	}
+	body, err := ioutil.ReadAll(reader)
 	if err != nil {
 		log.Debugf("failed to read resp body %f", err)
 	}
+	if limit > 0 {
+		//drain the rest to reuse the connection
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+	}
 	err = json.Unmarshal(body, &result)
 	if err != nil {
 		log.Debugf("failed to read resp body %f", err)
 	}
 	resp.Body.Close()
 
-	return result
+	return result, body
 }
 
 // cloneRequest returns a clone of the provided *http.Request.
@@ -251,6 +652,10 @@ func cloneRequest(r *http.Request, body []byte) *http.Request {
 	}
 	if len(body) > 0 {
 		r2.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r2.ContentLength = int64(len(body))
+		r2.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
 	}
 	return r2
 }
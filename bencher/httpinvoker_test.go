@@ -0,0 +1,234 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+//recordedRequest is what the test server saw of the last request
+type recordedRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Query  map[string][]string
+	Body   string
+}
+
+func newRecordingServer(t *testing.T, status int, response string) (*httptest.Server, *recordedRequest) {
+	record := &recordedRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		record.Method = req.Method
+		record.Path = req.URL.Path
+		record.Header = req.Header.Clone()
+		record.Query = req.URL.Query()
+		record.Body = string(body)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+	return server, record
+}
+
+//setupInvoker parses the yaml invoker config and sets it up against the target
+func setupInvoker(t *testing.T, config string, target string) Invoker {
+	var cnf InvokerConfig
+	if err := yaml.Unmarshal([]byte(config), &cnf); err != nil {
+		t.Fatal(err)
+	}
+	invoker, err := NewInvokerFromConfig(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := NewResultPipeline(PipelineConfig{}, &slowWriter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(results.Close)
+
+	err = invoker.Setup(context.Background(), &Phase{Threads: 1, Target: target}, &Bencher{results: results})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return invoker
+}
+
+func invokeOnce(t *testing.T, invoker *HTTPInvoker, worker int) *fact.Trace {
+	trace, _, err := invoker.call(context.Background(), worker, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return trace
+}
+
+func TestHTTPInvokerRequestConfig(t *testing.T) {
+	server, record := newRecordingServer(t, 200, "{}")
+
+	invoker := setupInvoker(t, `
+type: http
+timeout: 1s
+method: post
+contentType: application/json
+headers:
+  X-Api-Version: "2"
+query:
+  mode: fast
+bodyBase64: eyJpZCI6MX0=
+`, server.URL+"/run?user=1").(*HTTPInvoker)
+
+	trace := invokeOnce(t, invoker, 0)
+	assert.Equal(t, int32(200), trace.Status)
+	assert.Equal(t, http.MethodPost, record.Method)
+	assert.Equal(t, "application/json", record.Header.Get("Content-Type"))
+	assert.Equal(t, "2", record.Header.Get("X-Api-Version"))
+	assert.Equal(t, "fast", record.Query["mode"][0])
+	assert.Equal(t, "1", record.Query["user"][0])
+	assert.Equal(t, `{"id":1}`, record.Body)
+
+	//the body is send with every request
+	invokeOnce(t, invoker, 0)
+	assert.Equal(t, `{"id":1}`, record.Body)
+}
+
+func TestHTTPInvokerBodySources(t *testing.T) {
+	_, err := readRequestBody(map[string]interface{}{"body": "a", "bodyBase64": "YQ=="})
+	assert.Error(t, err)
+
+	body, err := readRequestBody(map[string]interface{}{"body": "hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestHTTPInvokerTemplates(t *testing.T) {
+	server, record := newRecordingServer(t, 200, "{}")
+
+	feeder := filepath.Join(t.TempDir(), "users.csv")
+	err := ioutil.WriteFile(feeder, []byte("name,age\nada,36\nalan,41\n"), 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invoker := setupInvoker(t, `
+type: http
+timeout: 1s
+method: POST
+headers:
+  X-Seq: "{{.Seq}}"
+query:
+  user: "{{.Row.name}}"
+body: '{"age":{{.Row.age}},"worker":{{.Worker}},"n":{{randInt 5 6}}}'
+feeder:
+  file: `+feeder+`
+  mode: sequential
+`, server.URL+"/users/{{.Row.name}}").(*HTTPInvoker)
+
+	invokeOnce(t, invoker, 3)
+	assert.Equal(t, `{"age":36,"worker":3,"n":5}`, record.Body)
+	assert.Equal(t, "0", record.Header.Get("X-Seq"))
+	assert.Equal(t, "ada", record.Query["user"][0])
+	assert.Equal(t, "/users/ada", record.Path)
+
+	invokeOnce(t, invoker, 1)
+	assert.Equal(t, `{"age":41,"worker":1,"n":5}`, record.Body)
+	assert.Equal(t, "1", record.Header.Get("X-Seq"))
+	assert.Equal(t, "alan", record.Query["user"][0])
+}
+
+func TestFeederModes(t *testing.T) {
+	rows := make([]map[string]interface{}, 6)
+	for i := range rows {
+		rows[i] = map[string]interface{}{"i": i}
+	}
+
+	worker := &Feeder{Rows: rows, Mode: FeedWorker, workers: make(map[int]int)}
+	assert.Equal(t, 1, worker.Next(1, 3)["i"])
+	assert.Equal(t, 4, worker.Next(1, 3)["i"])
+	assert.Equal(t, 1, worker.Next(1, 3)["i"])
+	assert.Equal(t, 0, worker.Next(0, 3)["i"])
+
+	sequential := &Feeder{Rows: rows, Mode: FeedSequential}
+	for i := 0; i < 8; i++ {
+		assert.Equal(t, i%6, sequential.Next(i, 3)["i"])
+	}
+}
+
+func TestHTTPInvokerAssertions(t *testing.T) {
+	server, _ := newRecordingServer(t, 201, `{"result":{"items":[{"id":7}],"status":"done"}}`)
+
+	config := `
+type: http
+timeout: 1s
+assert:
+  status: [200, 201]
+  contains: done
+  regex: ['"id":\d+']
+  json:
+    result.status: done
+    result.items.0.id: 7
+  maxSize: 1024
+`
+	invoker := setupInvoker(t, config, server.URL).(*HTTPInvoker)
+	trace := invokeOnce(t, invoker, 0)
+	assert.False(t, isFailed(trace), trace.Tags[ErrorTag])
+
+	invoker = setupInvoker(t, config+"  headers: [X-Call-Id]\n", server.URL).(*HTTPInvoker)
+	trace = invokeOnce(t, invoker, 0)
+	assert.True(t, isFailed(trace))
+	assert.Equal(t, "missing header X-Call-Id", trace.Tags[ErrorTag])
+
+	a := &Assertions{MaxSize: 4}
+	assert.Error(t, a.Check(200, http.Header{}, []byte("12345")))
+	a = &Assertions{JSON: map[string]interface{}{"a.1": 2}}
+	assert.NoError(t, a.Check(200, http.Header{}, []byte(`{"a":[1,2]}`)))
+	assert.Error(t, a.Check(200, http.Header{}, []byte(`{"a":[1,3]}`)))
+}
+
+//collectingWriter keeps all written traces
+type collectingWriter struct {
+	traces []*fact.Trace
+}
+
+func (w *collectingWriter) Name() string         { return "collect" }
+func (w *collectingWriter) Open(io.Writer, bool) {}
+func (w *collectingWriter) Write(traces []*fact.Trace) error {
+	w.traces = append(w.traces, traces...)
+	return nil
+}
+
+//outcomeRate counts the reported outcomes
+type outcomeRate struct {
+	unlimitedRate
+	success, failed, throttled int
+}
+
+func (r *outcomeRate) OnSuccess()                { r.success++ }
+func (r *outcomeRate) OnFailed()                 { r.failed++ }
+func (r *outcomeRate) OnThrottled(time.Duration) { r.throttled++ }
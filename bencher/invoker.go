@@ -20,6 +20,7 @@ package bencher
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"strings"
 )
 
@@ -28,11 +29,38 @@ type Invoker interface {
 	Exec(rate HatchRate) error
 }
 
+//WorkerInvoker is implemented by invokers that need to know which thread of the phase is sending, e.g. to feed per worker data.
+type WorkerInvoker interface {
+	Invoker
+	ExecAs(worker int, rate HatchRate) error
+}
+
+//LifecycleInvoker is implemented by invokers that prepare the platform before the workload and clean up afterwards, e.g. to deploy functions.
+type LifecycleInvoker interface {
+	Invoker
+	PreRun() error
+	PostRun() error
+}
+
+//PhaseSweeper is implemented by invokers that repeat all phases of the workload for a list of platform configurations, e.g. memory limits.
+type PhaseSweeper interface {
+	Invoker
+	SweepSteps() []string                     //names of the configurations, appended to the phase names
+	ApplySweep(step int, target string) error //activates the configuration before its first phase
+}
+
+//invocationResponse is the raw response of an invocation, e.g. used to extract values in scenarios
+type invocationResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
 type FunctionAPIInvoker interface {
 	Invoker
 }
 
-var _invokerTypes = []string{"http", "ow"}
+var _invokerTypes = []string{"http", "ow", "grpc", "stream", "awslambda", "openfaas", "knative", "scenario", "plugin"}
 
 type InvokerConstructor func(config InvokerConfig) (Invoker, error)
 
@@ -54,13 +82,36 @@ type InvokerConfig struct {
 	Type    string                 `yaml:"type"`
 }
 
+//NewInvokerFromConfig creates the invoker, it is wrapped if middleware is configured
 func NewInvokerFromConfig(config InvokerConfig) (Invoker, error) {
+	invoker, err := newInvoker(config)
+	if err != nil {
+		return nil, err
+	}
+	return withMiddleware(invoker, config.Options)
+}
+
+func newInvoker(config InvokerConfig) (Invoker, error) {
 	_type := strings.TrimSpace(strings.ToLower(config.Type))
 	switch _type {
 	case "http":
 		return newHttpInvoker(config)
 	case "ow":
 		return newOpenWhiskInvoker(config)
+	case "grpc":
+		return newGRPCInvoker(config)
+	case "stream":
+		return newStreamInvoker(config)
+	case "awslambda":
+		return newLambdaInvoker(config)
+	case "openfaas":
+		return newOpenFaaSInvoker(config)
+	case "knative":
+		return newKnativeInvoker(config)
+	case "scenario":
+		return newScenarioInvoker(config)
+	case "plugin":
+		return newPluginInvoker(config)
 	}
 
 	if val, ok := _invoker[_type]; ok {
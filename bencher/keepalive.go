@@ -0,0 +1,297 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+)
+
+//KeepAliveRate is an experiment to measure the idle timeout (keep-alive) policy of a platform.
+//For each idle gap a priming request is send, after waiting for the gap a single probe follows.
+//If the probe is answered by the same container (ContainerID) the container was kept alive.
+//The rate observes the traces of the phase, thus the invoker must report the ContainerID.
+type KeepAliveRate struct {
+	Gaps         []time.Duration //idle gaps to sweep, e.g. 1m,5m,10m,20m
+	Repetitions  int             //number of probes per gap
+	ProbeTimeout time.Duration   //max time to wait for the trace of a single probe
+	SummaryFile  string          //if set, the summary is written as csv to this file
+
+	tickets  chan struct{}
+	observed chan *fact.Trace
+	results  []KeepAliveResult
+	probing  bool
+	signal   *sync.Cond
+	ctx      context.Context
+	cancel   context.CancelFunc
+	sync.Mutex
+}
+
+//KeepAliveResult summarises all probes of a single idle gap.
+type KeepAliveResult struct {
+	Gap    time.Duration
+	Probes int //probes that returned a ContainerID
+	Reused int //probes that hit the same container as the priming request
+	Lost   int //probes without a usable answer
+}
+
+//ReuseProbability is the share of probes that hit a warm container.
+func (r KeepAliveResult) ReuseProbability() float64 {
+	if r.Probes == 0 {
+		return 0
+	}
+	return float64(r.Reused) / float64(r.Probes)
+}
+
+func newKeepAliveRateFromConfig(config HatchRateConfig) (HatchRate, error) {
+	if !checkFields(config.Options, "gaps") {
+		return nil, fmt.Errorf("missing values for keepalive type")
+	}
+
+	rawGaps, ok := config.Options["gaps"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("gaps must be a list of durations")
+	}
+	gaps := make([]time.Duration, 0, len(rawGaps))
+	for _, raw := range rawGaps {
+		gap, err := time.ParseDuration(fmt.Sprint(raw))
+		if err != nil {
+			return nil, err
+		}
+		gaps = append(gaps, gap)
+	}
+
+	rate := &KeepAliveRate{
+		Gaps:         gaps,
+		Repetitions:  1,
+		ProbeTimeout: time.Minute,
+	}
+
+	if val, ok := config.Options["repetitions"]; ok {
+		rate.Repetitions, ok = val.(int)
+		if !ok || rate.Repetitions < 1 {
+			return nil, fmt.Errorf("repetitions must be a positive number")
+		}
+	}
+
+	if val, ok := config.Options["probeTimeout"]; ok {
+		probeTimeout, err := time.ParseDuration(fmt.Sprint(val))
+		if err != nil {
+			return nil, err
+		}
+		rate.ProbeTimeout = probeTimeout
+	}
+
+	if val, ok := config.Options["summary"]; ok {
+		rate.SummaryFile = fmt.Sprint(val)
+	}
+
+	return rate, nil
+}
+
+//Duration is the minimal time the experiment needs, use it to size the phase timeout.
+func (k *KeepAliveRate) Duration() time.Duration {
+	var total time.Duration
+	for _, gap := range k.Gaps {
+		total += gap * time.Duration(k.Repetitions)
+	}
+	return total
+}
+
+func (k *KeepAliveRate) Setup(ctx context.Context, phase *Phase) (*sync.Cond, error) {
+	if len(k.Gaps) == 0 {
+		return nil, fmt.Errorf("keepalive rate needs at least one gap")
+	}
+	if k.Repetitions < 1 {
+		k.Repetitions = 1
+	}
+	if k.ProbeTimeout <= 0 {
+		k.ProbeTimeout = time.Minute
+	}
+	if phase.Timeout < k.Duration() {
+		log.Warnf("phase %s timeout %s is shorter than the keepalive sweep %s", phase.Name, phase.Timeout, k.Duration())
+	}
+
+	k.ctx, k.cancel = context.WithCancel(ctx)
+	m := sync.Mutex{}
+	m.Lock()
+	k.signal = sync.NewCond(&m)
+	k.tickets = make(chan struct{})
+	k.observed = make(chan *fact.Trace, 1)
+	k.results = make([]KeepAliveResult, 0, len(k.Gaps))
+
+	go k.sweep()
+
+	return k.signal, nil
+}
+
+func (k *KeepAliveRate) sweep() {
+	defer k.signal.Broadcast()
+	for _, gap := range k.Gaps {
+		result := KeepAliveResult{Gap: gap}
+		for i := 0; i < k.Repetitions; i++ {
+			prime, ok := k.probe()
+			if k.ctx.Err() != nil {
+				return
+			}
+			if !ok {
+				result.Lost++
+				continue
+			}
+
+			log.Debugf("keepalive: primed %s, waiting %s", prime.ContainerID, gap)
+			select {
+			case <-time.After(gap):
+			case <-k.ctx.Done():
+				return
+			}
+
+			probe, ok := k.probe()
+			if k.ctx.Err() != nil {
+				return
+			}
+			if !ok {
+				result.Lost++
+				continue
+			}
+			result.Probes++
+			if probe.ContainerID == prime.ContainerID {
+				result.Reused++
+			}
+		}
+		log.Infof("keepalive: gap %s reused %d/%d (lost %d)", gap, result.Reused, result.Probes, result.Lost)
+		k.Lock()
+		k.results = append(k.results, result)
+		k.Unlock()
+	}
+}
+
+//probe releases a single request and waits for its trace
+func (k *KeepAliveRate) probe() (*fact.Trace, bool) {
+	k.Lock()
+	k.probing = true
+	k.Unlock()
+	defer func() {
+		k.Lock()
+		k.probing = false
+		k.Unlock()
+		//drop late traces of a timed out probe
+		select {
+		case <-k.observed:
+		default:
+		}
+	}()
+
+	select {
+	case k.tickets <- struct{}{}:
+	case <-k.ctx.Done():
+		return nil, false
+	}
+
+	select {
+	case trace := <-k.observed:
+		return trace, trace.ContainerID != ""
+	case <-time.After(k.ProbeTimeout):
+		log.Warnf("keepalive: probe did not return within %s", k.ProbeTimeout)
+		return nil, false
+	case <-k.ctx.Done():
+		return nil, false
+	}
+}
+
+//Observe implements TraceObserver, the Bencher forwards all traces of the run.
+func (k *KeepAliveRate) Observe(trace *fact.Trace) {
+	k.Lock()
+	probing := k.probing
+	k.Unlock()
+	if !probing {
+		return
+	}
+	select {
+	case k.observed <- trace:
+	default:
+	}
+}
+
+func (k *KeepAliveRate) Take() error {
+	select {
+	case <-k.tickets:
+		return nil
+	case <-k.ctx.Done():
+		return fmt.Errorf("closed")
+	}
+}
+func (k *KeepAliveRate) OnSuccess()                {}
+func (k *KeepAliveRate) OnFailed()                 {}
+func (k *KeepAliveRate) OnQueued()                 {}
+func (k *KeepAliveRate) OnThrottled(time.Duration) {}
+func (k *KeepAliveRate) Close() error {
+	k.cancel()
+	k.logSummary()
+	if k.SummaryFile != "" {
+		return k.writeSummary(k.SummaryFile)
+	}
+	return nil
+}
+
+//Summary returns the reuse results of all gaps completed so far.
+func (k *KeepAliveRate) Summary() []KeepAliveResult {
+	k.Lock()
+	defer k.Unlock()
+	dump := make([]KeepAliveResult, len(k.results))
+	copy(dump, k.results)
+	return dump
+}
+
+func (k *KeepAliveRate) logSummary() {
+	for _, r := range k.Summary() {
+		log.Infof("keepalive gap:%s probes:%d reused:%d lost:%d p(reuse):%.2f",
+			r.Gap, r.Probes, r.Reused, r.Lost, r.ReuseProbability())
+	}
+}
+
+func (k *KeepAliveRate) writeSummary(filename string) error {
+	out, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := csv.NewWriter(out)
+	_ = w.Write([]string{"Gap", "Probes", "Reused", "Lost", "PReuse"})
+	for _, r := range k.Summary() {
+		_ = w.Write([]string{
+			r.Gap.String(),
+			strconv.Itoa(r.Probes),
+			strconv.Itoa(r.Reused),
+			strconv.Itoa(r.Lost),
+			strconv.FormatFloat(r.ReuseProbability(), 'f', 4, 64),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+var _ TraceObserver = &KeepAliveRate{}
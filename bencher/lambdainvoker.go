@@ -0,0 +1,477 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//Lambda invocation types
+const (
+	LambdaRequestResponse = "RequestResponse" //wait for the result, the log tail is requested
+	LambdaEvent           = "Event"           //queue the invocation, only the acceptance is measured
+)
+
+//Tags set from the REPORT line of a lambda invocation, durations are in ns
+const (
+	LambdaBilledDurationTag = "BilledDuration"
+	LambdaInitDurationTag   = "InitDuration"
+	LambdaMaxMemoryTag      = "MaxMemoryUsed" //in MB
+	LambdaColdStartTag      = "ColdStart"     //true if the REPORT contains an init duration
+	LambdaRequestIDTag      = "RequestID"     //id of the invocation, from the response header
+)
+
+//LambdaReport is the REPORT line lambda writes at the end of each invocation
+type LambdaReport struct {
+	RequestID      string
+	Duration       time.Duration
+	BilledDuration time.Duration
+	MemorySize     int32 //configured memory in MB
+	MaxMemoryUsed  int32 //in MB
+	InitDuration   time.Duration
+}
+
+var lambdaReportFields = regexp.MustCompile(`([A-Za-z ]+): ([0-9a-f.\-]+)`)
+
+//ParseLambdaReport finds the REPORT line in the logs
+func ParseLambdaReport(logs string) (*LambdaReport, bool) {
+	for _, line := range strings.Split(logs, "\n") {
+		if !strings.HasPrefix(line, "REPORT ") {
+			continue
+		}
+		report := &LambdaReport{}
+		for _, match := range lambdaReportFields.FindAllStringSubmatch(strings.TrimPrefix(line, "REPORT"), -1) {
+			name := strings.TrimSpace(match[1])
+			value := match[2]
+			switch name {
+			case "RequestId":
+				report.RequestID = value
+			case "Duration":
+				report.Duration = parseMilliseconds(value)
+			case "Billed Duration":
+				report.BilledDuration = parseMilliseconds(value)
+			case "Init Duration":
+				report.InitDuration = parseMilliseconds(value)
+			case "Memory Size":
+				size, _ := strconv.Atoi(value)
+				report.MemorySize = int32(size)
+			case "Max Memory Used":
+				used, _ := strconv.Atoi(value)
+				report.MaxMemoryUsed = int32(used)
+			}
+		}
+		return report, true
+	}
+	return nil, false
+}
+
+func parseMilliseconds(value string) time.Duration {
+	ms, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+//Apply maps the report onto the trace, values reported by the function itself are kept
+func (r *LambdaReport) Apply(t *fact.Trace) {
+	if t.Tags == nil {
+		t.Tags = make(map[string]string)
+	}
+	if t.ExecutionLatency == nil && r.Duration > 0 {
+		t.ExecutionLatency = durationpb.New(r.Duration)
+	}
+	if t.Memory == 0 {
+		t.Memory = r.MemorySize
+	}
+	t.Tags[LambdaBilledDurationTag] = strconv.FormatInt(r.BilledDuration.Nanoseconds(), 10)
+	t.Tags[LambdaMaxMemoryTag] = strconv.Itoa(int(r.MaxMemoryUsed))
+	t.Tags[LambdaColdStartTag] = strconv.FormatBool(r.InitDuration > 0)
+	if r.InitDuration > 0 {
+		t.Tags[LambdaInitDurationTag] = strconv.FormatInt(r.InitDuration.Nanoseconds(), 10)
+	}
+}
+
+//LambdaInvoker calls the lambda Invoke API, the function is the target of the phase unless configured.
+type LambdaInvoker struct {
+	FunctionName   string
+	Qualifier      string
+	InvocationType string
+	Region         string
+	//Endpoint of the lambda api, e.g. http://localhost:9000 for the runtime interface emulator
+	Endpoint string
+	Payload  []byte
+	Timeout  time.Duration
+	//Signer signs requests with sigv4, requests are unsigned if nil
+	Signer     AuthProvider
+	TLS        *TLSConfig
+	Assertions *Assertions
+	//Callback receives the completion of event invocations, the payload gets the correlation id and callback url as template variables
+	Callback *CallbackReceiver
+	//Retry decides if throttled invocations (TooManyRequestsException) are retried, by default they are only counted
+	Retry *RetryPolicy
+
+	payload         *payloadTemplate
+	payloadTemplate *template.Template
+
+	client  *http.Client
+	target  *url.URL
+	results *ResultPipeline
+	ctx     context.Context
+}
+
+func newLambdaInvoker(config InvokerConfig) (Invoker, error) {
+	if !checkFields(config.Options, "timeout") {
+		return nil, fmt.Errorf("missing key in config")
+	}
+	timeout, err := time.ParseDuration(stringValue("timeout", config.Options, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	invocationType := stringValue("invocationType", config.Options, LambdaRequestResponse)
+	if invocationType != LambdaRequestResponse && invocationType != LambdaEvent {
+		return nil, fmt.Errorf("invocationType must be %s or %s", LambdaRequestResponse, LambdaEvent)
+	}
+
+	region := stringValue("region", config.Options, os.Getenv("AWS_REGION"))
+	endpoint := stringValue("endpoint", config.Options, "")
+	if endpoint == "" {
+		if region == "" {
+			return nil, fmt.Errorf("awslambda needs a region or an endpoint")
+		}
+		endpoint = fmt.Sprintf("https://lambda.%s.amazonaws.com", region)
+	}
+
+	//the payload is either a map or a json string, both can contain templates
+	var payload []byte
+	switch val := config.Options["payload"].(type) {
+	case nil:
+		payload = []byte("{}")
+	case string:
+		payload = []byte(val)
+	default:
+		payload, err = json.Marshal(val)
+		if err != nil {
+			return nil, fmt.Errorf("could not read payload %+v form config", val)
+		}
+	}
+
+	assertions, err := newAssertionsFromConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfigFromConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+	callback, err := newCallbackReceiverFromConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := newRetryPolicyFromConfig(config.Options, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &LambdaInvoker{
+		FunctionName:   stringValue("function", config.Options, ""),
+		Qualifier:      stringValue("qualifier", config.Options, ""),
+		InvocationType: invocationType,
+		Region:         region,
+		Endpoint:       strings.TrimRight(endpoint, "/"),
+		Payload:        payload,
+		Timeout:        timeout,
+		TLS:            tlsConfig,
+		Assertions:     assertions,
+		Callback:       callback,
+		Retry:          retry,
+	}
+
+	//local emulators do not check signatures
+	if flagValue("sign", config.Options, true) {
+		signing := make(map[string]interface{})
+		for k, v := range config.Options {
+			signing[k] = v
+		}
+		signing["service"] = "lambda"
+		signing["region"] = region
+		l.Signer, err = newSigV4FromConfig(signing)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if isTemplate(string(payload)) {
+		l.payloadTemplate, err = parseTemplate("payload", string(payload))
+		if err != nil {
+			return nil, err
+		}
+		l.payload, err = newPayloadTemplate(config.Options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func (l *LambdaInvoker) Setup(ctx context.Context, phase *Phase, bencher *Bencher) error {
+	function := l.FunctionName
+	if function == "" {
+		function = phase.Target
+	}
+	target, err := url.Parse(l.Endpoint)
+	if err != nil {
+		return err
+	}
+	//function names can be arns, so the name is escaped as done by the aws sdks
+	path := strings.TrimRight(target.EscapedPath(), "/") + "/2015-03-31/functions/" + sigV4Escape(function, true) + "/invocations"
+	target.Path, err = url.PathUnescape(path)
+	if err != nil {
+		return err
+	}
+	target.RawPath = path
+	if l.Qualifier != "" {
+		target.RawQuery = url.Values{"Qualifier": []string{l.Qualifier}}.Encode()
+	}
+
+	tlsConfig, err := l.TLS.Build(phase.Threads)
+	if err != nil {
+		return err
+	}
+	l.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: min(phase.Threads, maxIdleConn),
+		},
+		Timeout: l.Timeout,
+	}
+	if l.Callback != nil {
+		if err := l.Callback.Start(ctx, bencher); err != nil {
+			return err
+		}
+	}
+	if l.payloadTemplate != nil || l.Callback != nil {
+		if l.payload == nil {
+			l.payload = &payloadTemplate{}
+		}
+		l.payload.setup(phase)
+	}
+	l.target = target
+	l.results = bencher.results
+	l.ctx = ctx
+	if l.Retry == nil {
+		l.Retry, _ = newRetryPolicyFromConfig(nil, 0)
+	}
+	l.Retry.reset()
+	return nil
+}
+
+func (l *LambdaInvoker) Exec(rate HatchRate) error {
+	return l.ExecAs(0, rate)
+}
+
+func (l *LambdaInvoker) ExecAs(worker int, rate HatchRate) error {
+	err := rate.Take()
+	if err != nil {
+		return err
+	}
+
+	result, _, err := l.call(context.Background(), worker, nil, rate)
+	if err != nil {
+		rate.OnFailed()
+		return err
+	}
+
+	//accepted event invocations count as success
+	if isFailed(result) || result.Status >= 400 {
+		rate.OnFailed()
+		l.results.Add(result)
+	} else {
+		rate.OnSuccess()
+		if l.Callback != nil {
+			l.Callback.Submit(result)
+		} else {
+			l.results.Add(result)
+		}
+	}
+
+	return nil
+}
+
+//completesLater reports if traces are written after the call, see CallInvoker
+func (l *LambdaInvoker) completesLater() bool {
+	return l.Callback != nil
+}
+
+//call invokes the function once without waiting on a hatch rate
+//throttled invocations are retried with the same payload as the retry policy allows, throttles are signaled to the rate
+func (l *LambdaInvoker) call(ctx context.Context, worker int, vars map[string]string, rate HatchRate) (*fact.Trace, *invocationResponse, error) {
+	payload := l.Payload
+	var tpl *TemplateContext
+	if l.payloadTemplate != nil || l.Callback != nil {
+		tpl = l.payload.next(worker)
+		tpl.Vars = vars
+	}
+	if l.Callback != nil {
+		tpl.CorrelationID = tpl.UUID
+		tpl.CallbackURL = l.Callback.URLFor(tpl.CorrelationID)
+	}
+	if l.payloadTemplate != nil {
+		rendered, err := renderTemplate(l.payloadTemplate, tpl)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to render payload - %+v", err)
+		}
+		payload = rendered
+	}
+
+	throttles := signalThrottles(rate)
+	retry := l.Retry.start(l.ctx)
+	for {
+		result, response, err := l.invoke(ctx, payload, tpl)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !l.Retry.isThrottled(response.Status) || ctx.Err() != nil || !retry.retry(throttles, response.Status, response.Header) {
+			retry.tag(result)
+			return result, response, nil
+		}
+	}
+}
+
+//invoke sends a signed request, the sigv4 signature is renewed for each attempt
+func (l *LambdaInvoker) invoke(ctx context.Context, payload []byte, tpl *TemplateContext) (*fact.Trace, *invocationResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.target.String(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Amz-Invocation-Type", l.InvocationType)
+	if l.InvocationType == LambdaRequestResponse {
+		req.Header.Set("X-Amz-Log-Type", "Tail")
+	}
+
+	id := uuid.New().String()
+	result := &fact.Trace{ID: id}
+	if l.Callback != nil {
+		//synchronous invocations get the callback in the client context, events only in templated payloads
+		clientContext, err := json.Marshal(map[string]interface{}{
+			"custom": map[string]string{
+				"correlationId": tpl.CorrelationID,
+				"callbackUrl":   tpl.CallbackURL,
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("X-Amz-Client-Context", base64.StdEncoding.EncodeToString(clientContext))
+	}
+	if l.Signer != nil {
+		if err := l.Signer.Authorize(req, payload); err != nil {
+			markFailed(result, fmt.Errorf("failed to sign request - %+v", err))
+			result.Timestamp = timestamppb.Now()
+			return result, &invocationResponse{Header: http.Header{}}, nil
+		}
+	}
+
+	start := time.Now()
+	resp, err := l.client.Do(req)
+	var body []byte
+	var header = http.Header{}
+	var code int
+	if err == nil {
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		header = resp.Header
+		code = resp.StatusCode
+	}
+	end := time.Now()
+
+	if err == nil && len(body) > 0 {
+		//functions instrumented with fact return their trace
+		var trace fact.Trace
+		if json.Unmarshal(body, &trace) == nil && trace.ID != "" {
+			result = &trace
+		}
+	}
+	if result.Tags == nil {
+		result.Tags = make(map[string]string)
+	}
+	if result.Timestamp == nil || !result.Timestamp.IsValid() || result.Timestamp.GetSeconds() <= 1 {
+		result.Timestamp = timestamppb.New(start)
+	}
+	result.RequestStartTime = timestamppb.New(start)
+	result.RequestEndTime = timestamppb.New(end)
+	result.RequestResponseLatency = durationpb.New(end.Sub(start))
+	result.Status = int32(code)
+	if result.Platform == "" {
+		result.Platform = "aws-lambda"
+	}
+	if result.Region == "" {
+		result.Region = l.Region
+	}
+	if version := header.Get("X-Amz-Executed-Version"); version != "" && result.CodeVersion == "" {
+		result.CodeVersion = version
+	}
+	if requestID := header.Get("X-Amzn-Requestid"); requestID != "" {
+		result.Tags[LambdaRequestIDTag] = requestID
+	}
+	if tpl != nil && tpl.CorrelationID != "" {
+		result.Tags[CorrelationIDTag] = tpl.CorrelationID
+	}
+
+	if logs := header.Get("X-Amz-Log-Result"); logs != "" {
+		decoded, decodeErr := base64.StdEncoding.DecodeString(logs)
+		if decodeErr == nil {
+			if report, ok := ParseLambdaReport(string(decoded)); ok {
+				report.Apply(result)
+			}
+		}
+	}
+
+	if err != nil {
+		markFailed(result, err)
+	} else if functionError := header.Get("X-Amz-Function-Error"); functionError != "" {
+		markFailed(result, fmt.Errorf("%s function error - %s", functionError, string(body)))
+	} else if l.Assertions != nil {
+		if err := l.Assertions.Check(code, header, body); err != nil {
+			markFailed(result, err)
+		}
+	}
+
+	return result, &invocationResponse{Status: code, Header: header, Body: body}, nil
+}
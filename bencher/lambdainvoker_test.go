@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const lambdaLogs = "START RequestId: 6f3b7c1e-94a1-4c2b-b0a4-3f2f1c3f8e11 Version: $LATEST\n" +
+	"END RequestId: 6f3b7c1e-94a1-4c2b-b0a4-3f2f1c3f8e11\n" +
+	"REPORT RequestId: 6f3b7c1e-94a1-4c2b-b0a4-3f2f1c3f8e11\tDuration: 12.50 ms\tBilled Duration: 13 ms\t" +
+	"Memory Size: 256 MB\tMax Memory Used: 71 MB\tInit Duration: 153.27 ms\t\n"
+
+func TestParseLambdaReport(t *testing.T) {
+	report, ok := ParseLambdaReport(lambdaLogs)
+	assert.True(t, ok)
+	assert.Equal(t, "6f3b7c1e-94a1-4c2b-b0a4-3f2f1c3f8e11", report.RequestID)
+	assert.Equal(t, 12500*time.Microsecond, report.Duration)
+	assert.Equal(t, 13*time.Millisecond, report.BilledDuration)
+	assert.Equal(t, int32(256), report.MemorySize)
+	assert.Equal(t, int32(71), report.MaxMemoryUsed)
+	assert.Equal(t, 153270*time.Microsecond, report.InitDuration)
+
+	_, ok = ParseLambdaReport("START RequestId: 1\n")
+	assert.False(t, ok)
+}
+
+func TestLambdaInvoker(t *testing.T) {
+	var path, invocationType, authorization, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		path = req.URL.EscapedPath()
+		invocationType = req.Header.Get("X-Amz-Invocation-Type")
+		authorization = req.Header.Get("Authorization")
+		body = string(data)
+		if invocationType == LambdaEvent {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("X-Amz-Executed-Version", "$LATEST")
+		w.Header().Set("X-Amzn-Requestid", "6f3b7c1e-94a1-4c2b-b0a4-3f2f1c3f8e11")
+		w.Header().Set("X-Amz-Log-Result", base64.StdEncoding.EncodeToString([]byte(lambdaLogs)))
+		if strings.Contains(body, "fail") {
+			w.Header().Set("X-Amz-Function-Error", "Unhandled")
+		}
+		_, _ = w.Write([]byte(`{"result":"ok"}`))
+	}))
+	defer server.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	invoker := setupInvoker(t, `
+type: awslambda
+timeout: 5s
+region: eu-west-1
+endpoint: `+server.URL+`
+payload:
+  name: "bench-{{.Seq}}"
+`, "arn:aws:lambda:eu-west-1:123456789012:function:echo").(*LambdaInvoker)
+	trace, _, err := invoker.call(context.Background(), 0, nil, nil)
+	assert.NoError(t, err)
+	assert.False(t, isFailed(trace), trace.Tags[ErrorTag])
+	assert.Equal(t, "/2015-03-31/functions/arn%3Aaws%3Alambda%3Aeu-west-1%3A123456789012%3Afunction%3Aecho/invocations", path)
+	assert.Equal(t, LambdaRequestResponse, invocationType)
+	assert.Contains(t, authorization, "/eu-west-1/lambda/aws4_request")
+	assert.Equal(t, `{"name":"bench-0"}`, body)
+	assert.Equal(t, int32(200), trace.Status)
+	assert.Equal(t, "$LATEST", trace.CodeVersion)
+	assert.Equal(t, "6f3b7c1e-94a1-4c2b-b0a4-3f2f1c3f8e11", trace.Tags[LambdaRequestIDTag])
+	assert.Equal(t, int32(256), trace.Memory)
+	assert.Equal(t, 12500*time.Microsecond, trace.ExecutionLatency.AsDuration())
+	assert.Equal(t, "true", trace.Tags[LambdaColdStartTag])
+	assert.Equal(t, "13000000", trace.Tags[LambdaBilledDurationTag])
+
+	invoker = setupInvoker(t, `
+type: awslambda
+timeout: 5s
+endpoint: `+server.URL+`
+sign: false
+payload: '{"fail":true}'
+`, "function").(*LambdaInvoker)
+	trace, _, err = invoker.call(context.Background(), 0, nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, authorization)
+	assert.True(t, isFailed(trace))
+
+	invoker = setupInvoker(t, `
+type: awslambda
+timeout: 5s
+endpoint: `+server.URL+`
+sign: false
+invocationType: Event
+`, "function").(*LambdaInvoker)
+	trace, _, err = invoker.call(context.Background(), 0, nil, nil)
+	assert.NoError(t, err)
+	assert.False(t, isFailed(trace))
+	assert.Equal(t, int32(202), trace.Status)
+	assert.Equal(t, LambdaEvent, invocationType)
+}
+
+func TestLambdaThrottled(t *testing.T) {
+	var requests int32
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(data))
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.Header().Set("X-Amzn-Errortype", "TooManyRequestsException")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"Reason":"ReservedFunctionConcurrentInvocationLimitExceeded","Type":"User"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"result":"ok"}`))
+	}))
+	defer server.Close()
+
+	invoker := setupInvoker(t, `
+type: awslambda
+timeout: 5s
+endpoint: `+server.URL+`
+sign: false
+payload: '{"seq":{{.Seq}}}'
+retry:
+  maxRetries: 3
+  backoff: 1ms
+`, "function").(*LambdaInvoker)
+	rate := &outcomeRate{}
+	assert.NoError(t, invoker.Exec(rate))
+	assert.Equal(t, 2, rate.throttled)
+	assert.Equal(t, 1, rate.success)
+	//retries send the same payload
+	assert.Equal(t, []string{`{"seq":0}`, `{"seq":0}`, `{"seq":0}`}, bodies)
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redacted = "<redacted>"
+
+//option keys containing one of these are never written to the metadata
+var secretKeys = []string{"token", "secret", "password", "passwd", "auth", "key", "credential"}
+
+//RunMeta is written next to each result file to make a run reproducible.
+type RunMeta struct {
+	Build       string          `json:"build"`
+	GoVersion   string          `json:"goVersion"`
+	CommandLine []string        `json:"commandLine"`
+	Seed        int64           `json:"seed"`
+	Host        HostMeta        `json:"host"`
+	Config      BenchmarkConfig `json:"config"`
+	Start       time.Time       `json:"start"`
+	End         time.Time       `json:"end"`
+	Phases      []PhaseRecord   `json:"phases"`
+	ClockBefore *ClockSync      `json:"clockBefore,omitempty"`
+	ClockAfter  *ClockSync      `json:"clockAfter,omitempty"`
+	Overheads   []PhaseOverhead `json:"overheads,omitempty"`
+	Results     PipelineStats   `json:"results"`
+}
+
+//HostMeta describes the machine that generated the workload.
+type HostMeta struct {
+	Hostname   string `json:"hostname"`
+	OS         string `json:"os"`
+	Arch       string `json:"arch"`
+	CPUs       int    `json:"cpus"`
+	CPUModel   string `json:"cpuModel,omitempty"`
+	MemoryKB   int64  `json:"memoryKB,omitempty"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+}
+
+func readHostMeta() HostMeta {
+	hostname, _ := os.Hostname()
+	host := HostMeta{
+		Hostname:   hostname,
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		CPUs:       runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+	}
+
+	//best effort, only available on linux
+	if value, ok := readProcValue("/proc/cpuinfo", "model name"); ok {
+		host.CPUModel = value
+	}
+	if value, ok := readProcValue("/proc/meminfo", "MemTotal"); ok {
+		mem, err := strconv.ParseInt(strings.TrimSuffix(value, " kB"), 10, 64)
+		if err == nil {
+			host.MemoryKB = mem
+		}
+	}
+	return host
+}
+
+func readProcValue(path string, key string) (string, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		data := strings.SplitN(scanner.Text(), ":", 2)
+		if len(data) == 2 && strings.TrimSpace(data[0]) == key {
+			return strings.TrimSpace(data[1]), true
+		}
+	}
+	return "", false
+}
+
+//metaFileName derives the sidecar name of a result file, e.g. run.csv becomes run.meta.json
+func metaFileName(output string) string {
+	return strings.TrimSuffix(output, filepath.Ext(output)) + ".meta.json"
+}
+
+//writeMeta writes the metadata of the last run next to the result file
+func (b *Bencher) writeMeta(start, end time.Time) error {
+	if b.outputName == "" {
+		return nil
+	}
+
+	config := b.Config
+	config.Workload.Invocation.Options = redactOptions(config.Workload.Invocation.Options)
+	phases := make([]PhaseConfig, len(config.Workload.Phases))
+	for i, phase := range config.Workload.Phases {
+		phase.HatchRate.Options = redactOptions(phase.HatchRate.Options)
+		phases[i] = phase
+	}
+	config.Workload.Phases = phases
+
+	meta := RunMeta{
+		Build:       b.Build,
+		GoVersion:   runtime.Version(),
+		CommandLine: os.Args,
+		Seed:        b.Seed,
+		Host:        readHostMeta(),
+		Config:      config,
+		Start:       start,
+		End:         end,
+		Phases:      b.Timeline(),
+		ClockBefore: b.ClockBefore,
+		ClockAfter:  b.ClockAfter,
+		Overheads:   b.Overheads(),
+	}
+	if b.results != nil {
+		meta.Results = b.results.Stats()
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaFileName(b.outputName), data, 0664)
+}
+
+//redactOptions returns a copy of the options without any secrets
+func redactOptions(options map[string]interface{}) map[string]interface{} {
+	if options == nil {
+		return nil
+	}
+	clean := make(map[string]interface{}, len(options))
+	for k, v := range options {
+		clean[k] = redactValue(k, v)
+	}
+	return clean
+}
+
+func redactValue(key string, value interface{}) interface{} {
+	if isSecretKey(key) {
+		return redacted
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return redactOptions(v)
+	case []interface{}:
+		clean := make([]interface{}, len(v))
+		for i, e := range v {
+			clean[i] = redactValue("", e)
+		}
+		return clean
+	}
+	return value
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,528 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//Tags set by the built-in middleware
+const (
+	TimedOutTag    = "TimedOut"    //true if the call was abandoned by the timeout middleware
+	CircuitOpenTag = "CircuitOpen" //true if the call was rejected by the circuit breaker
+)
+
+//CallResult is the outcome of a single call, the trace is written by the invoker after the middleware chain
+type CallResult struct {
+	Trace  *fact.Trace
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+//Call makes a single invocation, the rate is only used to signal outcomes, e.g. throttles
+type Call func(ctx context.Context, worker int, rate HatchRate) (*CallResult, error)
+
+//Middleware wraps a call, like wrappers of http.RoundTripper, e.g. to retry or tag it
+type Middleware func(next Call) Call
+
+//CallInvoker is implemented by invokers that return the trace of a call instead of writing it, required for middleware.
+//The rate of the phase is passed to signal throttles, the call must not take from it or report its outcome.
+//The built-in invokers support middleware unless their results complete later, e.g. with callbacks.
+type CallInvoker interface {
+	Invoker
+	Call(ctx context.Context, worker int, rate HatchRate) (*CallResult, error)
+}
+
+//deferredInvoker is implemented by invokers that may write traces after the call returned
+type deferredInvoker interface {
+	completesLater() bool
+}
+
+type MiddlewareConstructor func(options map[string]interface{}) (Middleware, error)
+
+//MiddlewareHook is run by the MiddlewareInvoker for middleware with state, e.g. to reset a retry budget
+//before each phase or to close a file after the run. Either function can be nil.
+type MiddlewareHook struct {
+	Setup func()
+	Close func() error
+}
+
+var _middlewareTypes = []string{"timeout", "retry", "circuitBreaker", "capture", "tag"}
+
+var _middleware = make(map[string]MiddlewareConstructor)
+
+//Extension Method to register more middleware used during config parsing
+func RegisterMiddleware(name string, constructor MiddlewareConstructor) error {
+	for _, k := range _middlewareTypes {
+		if name == k {
+			return fmt.Errorf("cannot use %s to register a Middleware", name)
+		}
+	}
+	_middleware[name] = constructor
+	return nil
+}
+
+func newMiddlewareFromConfig(options map[string]interface{}) (Middleware, *MiddlewareHook, error) {
+	if !checkFields(options, "type") {
+		return nil, nil, fmt.Errorf("middleware needs a type")
+	}
+	_type := stringValue("type", options, "")
+	switch _type {
+	case "timeout":
+		timeout, err := time.ParseDuration(stringValue("timeout", options, ""))
+		if err != nil || timeout <= 0 {
+			return nil, nil, fmt.Errorf("timeout middleware needs a timeout")
+		}
+		return TimeoutMiddleware(timeout), nil, nil
+	case "retry":
+		policy, err := newRetryPolicyFromConfig(map[string]interface{}{"retry": options}, maxRetries-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return RetryMiddleware(policy), &MiddlewareHook{Setup: policy.reset}, nil
+	case "circuitBreaker":
+		failures := 5
+		if val, ok := options["failures"]; ok {
+			failures, ok = val.(int)
+			if !ok || failures < 1 {
+				return nil, nil, fmt.Errorf("circuitBreaker failures must be a positive number")
+			}
+		}
+		cooldown, err := time.ParseDuration(stringValue("cooldown", options, "30s"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid circuitBreaker cooldown - %+v", err)
+		}
+		return CircuitBreakerMiddleware(failures, cooldown), nil, nil
+	case "capture":
+		if !checkFields(options, "file") {
+			return nil, nil, fmt.Errorf("capture middleware needs a file")
+		}
+		maxBody := 4096
+		if val, ok := options["maxBody"]; ok {
+			maxBody, ok = val.(int)
+			if !ok || maxBody < 0 {
+				return nil, nil, fmt.Errorf("capture maxBody must be a positive number")
+			}
+		}
+		file, err := os.OpenFile(stringValue("file", options, ""), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open capture file - %+v", err)
+		}
+		return CaptureMiddleware(file, maxBody, flagValue("failedOnly", options, false)), &MiddlewareHook{Close: file.Close}, nil
+	case "tag":
+		tags, err := stringMap("tags", options)
+		if err != nil {
+			return nil, nil, err
+		}
+		return TagMiddleware(tags), nil, nil
+	}
+
+	if val, ok := _middleware[_type]; ok {
+		middleware, err := val(options)
+		return middleware, nil, err
+	}
+	return nil, nil, fmt.Errorf("unknown middleware type %s", _type)
+}
+
+//withMiddleware wraps the invoker if middleware is configured as a list under middleware:
+func withMiddleware(invoker Invoker, options map[string]interface{}) (Invoker, error) {
+	configs := listValue("middleware", options)
+	if len(configs) == 0 {
+		return invoker, nil
+	}
+	chain := make([]Middleware, 0, len(configs))
+	hooks := make([]*MiddlewareHook, 0)
+	closeHooks := func() {
+		for _, hook := range hooks {
+			if hook.Close != nil {
+				_ = hook.Close()
+			}
+		}
+	}
+	for _, val := range configs {
+		config, ok := val.(map[string]interface{})
+		if !ok {
+			closeHooks()
+			return nil, fmt.Errorf("middleware must be a list of maps")
+		}
+		middleware, hook, err := newMiddlewareFromConfig(config)
+		if err != nil {
+			closeHooks()
+			return nil, err
+		}
+		chain = append(chain, middleware)
+		if hook != nil {
+			hooks = append(hooks, hook)
+		}
+	}
+	wrapped, err := NewMiddlewareInvoker(invoker, chain...)
+	if err != nil {
+		closeHooks()
+		return nil, err
+	}
+	wrapped.Hooks = hooks
+	return wrapped, nil
+}
+
+//MiddlewareInvoker runs each call of an invoker through a chain of middleware, the first middleware is the outermost.
+//Calls are not bound to the phase, calls still running at its end complete as without middleware.
+type MiddlewareInvoker struct {
+	Invoker Invoker
+	Chain   []Middleware
+	//Hooks of the middleware in the chain, set up before each phase and closed after the run
+	Hooks []*MiddlewareHook
+
+	call    Call
+	results *ResultPipeline
+}
+
+//NewMiddlewareInvoker wraps an invoker, it has to be a CallInvoker or one of the built-in invokers
+func NewMiddlewareInvoker(invoker Invoker, chain ...Middleware) (*MiddlewareInvoker, error) {
+	if deferred, ok := invoker.(deferredInvoker); ok && deferred.completesLater() {
+		return nil, fmt.Errorf("middleware needs invokers that complete within the call, disable callbacks and non-blocking modes")
+	}
+
+	var call Call
+	if callable, ok := invoker.(CallInvoker); ok {
+		call = func(ctx context.Context, worker int, rate HatchRate) (*CallResult, error) {
+			return callable.Call(ctx, worker, rate)
+		}
+	} else if callable, ok := invoker.(stepInvoker); ok {
+		call = func(ctx context.Context, worker int, rate HatchRate) (*CallResult, error) {
+			trace, response, err := callable.call(ctx, worker, nil, rate)
+			if err != nil {
+				return nil, err
+			}
+			result := &CallResult{Trace: trace}
+			if response != nil {
+				result.Status, result.Header, result.Body = response.Status, response.Header, response.Body
+			}
+			return result, nil
+		}
+	} else {
+		return nil, fmt.Errorf("%T does not support middleware, it has to implement CallInvoker", invoker)
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		call = chain[i](call)
+	}
+	return &MiddlewareInvoker{
+		Invoker: invoker,
+		Chain:   chain,
+		call:    call,
+	}, nil
+}
+
+func (m *MiddlewareInvoker) Setup(ctx context.Context, phase *Phase, bencher *Bencher) error {
+	m.results = bencher.results
+	for _, hook := range m.Hooks {
+		if hook.Setup != nil {
+			hook.Setup()
+		}
+	}
+	return m.Invoker.Setup(ctx, phase, bencher)
+}
+
+func (m *MiddlewareInvoker) Exec(rate HatchRate) error {
+	return m.ExecAs(0, rate)
+}
+
+func (m *MiddlewareInvoker) ExecAs(worker int, rate HatchRate) error {
+	err := rate.Take()
+	if err != nil {
+		return err
+	}
+
+	result, err := m.call(context.Background(), worker, rate)
+	if err != nil {
+		rate.OnFailed()
+		return err
+	}
+
+	if callFailed(result) {
+		rate.OnFailed()
+	} else {
+		rate.OnSuccess()
+	}
+	m.results.Add(result.Trace)
+	return nil
+}
+
+//PreRun and PostRun are forwarded to the wrapped invoker, PostRun also closes the hooks
+func (m *MiddlewareInvoker) PreRun() error {
+	if lifecycle, ok := m.Invoker.(LifecycleInvoker); ok {
+		return lifecycle.PreRun()
+	}
+	return nil
+}
+
+func (m *MiddlewareInvoker) PostRun() error {
+	var err error
+	if lifecycle, ok := m.Invoker.(LifecycleInvoker); ok {
+		err = lifecycle.PostRun()
+	}
+	for _, hook := range m.Hooks {
+		if hook.Close == nil {
+			continue
+		}
+		if closeErr := hook.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close middleware - %+v", closeErr)
+		}
+	}
+	return err
+}
+
+//SweepSteps and ApplySweep are forwarded to the wrapped invoker
+func (m *MiddlewareInvoker) SweepSteps() []string {
+	if sweeper, ok := m.Invoker.(PhaseSweeper); ok {
+		return sweeper.SweepSteps()
+	}
+	return nil
+}
+
+func (m *MiddlewareInvoker) ApplySweep(step int, target string) error {
+	if sweeper, ok := m.Invoker.(PhaseSweeper); ok {
+		return sweeper.ApplySweep(step, target)
+	}
+	return fmt.Errorf("%T has no sweep", m.Invoker)
+}
+
+//callFailed reports if the call failed, e.g. by an assertion or with an error status
+func callFailed(result *CallResult) bool {
+	status := int(result.Trace.Status)
+	if result.Status > 0 {
+		status = result.Status
+	}
+	return isFailed(result.Trace) || status == 0 || status >= 400
+}
+
+//failedCall is the result of a call that did not reach the platform
+func failedCall(err error, tag string) *CallResult {
+	now := timestamppb.Now()
+	trace := &fact.Trace{
+		ID:               uuid.New().String(),
+		Timestamp:        now,
+		RequestStartTime: now,
+		Tags:             map[string]string{tag: "true"},
+	}
+	markFailed(trace, err)
+	return &CallResult{Trace: trace}
+}
+
+//TimeoutMiddleware fails calls that take longer than the timeout, the call is cancelled with its context and not written.
+//Custom invokers have to stop their call once the context is done, otherwise it keeps running in the background.
+func TimeoutMiddleware(timeout time.Duration) Middleware {
+	return func(next Call) Call {
+		return func(ctx context.Context, worker int, rate HatchRate) (*CallResult, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			type outcome struct {
+				result *CallResult
+				err    error
+			}
+			done := make(chan outcome, 1)
+			go func() {
+				result, err := next(ctx, worker, rate)
+				done <- outcome{result, err}
+			}()
+			select {
+			case o := <-done:
+				return o.result, o.err
+			case <-ctx.Done():
+				return failedCall(fmt.Errorf("call timed out after %s", timeout), TimedOutTag), nil
+			}
+		}
+	}
+}
+
+//RetryMiddleware retries failed calls as the policy allows, throttles are signaled to the rate.
+//The retries stack with those of the invoker, e.g. ow retries failed invocations itself,
+//set retry: {maxRetries: 0} on the invoker to only retry in the middleware.
+//The budget of the policy is not reset, configured retry middleware is reset by the MiddlewareInvoker before each phase.
+func RetryMiddleware(policy *RetryPolicy) Middleware {
+	return func(next Call) Call {
+		return func(ctx context.Context, worker int, rate HatchRate) (*CallResult, error) {
+			retry := policy.start(ctx)
+			for {
+				result, err := next(ctx, worker, rate)
+				if err == nil && !callFailed(result) {
+					retry.tag(result.Trace)
+					return result, nil
+				}
+				var status int
+				var header http.Header
+				if result != nil {
+					status, header = result.Status, result.Header
+					if status == 0 {
+						status = int(result.Trace.Status)
+					}
+				}
+				if !retry.retry(rate, status, header) {
+					if result != nil {
+						retry.tag(result.Trace)
+					}
+					return result, err
+				}
+			}
+		}
+	}
+}
+
+//circuitBreaker opens after consecutive failures, after the cooldown a single call probes if the platform recovered
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	failures  int
+	openUntil time.Time
+	probing   bool
+	sync.Mutex
+}
+
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) record(failed bool, now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	if !failed {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.probing = false
+		return
+	}
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		log.Debugf("circuit opened after %d failures", b.failures)
+		b.openUntil = now.Add(b.cooldown)
+		b.failures = 0
+	}
+	b.probing = false
+}
+
+//CircuitBreakerMiddleware rejects calls for the cooldown after the given number of consecutive failures.
+//Rejected calls are written as failed traces tagged with CircuitOpen.
+func CircuitBreakerMiddleware(failures int, cooldown time.Duration) Middleware {
+	breaker := &circuitBreaker{threshold: failures, cooldown: cooldown}
+	return func(next Call) Call {
+		return func(ctx context.Context, worker int, rate HatchRate) (*CallResult, error) {
+			if !breaker.allow(time.Now()) {
+				return failedCall(fmt.Errorf("circuit open"), CircuitOpenTag), nil
+			}
+			result, err := next(ctx, worker, rate)
+			breaker.record(err != nil || callFailed(result), time.Now())
+			return result, err
+		}
+	}
+}
+
+//capturedCall is one line of the capture file
+type capturedCall struct {
+	Time    time.Time   `json:"time"`
+	Worker  int         `json:"worker"`
+	ID      string      `json:"id"`
+	Status  int         `json:"status"`
+	Latency int64       `json:"latency"` //in ns
+	Error   string      `json:"error,omitempty"`
+	Header  http.Header `json:"header,omitempty"`
+	Body    string      `json:"body,omitempty"`
+}
+
+//CaptureMiddleware writes the response of each call as json line, bodies are truncated to maxBody bytes.
+//With failedOnly only failed calls are captured, e.g. to inspect the errors of a platform.
+func CaptureMiddleware(file *os.File, maxBody int, failedOnly bool) Middleware {
+	var lock sync.Mutex
+	encoder := json.NewEncoder(file)
+	return func(next Call) Call {
+		return func(ctx context.Context, worker int, rate HatchRate) (*CallResult, error) {
+			start := time.Now()
+			result, err := next(ctx, worker, rate)
+			if err == nil && failedOnly && !callFailed(result) {
+				return result, err
+			}
+
+			record := capturedCall{Time: start, Worker: worker, Latency: time.Since(start).Nanoseconds()}
+			if err != nil {
+				record.Error = err.Error()
+			}
+			if result != nil {
+				record.ID = result.Trace.ID
+				record.Status = result.Status
+				if record.Status == 0 {
+					record.Status = int(result.Trace.Status)
+				}
+				if isFailed(result.Trace) {
+					record.Error = result.Trace.Tags[ErrorTag]
+				}
+				record.Header = result.Header
+				body := result.Body
+				if len(body) > maxBody {
+					body = body[:maxBody]
+				}
+				record.Body = string(body)
+			}
+
+			lock.Lock()
+			if err := encoder.Encode(record); err != nil {
+				log.Debugf("failed to capture %s - %+v", record.ID, err)
+			}
+			lock.Unlock()
+			return result, err
+		}
+	}
+}
+
+//TagMiddleware adds the tags to the trace of each call, e.g. to label the runs of an experiment
+func TagMiddleware(tags map[string]string) Middleware {
+	return func(next Call) Call {
+		return func(ctx context.Context, worker int, rate HatchRate) (*CallResult, error) {
+			result, err := next(ctx, worker, rate)
+			if result != nil {
+				if result.Trace.Tags == nil {
+					result.Trace.Tags = make(map[string]string)
+				}
+				for k, v := range tags {
+					result.Trace.Tags[k] = v
+				}
+			}
+			return result, err
+		}
+	}
+}
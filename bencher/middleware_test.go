@@ -0,0 +1,262 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+	"github.com/stretchr/testify/assert"
+)
+
+//countingInvoker is a minimal invoker of a Go user, it fails every second call
+type countingInvoker struct {
+	calls int32
+}
+
+func (c *countingInvoker) Setup(context.Context, *Phase, *Bencher) error { return nil }
+func (c *countingInvoker) Exec(HatchRate) error                          { return fmt.Errorf("only calls") }
+func (c *countingInvoker) Call(ctx context.Context, worker int, rate HatchRate) (*CallResult, error) {
+	n := atomic.AddInt32(&c.calls, 1)
+	trace := &fact.Trace{ID: fmt.Sprintf("c%d", n), Status: 200}
+	if n%2 == 1 {
+		trace.Status = 500
+	}
+	return &CallResult{Trace: trace}, nil
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	capture := filepath.Join(t.TempDir(), "capture.jsonl")
+	invoker := setupInvoker(t, fmt.Sprintf(`
+type: http
+timeout: 1s
+middleware:
+  - type: tag
+    tags:
+      experiment: baseline
+  - type: capture
+    file: %s
+  - type: retry
+    maxRetries: 3
+    backoff: 1ms
+`, capture), server.URL).(*MiddlewareInvoker)
+
+	result, err := invoker.call(context.Background(), 0, &outcomeRate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int32(200), result.Trace.Status)
+	assert.Equal(t, "2", result.Trace.Tags[RetriesTag])
+	assert.Equal(t, "baseline", result.Trace.Tags["experiment"])
+
+	//the capture is inside of the tags but outside of the retries
+	data, err := ioutil.ReadFile(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if assert.Len(t, lines, 1) {
+		var record capturedCall
+		assert.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+		assert.Equal(t, 200, record.Status)
+		assert.Equal(t, "{}", record.Body)
+		assert.Equal(t, result.Trace.ID, record.ID)
+	}
+
+	//traces of callbacks complete later, middleware can not see them
+	_, err = NewInvokerFromConfig(InvokerConfig{Type: "http", Options: map[string]interface{}{
+		"timeout":    "1s",
+		"callback":   map[string]interface{}{"listen": "127.0.0.1:0"},
+		"middleware": []interface{}{map[string]interface{}{"type": "tag"}},
+	}})
+	assert.Error(t, err)
+	_, err = NewInvokerFromConfig(InvokerConfig{Type: "http", Options: map[string]interface{}{
+		"timeout":    "1s",
+		"middleware": []interface{}{map[string]interface{}{"type": "unknown"}},
+	}})
+	assert.Error(t, err)
+}
+
+func TestMiddlewareBuiltins(t *testing.T) {
+	var requests int32
+	cancelled := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if req.URL.Path == "/slow" {
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-req.Context().Done():
+				cancelled <- struct{}{}
+				return
+			}
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	breaker := setupInvoker(t, `
+type: http
+timeout: 1s
+middleware:
+  - type: circuitBreaker
+    failures: 2
+    cooldown: 1h
+`, server.URL).(*MiddlewareInvoker)
+	for i := 0; i < 3; i++ {
+		result, err := breaker.call(context.Background(), 0, &outcomeRate{})
+		assert.NoError(t, err)
+		assert.True(t, callFailed(result))
+		assert.Equal(t, i == 2, result.Trace.Tags[CircuitOpenTag] == "true")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	timeout := setupInvoker(t, `
+type: http
+timeout: 1s
+middleware:
+  - type: timeout
+    timeout: 20ms
+`, server.URL+"/slow").(*MiddlewareInvoker)
+	start := time.Now()
+	result, err := timeout.call(context.Background(), 0, &outcomeRate{})
+	assert.NoError(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(400*time.Millisecond))
+	assert.True(t, isFailed(result.Trace))
+	assert.Equal(t, "true", result.Trace.Tags[TimedOutTag])
+	//the request is cancelled instead of running on in the background
+	select {
+	case <-cancelled:
+	case <-time.After(400 * time.Millisecond):
+		t.Error("timed out request was not cancelled")
+	}
+}
+
+func TestMiddlewareHooks(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	capture := filepath.Join(t.TempDir(), "calls.json")
+	invoker := setupInvoker(t, fmt.Sprintf(`
+type: http
+timeout: 1s
+middleware:
+  - type: retry
+    maxRetries: 20
+    backoff: 1ms
+    budget: 0.001
+  - type: capture
+    file: %s
+`, capture), server.URL).(*MiddlewareInvoker)
+	assert.Len(t, invoker.Hooks, 2)
+
+	//the first call spends the budget of the phase
+	_, err := invoker.call(context.Background(), 0, &outcomeRate{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(retryBudgetFloor+1), atomic.LoadInt32(&requests))
+	_, err = invoker.call(context.Background(), 0, &outcomeRate{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(retryBudgetFloor+2), atomic.LoadInt32(&requests))
+
+	//the next phase starts with a new budget
+	assert.NoError(t, invoker.Setup(context.Background(), &Phase{Threads: 1, Target: server.URL}, &Bencher{results: invoker.results}))
+	_, err = invoker.call(context.Background(), 0, &outcomeRate{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2*retryBudgetFloor+3), atomic.LoadInt32(&requests))
+
+	//the capture file is closed after the run
+	assert.NoError(t, invoker.PostRun())
+	_, err = invoker.call(context.Background(), 0, &outcomeRate{})
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//every attempt before the close was captured, none after it
+	assert.Equal(t, 2*retryBudgetFloor+3, strings.Count(string(data), "\n"))
+}
+
+func TestMiddlewareRegistered(t *testing.T) {
+	assert.NoError(t, RegisterInvoker("counting", func(config InvokerConfig) (Invoker, error) {
+		return &countingInvoker{}, nil
+	}))
+	assert.NoError(t, RegisterMiddleware("stamp", func(options map[string]interface{}) (Middleware, error) {
+		return func(next Call) Call {
+			return func(ctx context.Context, worker int, rate HatchRate) (*CallResult, error) {
+				result, err := next(ctx, worker, rate)
+				if result != nil {
+					if result.Trace.Tags == nil {
+						result.Trace.Tags = make(map[string]string)
+					}
+					result.Trace.Tags["Stamp"] = fmt.Sprint(worker)
+				}
+				return result, err
+			}
+		}, nil
+	}))
+	assert.Error(t, RegisterMiddleware("retry", nil))
+
+	invoker, err := NewInvokerFromConfig(InvokerConfig{Type: "counting", Options: map[string]interface{}{
+		"middleware": []interface{}{
+			map[string]interface{}{"type": "stamp"},
+			map[string]interface{}{"type": "retry", "backoff": "1ms"},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &collectingWriter{}
+	results, err := NewResultPipeline(PipelineConfig{}, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, invoker.Setup(context.Background(), &Phase{Threads: 1}, &Bencher{results: results}))
+	rate := &outcomeRate{}
+	assert.NoError(t, invoker.(WorkerInvoker).ExecAs(3, rate))
+	results.Close()
+
+	assert.Equal(t, 1, rate.success)
+	if assert.Len(t, writer.traces, 1) {
+		assert.Equal(t, "c2", writer.traces[0].ID)
+		assert.Equal(t, "3", writer.traces[0].Tags["Stamp"])
+	}
+}
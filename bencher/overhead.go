@@ -0,0 +1,233 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+)
+
+//Tags used to emit the derived overheads of each trace
+const (
+	IngressOverheadTag  = "IngressOverhead"
+	EgressOverheadTag   = "EgressOverhead"
+	PlatformOverheadTag = "PlatformOverhead"
+)
+
+//Overhead decomposes a single request into the time spent in the platform and in the function.
+//Ingress and egress compare client and function clocks, use NTPConfig.Correct to align them.
+type Overhead struct {
+	Ingress  time.Duration //RequestStartTime to StartTime
+	Egress   time.Duration //EndTime to RequestEndTime
+	Platform time.Duration //RequestStartTime to RequestEndTime minus execution
+
+	HasIngress  bool
+	HasEgress   bool
+	HasPlatform bool
+}
+
+//DeriveOverhead computes all overheads that the fields of the trace allow for.
+func DeriveOverhead(t *fact.Trace) Overhead {
+	var o Overhead
+	if t.RequestStartTime != nil && t.StartTime != nil {
+		o.Ingress = t.StartTime.AsTime().Sub(t.RequestStartTime.AsTime())
+		o.HasIngress = true
+	}
+	if t.EndTime != nil && t.RequestEndTime != nil {
+		o.Egress = t.RequestEndTime.AsTime().Sub(t.EndTime.AsTime())
+		o.HasEgress = true
+	}
+
+	//the http invoker measures RequestResponseLatency from the first response byte, only the timestamps span the round trip
+	var roundTrip time.Duration
+	if t.RequestStartTime != nil && t.RequestEndTime != nil {
+		roundTrip = t.RequestEndTime.AsTime().Sub(t.RequestStartTime.AsTime())
+	} else if t.RequestResponseLatency != nil {
+		roundTrip = t.RequestResponseLatency.AsDuration()
+	}
+	var execution time.Duration
+	if t.ExecutionLatency != nil {
+		execution = t.ExecutionLatency.AsDuration()
+	} else if t.StartTime != nil && t.EndTime != nil {
+		execution = t.EndTime.AsTime().Sub(t.StartTime.AsTime())
+	}
+	if roundTrip > 0 && execution > 0 {
+		o.Platform = roundTrip - execution
+		o.HasPlatform = true
+	}
+	return o
+}
+
+//Tag writes all known overheads as nanoseconds into the tags of the trace.
+func (o Overhead) Tag(t *fact.Trace) {
+	if !o.HasIngress && !o.HasEgress && !o.HasPlatform {
+		return
+	}
+	if t.Tags == nil {
+		t.Tags = make(map[string]string)
+	}
+	if o.HasIngress {
+		t.Tags[IngressOverheadTag] = strconv.FormatInt(int64(o.Ingress), 10)
+	}
+	if o.HasEgress {
+		t.Tags[EgressOverheadTag] = strconv.FormatInt(int64(o.Egress), 10)
+	}
+	if o.HasPlatform {
+		t.Tags[PlatformOverheadTag] = strconv.FormatInt(int64(o.Platform), 10)
+	}
+}
+
+//DurationStats aggregates a set of durations, percentiles are estimated from a bounded sample.
+type DurationStats struct {
+	Count int           `json:"count"`
+	Min   time.Duration `json:"min"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P95   time.Duration `json:"p95"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+//overheadReservoirSize bounds the samples kept per phase and overhead
+const overheadReservoirSize = 10000
+
+//durationReservoir counts all durations exactly and keeps a uniform random sample of them for the percentiles
+type durationReservoir struct {
+	count    int
+	sum      time.Duration
+	min, max time.Duration
+	samples  []time.Duration
+	random   *rand.Rand
+}
+
+func newDurationReservoir() *durationReservoir {
+	//own source, the global one is seeded for the workload
+	return &durationReservoir{random: rand.New(rand.NewSource(1))}
+}
+
+func (r *durationReservoir) add(d time.Duration) {
+	if r.count == 0 || d < r.min {
+		r.min = d
+	}
+	if r.count == 0 || d > r.max {
+		r.max = d
+	}
+	r.count++
+	r.sum += d
+	if len(r.samples) < overheadReservoirSize {
+		r.samples = append(r.samples, d)
+	} else if i := r.random.Intn(r.count); i < overheadReservoirSize {
+		r.samples[i] = d
+	}
+}
+
+func (r *durationReservoir) stats() DurationStats {
+	if r.count == 0 {
+		return DurationStats{}
+	}
+	sorted := make([]time.Duration, len(r.samples))
+	copy(sorted, r.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	percentile := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))]
+	}
+
+	return DurationStats{
+		Count: r.count,
+		Min:   r.min,
+		Mean:  r.sum / time.Duration(r.count),
+		P50:   percentile(.5),
+		P95:   percentile(.95),
+		P99:   percentile(.99),
+		Max:   r.max,
+	}
+}
+
+//PhaseOverhead are the aggregated overheads of all traces started in a phase.
+type PhaseOverhead struct {
+	Phase    string        `json:"phase"`
+	Ingress  DurationStats `json:"ingress"`
+	Egress   DurationStats `json:"egress"`
+	Platform DurationStats `json:"platform"`
+}
+
+type overheadSamples struct {
+	ingress  *durationReservoir
+	egress   *durationReservoir
+	platform *durationReservoir
+}
+
+//overheadCollector keeps the derived overheads of each phase in bounded memory
+type overheadCollector struct {
+	phases  map[string]*overheadSamples
+	ordered []string
+	sync.Mutex
+}
+
+func newOverheadCollector() *overheadCollector {
+	return &overheadCollector{
+		phases:  make(map[string]*overheadSamples),
+		ordered: make([]string, 0),
+	}
+}
+
+func (c *overheadCollector) add(phase string, o Overhead) {
+	c.Lock()
+	defer c.Unlock()
+	samples, ok := c.phases[phase]
+	if !ok {
+		samples = &overheadSamples{
+			ingress:  newDurationReservoir(),
+			egress:   newDurationReservoir(),
+			platform: newDurationReservoir(),
+		}
+		c.phases[phase] = samples
+		c.ordered = append(c.ordered, phase)
+	}
+	if o.HasIngress {
+		samples.ingress.add(o.Ingress)
+	}
+	if o.HasEgress {
+		samples.egress.add(o.Egress)
+	}
+	if o.HasPlatform {
+		samples.platform.add(o.Platform)
+	}
+}
+
+func (c *overheadCollector) summary() []PhaseOverhead {
+	c.Lock()
+	defer c.Unlock()
+	result := make([]PhaseOverhead, 0, len(c.ordered))
+	for _, phase := range c.ordered {
+		samples := c.phases[phase]
+		result = append(result, PhaseOverhead{
+			Phase:    phase,
+			Ingress:  samples.ingress.stats(),
+			Egress:   samples.egress.stats(),
+			Platform: samples.platform.stats(),
+		})
+	}
+	return result
+}
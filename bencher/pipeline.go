@@ -0,0 +1,236 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+)
+
+//Overflow policies of the result pipeline
+const (
+	OverflowBlock  = "block"  //invokers wait until the writer catches up
+	OverflowDrop   = "drop"   //traces are dropped and counted
+	OverflowSample = "sample" //only a sample of the traces is kept, the rest is dropped
+)
+
+const defaultQueueSize = 10000
+const defaultBatchSize = 1000
+const defaultFlushInterval = time.Second * 5
+
+//PipelineConfig bounds the memory used for results between the invokers and the output.
+type PipelineConfig struct {
+	QueueSize     int           `json:"queueSize" yaml:"queueSize"`         //max number of traces waiting to be written
+	BatchSize     int           `json:"batchSize" yaml:"batchSize"`         //traces are written once a batch is full
+	FlushInterval time.Duration `json:"flushInterval" yaml:"flushInterval"` //or after this interval
+	Overflow      string        `json:"overflow" yaml:"overflow"`           //block, drop or sample
+	SampleRate    float64       `json:"sampleRate" yaml:"sampleRate"`       //share of traces kept on overflow with sample
+}
+
+func (c PipelineConfig) withDefaults() (PipelineConfig, error) {
+	if c.QueueSize <= 0 {
+		c.QueueSize = defaultQueueSize
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaultFlushInterval
+	}
+	c.Overflow = strings.TrimSpace(strings.ToLower(c.Overflow))
+	switch c.Overflow {
+	case "":
+		c.Overflow = OverflowBlock
+	case OverflowBlock, OverflowDrop:
+	case OverflowSample:
+		if c.SampleRate <= 0 || c.SampleRate > 1 {
+			return c, fmt.Errorf("sampleRate must be in (0,1] for the sample overflow")
+		}
+	default:
+		return c, fmt.Errorf("unknown overflow policy %s", c.Overflow)
+	}
+	return c, nil
+}
+
+//PipelineStats are the counters of a result pipeline.
+type PipelineStats struct {
+	Added         uint64 `json:"added"`
+	Written       uint64 `json:"written"`
+	Dropped       uint64 `json:"dropped"`
+	Failed        uint64 `json:"failed"` //traces marked as failed, e.g. by assertions
+	WriteFailures uint64 `json:"writeFailures"`
+	QueueDepth    int    `json:"queueDepth"`
+	MaxQueueDepth int    `json:"maxQueueDepth"`
+	QueueSize     int    `json:"queueSize"`
+}
+
+//ResultPipeline streams traces from the invokers through a bounded queue to a writer.
+type ResultPipeline struct {
+	//counters first to keep them 64bit aligned for atomic access
+	added         uint64
+	written       uint64
+	dropped       uint64
+	failed        uint64
+	writeFailures uint64
+	maxDepth      int64
+
+	config    PipelineConfig
+	queue     chan *fact.Trace
+	writer    fact.TraceWriter
+	observers []TraceObserver
+	done      chan struct{}
+
+	closed bool
+	sync.RWMutex
+}
+
+//NewResultPipeline starts a pipeline that writes all added traces to the writer.
+func NewResultPipeline(config PipelineConfig, writer fact.TraceWriter, observers ...TraceObserver) (*ResultPipeline, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ResultPipeline{
+		config:    config,
+		queue:     make(chan *fact.Trace, config.QueueSize),
+		writer:    writer,
+		observers: observers,
+		done:      make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+//Add enqueues a trace, depending on the overflow policy this blocks or drops the trace if the queue is full.
+func (p *ResultPipeline) Add(t *fact.Trace) {
+	p.RLock()
+	defer p.RUnlock()
+	if p.closed {
+		atomic.AddUint64(&p.dropped, 1)
+		log.Debugf("dropped trace %s, pipeline is closed", t.ID)
+		return
+	}
+	atomic.AddUint64(&p.added, 1)
+
+	select {
+	case p.queue <- t:
+	default:
+		switch p.config.Overflow {
+		case OverflowDrop:
+			atomic.AddUint64(&p.dropped, 1)
+			return
+		case OverflowSample:
+			if rand.Float64() >= p.config.SampleRate {
+				atomic.AddUint64(&p.dropped, 1)
+				return
+			}
+		}
+		p.queue <- t
+	}
+
+	depth := int64(len(p.queue))
+	for {
+		max := atomic.LoadInt64(&p.maxDepth)
+		if depth <= max || atomic.CompareAndSwapInt64(&p.maxDepth, max, depth) {
+			break
+		}
+	}
+}
+
+func (p *ResultPipeline) run() {
+	defer close(p.done)
+
+	batch := make([]*fact.Trace, 0, p.config.BatchSize)
+	ticker := time.NewTicker(p.config.FlushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := p.writer.Write(batch)
+		if err != nil {
+			atomic.AddUint64(&p.writeFailures, 1)
+			log.Errorf("failed to write %d results - %+v", len(batch), err)
+		} else {
+			atomic.AddUint64(&p.written, uint64(len(batch)))
+		}
+		batch = make([]*fact.Trace, 0, p.config.BatchSize)
+	}
+
+	for {
+		select {
+		case t, ok := <-p.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if isFailed(t) {
+				atomic.AddUint64(&p.failed, 1)
+			}
+			for _, observer := range p.observers {
+				observer.Observe(t)
+			}
+			batch = append(batch, t)
+			if len(batch) >= p.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			depth := len(p.queue)
+			log.Debugf("result queue %d/%d, dropped %d", depth, p.config.QueueSize, atomic.LoadUint64(&p.dropped))
+			if depth > p.config.QueueSize*8/10 {
+				log.Warnf("result queue is %d/%d full, the output can not keep up", depth, p.config.QueueSize)
+			}
+			flush()
+		}
+	}
+}
+
+//Close stops accepting traces and blocks until all queued traces are written.
+func (p *ResultPipeline) Close() {
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.queue)
+	p.Unlock()
+	<-p.done
+}
+
+//Stats returns the current counters of the pipeline.
+func (p *ResultPipeline) Stats() PipelineStats {
+	return PipelineStats{
+		Added:         atomic.LoadUint64(&p.added),
+		Written:       atomic.LoadUint64(&p.written),
+		Dropped:       atomic.LoadUint64(&p.dropped),
+		Failed:        atomic.LoadUint64(&p.failed),
+		WriteFailures: atomic.LoadUint64(&p.writeFailures),
+		QueueDepth:    len(p.queue),
+		MaxQueueDepth: int(atomic.LoadInt64(&p.maxDepth)),
+		QueueSize:     p.config.QueueSize,
+	}
+}
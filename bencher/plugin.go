@@ -0,0 +1,472 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//PluginProtocolVersion is sent with the setup request, plugins should refuse versions they do not know
+const PluginProtocolVersion = 1
+
+//Operations of the plugin protocol
+const (
+	PluginSetup = "setup" //once per phase after the process started, answered before the first exec
+	PluginExec  = "exec"  //one invocation, answered with the trace
+	PluginClose = "close" //the phase ended, the plugin should exit after answering
+)
+
+//pluginMaxLine is the longest response line read from a plugin
+const pluginMaxLine = 16 * 1024 * 1024
+
+//PluginRequest is written as one json line to the stdin of the plugin.
+type PluginRequest struct {
+	ID       int64                  `json:"id"`
+	Op       string                 `json:"op"`
+	Protocol int                    `json:"protocol,omitempty"` //setup only
+	Phase    *PluginPhase           `json:"phase,omitempty"`    //setup only
+	Config   map[string]interface{} `json:"config,omitempty"`   //setup only, the config of the invoker
+	Worker   int                    `json:"worker"`
+	Payload  string                 `json:"payload,omitempty"` //rendered payload of the invocation
+	Vars     map[string]string      `json:"vars,omitempty"`    //variables of scenario steps
+}
+
+//PluginPhase describes the phase the plugin is started for
+type PluginPhase struct {
+	Name    string `json:"name"`
+	Target  string `json:"target"`
+	Threads int    `json:"threads"`
+}
+
+//PluginResponse is read as one json line from the stdout of the plugin, it answers the request with the same id.
+//Responses can be written in any order, e.g. by plugins that run invocations concurrently.
+type PluginResponse struct {
+	ID     int64             `json:"id"`
+	Trace  *fact.Trace       `json:"trace,omitempty"` //fields as in fact.Trace, timestamps as {"seconds":..,"nanos":..}
+	Status int               `json:"status,omitempty"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   string            `json:"body,omitempty"`
+	Error  string            `json:"error,omitempty"` //failed invocation, or failed setup
+}
+
+//PluginInvoker runs invocations through an external process, e.g. a python or node script for platforms without go sdk.
+//The process is started for each phase and speaks line delimited json over stdin and stdout, its stderr is logged.
+//Request timestamps the plugin does not report are measured around the exchange with the process.
+type PluginInvoker struct {
+	Command string
+	Args    []string
+	Env     map[string]string
+	Dir     string
+	//Config is forwarded with the setup request
+	Config map[string]interface{}
+	//Payload is sent with each exec request, it can contain templates
+	Payload []byte
+	//Timeout of each request to the plugin, also the grace period of the process after close
+	Timeout    time.Duration
+	Assertions *Assertions
+
+	payload         *payloadTemplate
+	payloadTemplate *template.Template
+
+	process *pluginProcess
+	results *ResultPipeline
+}
+
+func newPluginInvoker(config InvokerConfig) (Invoker, error) {
+	if !checkFields(config.Options, "command") {
+		return nil, fmt.Errorf("plugin needs a command")
+	}
+	timeout, err := time.ParseDuration(stringValue("timeout", config.Options, "30s"))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0)
+	for _, arg := range listValue("args", config.Options) {
+		args = append(args, fmt.Sprint(arg))
+	}
+	env, err := stringMap("env", config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	pluginConfig := make(map[string]interface{})
+	if val, ok := config.Options["config"]; ok && val != nil {
+		pluginConfig, ok = val.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("plugin config must be a map")
+		}
+	}
+
+	//the payload is either a map or a string, both can contain templates
+	var payload []byte
+	switch val := config.Options["payload"].(type) {
+	case nil:
+	case string:
+		payload = []byte(val)
+	default:
+		payload, err = json.Marshal(val)
+		if err != nil {
+			return nil, fmt.Errorf("could not read payload %+v form config", val)
+		}
+	}
+
+	assertions, err := newAssertionsFromConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PluginInvoker{
+		Command:    stringValue("command", config.Options, ""),
+		Args:       args,
+		Env:        env,
+		Dir:        stringValue("dir", config.Options, ""),
+		Config:     pluginConfig,
+		Payload:    payload,
+		Timeout:    timeout,
+		Assertions: assertions,
+	}
+
+	if isTemplate(string(payload)) {
+		p.payloadTemplate, err = parseTemplate("payload", string(payload))
+		if err != nil {
+			return nil, err
+		}
+		p.payload, err = newPayloadTemplate(config.Options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+//Setup starts the plugin for the phase, it is closed once the phase ends
+func (p *PluginInvoker) Setup(ctx context.Context, phase *Phase, bencher *Bencher) error {
+	process, err := startPlugin(p.Command, p.Args, p.Env, p.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to start plugin %s - %+v", p.Command, err)
+	}
+
+	response, err := process.roundtrip(ctx, &PluginRequest{
+		Op:       PluginSetup,
+		Protocol: PluginProtocolVersion,
+		Phase:    &PluginPhase{Name: phase.Name, Target: phase.Target, Threads: phase.Threads},
+		Config:   p.Config,
+	}, p.Timeout)
+	if err == nil && response.Error != "" {
+		err = fmt.Errorf("%s", response.Error)
+	}
+	if err != nil {
+		process.close(p.Timeout)
+		return fmt.Errorf("failed to setup plugin %s - %+v", p.Command, err)
+	}
+
+	if p.payloadTemplate != nil {
+		p.payload.setup(phase)
+	}
+	p.process = process
+	p.results = bencher.results
+
+	bencher.pending.Add(1)
+	go func() {
+		defer bencher.pending.Done()
+		<-ctx.Done()
+		process.close(p.Timeout)
+	}()
+	return nil
+}
+
+func (p *PluginInvoker) Exec(rate HatchRate) error {
+	return p.ExecAs(0, rate)
+}
+
+func (p *PluginInvoker) ExecAs(worker int, rate HatchRate) error {
+	err := rate.Take()
+	if err != nil {
+		return err
+	}
+
+	result, _, err := p.call(context.Background(), worker, nil, rate)
+	if err != nil {
+		rate.OnFailed()
+		return err
+	}
+
+	if isFailed(result) || result.Status >= 400 {
+		rate.OnFailed()
+	} else {
+		rate.OnSuccess()
+	}
+	p.results.Add(result)
+
+	return nil
+}
+
+//call sends a single exec request without waiting on a hatch rate, errors are only returned if the plugin is unusable.
+//A cancelled call stops waiting for the answer, the plugin is not interrupted.
+func (p *PluginInvoker) call(ctx context.Context, worker int, vars map[string]string, rate HatchRate) (*fact.Trace, *invocationResponse, error) {
+	payload := p.Payload
+	if p.payloadTemplate != nil {
+		tpl := p.payload.next(worker)
+		tpl.Vars = vars
+		rendered, err := renderTemplate(p.payloadTemplate, tpl)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to render payload - %+v", err)
+		}
+		payload = rendered
+	}
+
+	start := time.Now()
+	response, err := p.process.roundtrip(ctx, &PluginRequest{
+		Op:      PluginExec,
+		Worker:  worker,
+		Payload: string(payload),
+		Vars:    vars,
+	}, p.Timeout)
+	end := time.Now()
+	if err == errPluginTimeout || (err != nil && ctx.Err() != nil) {
+		//the process may still answer later requests
+		response = &PluginResponse{Error: err.Error()}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	result := response.Trace
+	if result == nil {
+		result = &fact.Trace{}
+	}
+	if result.ID == "" {
+		result.ID = uuid.New().String()
+	}
+	if result.Timestamp == nil {
+		result.Timestamp = timestamppb.New(start)
+	}
+	if result.RequestStartTime == nil || result.RequestEndTime == nil {
+		result.RequestStartTime = timestamppb.New(start)
+		result.RequestEndTime = timestamppb.New(end)
+	}
+	if result.RequestResponseLatency == nil {
+		result.RequestResponseLatency = durationpb.New(result.RequestEndTime.AsTime().Sub(result.RequestStartTime.AsTime()))
+	}
+	if response.Status != 0 {
+		result.Status = int32(response.Status)
+	}
+
+	header := make(http.Header)
+	for k, v := range response.Header {
+		header.Set(k, v)
+	}
+	body := []byte(response.Body)
+
+	if response.Error != "" {
+		markFailed(result, fmt.Errorf("%s", response.Error))
+	} else if p.Assertions != nil {
+		if err := p.Assertions.Check(int(result.Status), header, body); err != nil {
+			markFailed(result, err)
+		}
+	}
+
+	return result, &invocationResponse{
+		Status: int(result.Status),
+		Header: header,
+		Body:   body,
+	}, nil
+}
+
+var errPluginTimeout = fmt.Errorf("plugin did not answer in time")
+
+//pluginProcess matches the responses of a running plugin to the waiting requests
+type pluginProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	write   sync.Mutex
+	lock    sync.Mutex
+	seq     int64
+	pending map[int64]chan *PluginResponse
+	err     error //set once the plugin exited
+	exited  chan struct{}
+	logs    sync.WaitGroup //stderr must be drained before waiting on the process
+}
+
+func startPlugin(command string, args []string, env map[string]string, dir string) (*pluginProcess, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	process := &pluginProcess{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[int64]chan *PluginResponse),
+		exited:  make(chan struct{}),
+	}
+	process.logs.Add(1)
+	go func() {
+		defer process.logs.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Debugf("plugin %s: %s", command, scanner.Text())
+		}
+	}()
+	go process.read(stdout)
+	return process, nil
+}
+
+//read dispatches the responses until the plugin closes its stdout
+func (p *pluginProcess) read(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), pluginMaxLine)
+	for scanner.Scan() {
+		var response PluginResponse
+		if err := json.Unmarshal(scanner.Bytes(), &response); err != nil {
+			log.Debugf("plugin wrote no response - %+v", err)
+			continue
+		}
+		p.lock.Lock()
+		waiting, ok := p.pending[response.ID]
+		delete(p.pending, response.ID)
+		p.lock.Unlock()
+		if !ok {
+			log.Debugf("plugin answered unknown or timed out request %d", response.ID)
+			continue
+		}
+		waiting <- &response
+	}
+
+	p.logs.Wait()
+	err := p.cmd.Wait()
+	p.lock.Lock()
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err != nil {
+		p.err = fmt.Errorf("plugin exited - %+v", err)
+	} else {
+		p.err = fmt.Errorf("plugin exited")
+	}
+	for id, waiting := range p.pending {
+		close(waiting)
+		delete(p.pending, id)
+	}
+	p.lock.Unlock()
+	close(p.exited)
+}
+
+//roundtrip sends the request and waits for its response
+func (p *pluginProcess) roundtrip(ctx context.Context, request *PluginRequest, timeout time.Duration) (*PluginResponse, error) {
+	waiting := make(chan *PluginResponse, 1)
+	p.lock.Lock()
+	if p.err != nil {
+		p.lock.Unlock()
+		return nil, p.err
+	}
+	p.seq++
+	request.ID = p.seq
+	p.pending[request.ID] = waiting
+	p.lock.Unlock()
+
+	line, err := json.Marshal(request)
+	if err != nil {
+		p.forget(request.ID)
+		return nil, err
+	}
+	p.write.Lock()
+	_, err = p.stdin.Write(append(line, '\n'))
+	p.write.Unlock()
+	if err != nil {
+		p.forget(request.ID)
+		return nil, fmt.Errorf("failed to write to plugin - %+v", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response, ok := <-waiting:
+		if !ok {
+			return nil, p.exitErr()
+		}
+		return response, nil
+	case <-timer.C:
+		p.forget(request.ID)
+		return nil, errPluginTimeout
+	case <-ctx.Done():
+		p.forget(request.ID)
+		return nil, ctx.Err()
+	}
+}
+
+func (p *pluginProcess) forget(id int64) {
+	p.lock.Lock()
+	delete(p.pending, id)
+	p.lock.Unlock()
+}
+
+func (p *pluginProcess) exitErr() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+//close asks the plugin to exit and kills it if it does not within the grace period
+func (p *pluginProcess) close(grace time.Duration) {
+	if _, err := p.roundtrip(context.Background(), &PluginRequest{Op: PluginClose}, grace); err != nil {
+		log.Debugf("plugin did not confirm close - %+v", err)
+	}
+	_ = p.stdin.Close()
+	select {
+	case <-p.exited:
+	case <-time.After(grace):
+		log.Warnf("killing plugin %s", p.cmd.Path)
+		_ = p.cmd.Process.Kill()
+		<-p.exited
+	}
+}
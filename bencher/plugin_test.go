@@ -0,0 +1,181 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+//TestPluginProcess is the plugin started by the tests, it only runs inside the child process
+func TestPluginProcess(t *testing.T) {
+	if os.Getenv("BENCH_PLUGIN") != "1" {
+		return
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	encoder := json.NewEncoder(os.Stdout)
+	for scanner.Scan() {
+		var request PluginRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			fmt.Fprintf(os.Stderr, "bad request %s\n", scanner.Text())
+			continue
+		}
+		response := PluginResponse{ID: request.ID}
+		switch request.Op {
+		case PluginSetup:
+			if request.Protocol != PluginProtocolVersion || request.Config["fail"] == true {
+				response.Error = "setup refused"
+			}
+		case PluginExec:
+			switch request.Vars["mode"] {
+			case "slow":
+				time.Sleep(200 * time.Millisecond)
+			case "error":
+				response.Error = "platform error"
+			case "exit":
+				os.Exit(3)
+			}
+			response.Status = 200
+			response.Header = map[string]string{"X-Worker": fmt.Sprint(request.Worker)}
+			response.Body = request.Payload
+			response.Trace = &fact.Trace{ContainerID: os.Getenv("CONTAINER"), Tags: map[string]string{"Payload": request.Payload}}
+		case PluginClose:
+			_ = encoder.Encode(response)
+			os.Exit(0)
+		}
+		_ = encoder.Encode(response)
+	}
+	os.Exit(0)
+}
+
+func newTestPlugin(t *testing.T, extra string) (*PluginInvoker, *Bencher, context.CancelFunc, error) {
+	config := fmt.Sprintf(`
+type: plugin
+command: %s
+args: ["-test.run=TestPluginProcess"]
+env:
+  BENCH_PLUGIN: "1"
+  CONTAINER: plugin
+timeout: 100ms
+payload: "call-{{.Seq}}"
+%s`, os.Args[0], extra)
+	var cnf InvokerConfig
+	if err := yaml.Unmarshal([]byte(config), &cnf); err != nil {
+		t.Fatal(err)
+	}
+	invoker, err := NewInvokerFromConfig(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := NewResultPipeline(PipelineConfig{}, &slowWriter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(results.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bencher := &Bencher{results: results}
+	err = invoker.Setup(ctx, &Phase{Name: "test", Threads: 1, Target: "target"}, bencher)
+	return invoker.(*PluginInvoker), bencher, cancel, err
+}
+
+func TestPluginInvoker(t *testing.T) {
+	invoker, bencher, cancel, err := newTestPlugin(t, `
+assert:
+  status: [200]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	trace, response, err := invoker.call(context.Background(), 1, nil, nil)
+	assert.NoError(t, err)
+	assert.False(t, isFailed(trace))
+	assert.Equal(t, "plugin", trace.ContainerID)
+	assert.Equal(t, "call-0", trace.Tags["Payload"])
+	assert.Equal(t, int32(200), trace.Status)
+	assert.NotEmpty(t, trace.ID)
+	assert.NotNil(t, trace.RequestResponseLatency)
+	assert.Equal(t, "1", response.Header.Get("X-Worker"))
+	assert.Equal(t, "call-0", string(response.Body))
+
+	//failed invocations are reported by the plugin
+	trace, _, err = invoker.call(context.Background(), 0, map[string]string{"mode": "error"}, nil)
+	assert.NoError(t, err)
+	assert.True(t, isFailed(trace))
+
+	//a slow answer fails the invocation, but not the plugin
+	trace, _, err = invoker.call(context.Background(), 0, map[string]string{"mode": "slow"}, nil)
+	assert.NoError(t, err)
+	assert.True(t, isFailed(trace))
+	//the late answer is dropped once the plugin caught up
+	time.Sleep(150 * time.Millisecond)
+	rate := &outcomeRate{}
+	assert.NoError(t, invoker.ExecAs(0, rate))
+	assert.Equal(t, 1, rate.success)
+
+	//a plugin that exited can not be used anymore
+	_, _, err = invoker.call(context.Background(), 0, map[string]string{"mode": "exit"}, nil)
+	assert.Error(t, err)
+	assert.Error(t, invoker.ExecAs(0, rate))
+	assert.Equal(t, 1, rate.failed)
+	bencher.results.Close()
+
+	//the setup is answered with an error
+	_, _, _, err = newTestPlugin(t, `
+config:
+  fail: true
+`)
+	assert.Error(t, err)
+}
+
+func TestPluginClose(t *testing.T) {
+	invoker, bencher, cancel, err := newTestPlugin(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	//the bencher waits for the plugin to be closed
+	done := make(chan struct{})
+	go func() {
+		bencher.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("plugin was not closed after the phase")
+	}
+	select {
+	case <-invoker.process.exited:
+	default:
+		t.Fatal("plugin did not exit after the phase")
+	}
+	_, _, err = invoker.call(context.Background(), 0, nil, nil)
+	assert.Error(t, err)
+}
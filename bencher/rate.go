@@ -28,7 +28,7 @@ import (
 	"time"
 )
 
-var _hatchRateTypes = []string{"noop","slope","fixed","constant"}
+var _hatchRateTypes = []string{"noop","slope","fixed","constant","keepalive"}
 
 type HatchRateConstructor func (config HatchRateConfig) (HatchRate,error)
 
@@ -63,6 +63,8 @@ func NewRateFromConfig(config HatchRateConfig) (HatchRate,error) {
 		return newFixedRateFromConfig(config)
 	case "constant":
 		return newConstantRateFromConfig(config)
+	case "keepalive":
+		return newKeepAliveRateFromConfig(config)
 	}
 
 	if val,ok := _rates[_type]; ok {
@@ -127,6 +129,10 @@ type HatchRate interface {
 	OnFailed()
 	//call if the invocation was queued
 	OnQueued()
+	//call if the platform throttled the invocation, retryAfter is the wait it asked for or 0.
+	//Invokers signal it to the built-in and registered rates alike, so rates registered with
+	//RegisterHatchRate have to implement it as well, an empty method keeps the old behavior
+	OnThrottled(retryAfter time.Duration)
 
 	Close() error
 
@@ -173,6 +179,7 @@ func (f *ConstantRate) OnFailed()  {
 	f.counter<- struct{}{}
 }
 func (f *ConstantRate) OnQueued() {}
+func (f *ConstantRate) OnThrottled(time.Duration) {}
 func (f *ConstantRate) Close() error {
 	f.closed = fmt.Errorf("closed")
 	close(f.counter)
@@ -185,6 +192,8 @@ type FixedRPSRate struct{
 	BypassAtFailure bool
 	rate            *rate.Limiter
 	bypass          uint64
+	//unix nanos until Take holds after a throttle
+	held            int64
 	ctx             context.Context
 	cancel			context.CancelFunc
 }
@@ -195,6 +204,7 @@ func (f *FixedRPSRate) Setup(ctx context.Context, phase *Phase) (*sync.Cond, err
 	m.Lock()
 	signal := sync.NewCond(&m)
 	f.bypass = 0
+	atomic.StoreInt64(&f.held,0)
 	f.rate = rate.NewLimiter(rate.Every(time.Second/time.Duration(f.RPS)),1)
 	go func() {
 		time.Sleep(phase.Timeout)
@@ -208,6 +218,13 @@ func (f *FixedRPSRate) Setup(ctx context.Context, phase *Phase) (*sync.Cond, err
 	return signal, nil
 }
 func (f *FixedRPSRate) Take() error {
+	if wait := time.Until(time.Unix(0,atomic.LoadInt64(&f.held))); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-f.ctx.Done():
+			return f.ctx.Err()
+		}
+	}
 	if atomic.LoadUint64(&f.bypass) > 0 {
 		atomic.AddUint64(&f.bypass,^uint64(0))
 		return nil
@@ -223,6 +240,19 @@ func (f *FixedRPSRate) OnFailed() {
 	}
 }
 func (f *FixedRPSRate) OnQueued() {}
+//OnThrottled holds all requests for retryAfter or at least one interval
+func (f *FixedRPSRate) OnThrottled(retryAfter time.Duration) {
+	if interval := time.Second/time.Duration(f.RPS); retryAfter < interval {
+		retryAfter = interval
+	}
+	until := time.Now().Add(retryAfter).UnixNano()
+	for {
+		held := atomic.LoadInt64(&f.held)
+		if held >= until || atomic.CompareAndSwapInt64(&f.held,held,until) {
+			return
+		}
+	}
+}
 func (f *FixedRPSRate) Close() error {
 	f.cancel()
 	f.bypass = 0
@@ -289,12 +319,43 @@ func (r *SlopingRate) OnFailed() {
 	}
 }
 func (r *SlopingRate) OnQueued() {}
+func (r *SlopingRate) OnThrottled(time.Duration) {}
 func (r *SlopingRate) Close() error {
 	r.closed = !r.closed
 	r.cancel()
 	return nil
 }
 
+//unlimitedRate never blocks, used for calls that are already governed by an outer rate
+type unlimitedRate struct{}
+
+func (u *unlimitedRate) Setup(ctx context.Context, phase *Phase) (*sync.Cond, error) {
+	return nil, nil
+}
+func (u *unlimitedRate) Take() error               { return nil }
+func (u *unlimitedRate) OnSuccess()                {}
+func (u *unlimitedRate) OnFailed()                 {}
+func (u *unlimitedRate) OnQueued()                 {}
+func (u *unlimitedRate) OnThrottled(time.Duration) {}
+func (u *unlimitedRate) Close() error {
+	return nil
+}
+
+//throttleSignal never blocks but forwards throttles, used for calls governed by an outer rate that still slow down the phase
+type throttleSignal struct {
+	unlimitedRate
+	rate HatchRate
+}
+
+func (t *throttleSignal) OnThrottled(retryAfter time.Duration) { t.rate.OnThrottled(retryAfter) }
+
+func signalThrottles(rate HatchRate) HatchRate {
+	if rate == nil {
+		return &unlimitedRate{}
+	}
+	return &throttleSignal{rate: rate}
+}
+
 type NoopRate struct{
 	ctx context.Context
 	cancel context.CancelFunc
@@ -312,6 +373,7 @@ func (n *NoopRate) Take() error {
 func (n *NoopRate) OnSuccess() {}
 func (n *NoopRate) OnFailed() {}
 func (n *NoopRate) OnQueued() {}
+func (n *NoopRate) OnThrottled(time.Duration) {}
 func (n *NoopRate) Close() error {
 	n.cancel()
 	return nil
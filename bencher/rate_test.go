@@ -23,9 +23,12 @@ import (
 	"math"
 	"math/rand"
 	"runtime"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/faas-facts/fact/fact"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -149,6 +152,36 @@ func TestFixedRPSRate(t *testing.T) {
 
 }
 
+func TestFixedRPSRateThrottled(t *testing.T) {
+	rate := &FixedRPSRate{
+		RPS: 100,
+	}
+	_, err := rate.Setup(context.Background(), &Phase{Timeout: time.Second * 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rate.Close()
+	assert.NoError(t, rate.Take())
+
+	//a throttle holds the next request for the wait the platform asked for
+	rate.OnThrottled(300 * time.Millisecond)
+	//a shorter wait never cuts the hold short
+	rate.OnThrottled(0)
+	start := time.Now()
+	assert.NoError(t, rate.Take())
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(250*time.Millisecond))
+
+	//once the hold passed the rate is back to normal
+	start = time.Now()
+	assert.NoError(t, rate.Take())
+	assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+
+	//a closed rate does not hold
+	rate.OnThrottled(time.Hour)
+	_ = rate.Close()
+	assert.Error(t, rate.Take())
+}
+
 func TestSlopeingRate(t *testing.T) {
 	tests := []struct {
 		n int64
@@ -197,3 +230,46 @@ func testSlopingRate(t *testing.T, n int64, r float64, bypassAtFailure bool) {
 		recorder.Plot()
 	}
 }
+
+func TestKeepAliveRate(t *testing.T) {
+	rate := &KeepAliveRate{
+		Gaps:         []time.Duration{time.Millisecond * 10, time.Millisecond * 200},
+		Repetitions:  3,
+		ProbeTimeout: time.Second,
+	}
+	timeout := time.Second * 5
+	signal, err := rate.Setup(context.Background(), &Phase{Timeout: timeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a platform that keeps containers for 100ms
+	var container string
+	var lastSeen time.Time
+	var platform sync.Mutex
+	for i := 0; i < 4; i++ {
+		go func() {
+			for {
+				if rate.Take() != nil {
+					return
+				}
+				platform.Lock()
+				if time.Since(lastSeen) > time.Millisecond*100 {
+					container = uuid.New().String()
+				}
+				lastSeen = time.Now()
+				trace := &fact.Trace{ContainerID: container}
+				platform.Unlock()
+				rate.Observe(trace)
+			}
+		}()
+	}
+	waitOn(signal, &timeout)
+	_ = rate.Close()
+
+	summary := rate.Summary()
+	assert.Len(t, summary, 2)
+	assert.Equal(t, 3, summary[0].Reused)
+	assert.Equal(t, 0, summary[1].Reused)
+	assert.Equal(t, 1.0, summary[0].ReuseProbability())
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+)
+
+//Tags set on traces of retried or throttled invocations
+const (
+	RetriesTag      = "Retries"      //retries of the invocation
+	ThrottledTag    = "Throttled"    //responses of the invocation the platform throttled
+	ThrottleWaitTag = "ThrottleWait" //time waited before the retries, in ns
+)
+
+//retryBudgetFloor are the retries allowed before the budget has seen enough invocations
+const retryBudgetFloor = 10
+
+//RetryPolicy decides if and when failed or throttled invocations are retried, configured under retry: of the invoker.
+//Waits grow exponentially from Backoff up to MaxBackoff, a Retry-After of the platform is honoured if it is longer.
+type RetryPolicy struct {
+	MaxRetries int           //retries of one invocation
+	Backoff    time.Duration //wait before the first retry
+	MaxBackoff time.Duration //upper bound of the exponential backoff
+	Jitter     float64       //share of each wait that is randomized, 0 to 1
+	Budget     float64       //retries allowed per invocation of the phase, 0 for no budget
+	Throttled  []int         //status codes of throttled requests
+
+	invocations int64
+	retries     int64
+}
+
+func newRetryPolicyFromConfig(options map[string]interface{}, retries int) (*RetryPolicy, error) {
+	policy := &RetryPolicy{
+		MaxRetries: retries,
+		Backoff:    100 * time.Millisecond,
+		MaxBackoff: 10 * time.Second,
+		Jitter:     0.2,
+		Throttled:  []int{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+	}
+	val, ok := options["retry"]
+	if !ok || val == nil {
+		return policy, nil
+	}
+	config, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("retry must be a map")
+	}
+
+	if val, ok := config["maxRetries"]; ok {
+		policy.MaxRetries, ok = val.(int)
+		if !ok || policy.MaxRetries < 0 {
+			return nil, fmt.Errorf("retry maxRetries must be a positive number")
+		}
+	}
+	var err error
+	policy.Backoff, err = time.ParseDuration(stringValue("backoff", config, policy.Backoff.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry backoff - %+v", err)
+	}
+	policy.MaxBackoff, err = time.ParseDuration(stringValue("maxBackoff", config, policy.MaxBackoff.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry maxBackoff - %+v", err)
+	}
+	for key, target := range map[string]*float64{"jitter": &policy.Jitter, "budget": &policy.Budget} {
+		if val, ok := config[key]; ok {
+			value, err := strconv.ParseFloat(fmt.Sprint(val), 64)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("retry %s must be a positive number", key)
+			}
+			*target = value
+		}
+	}
+	if policy.Jitter > 1 {
+		return nil, fmt.Errorf("retry jitter must be between 0 and 1")
+	}
+	if statuses := listValue("throttled", config); len(statuses) > 0 {
+		policy.Throttled = make([]int, 0, len(statuses))
+		for _, val := range statuses {
+			status, ok := val.(int)
+			if !ok {
+				return nil, fmt.Errorf("retry throttled must be a list of status codes")
+			}
+			policy.Throttled = append(policy.Throttled, status)
+		}
+	}
+	return policy, nil
+}
+
+//reset starts a new retry budget, e.g. for the next phase
+func (p *RetryPolicy) reset() {
+	atomic.StoreInt64(&p.invocations, 0)
+	atomic.StoreInt64(&p.retries, 0)
+}
+
+//isThrottled reports if the status code signals that the platform throttled the request
+func (p *RetryPolicy) isThrottled(status int) bool {
+	for _, s := range p.Throttled {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+//next decides if the attempt is retried and how long to wait before, attempts count from 0
+func (p *RetryPolicy) next(attempt int, header http.Header) (time.Duration, bool) {
+	if attempt >= p.MaxRetries {
+		return 0, false
+	}
+	if p.Budget > 0 {
+		allowed := int64(p.Budget*float64(atomic.LoadInt64(&p.invocations))) + retryBudgetFloor
+		if atomic.LoadInt64(&p.retries) >= allowed {
+			log.Debugf("retry budget of %d exhausted", allowed)
+			return 0, false
+		}
+	}
+	atomic.AddInt64(&p.retries, 1)
+
+	wait := p.Backoff
+	for i := 0; i < attempt && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		wait -= time.Duration(p.Jitter * rand.Float64() * float64(wait))
+	}
+	if after := retryAfter(header, time.Now()); after > wait {
+		wait = after
+	}
+	return wait, true
+}
+
+//retryAfter reads the Retry-After header, either in seconds or as http date
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	if header == nil {
+		return 0
+	}
+	val := header.Get("Retry-After")
+	if val == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(val); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(val); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+//retryState counts the retries of one invocation
+type retryState struct {
+	policy    *RetryPolicy
+	ctx       context.Context
+	retries   int
+	throttled int
+	waited    time.Duration
+}
+
+func (p *RetryPolicy) start(ctx context.Context) *retryState {
+	atomic.AddInt64(&p.invocations, 1)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &retryState{policy: p, ctx: ctx}
+}
+
+//retry signals throttled responses to the rate and waits for the next attempt, false if the invocation is given up
+func (s *retryState) retry(rate HatchRate, status int, header http.Header) bool {
+	if s.policy.isThrottled(status) {
+		s.throttled++
+		rate.OnThrottled(retryAfter(header, time.Now()))
+	}
+	wait, ok := s.policy.next(s.retries, header)
+	if !ok {
+		return false
+	}
+	log.Debugf("retrying after %d in %s", status, wait)
+	select {
+	case <-time.After(wait):
+	case <-s.ctx.Done():
+		return false
+	}
+	s.retries++
+	s.waited += wait
+	return true
+}
+
+//tag records the retries on the trace of the invocation
+func (s *retryState) tag(trace *fact.Trace) {
+	if s.retries == 0 && s.throttled == 0 {
+		return
+	}
+	if trace.Tags == nil {
+		trace.Tags = make(map[string]string)
+	}
+	trace.Tags[RetriesTag] = strconv.Itoa(s.retries)
+	trace.Tags[ThrottledTag] = strconv.Itoa(s.throttled)
+	trace.Tags[ThrottleWaitTag] = strconv.FormatInt(s.waited.Nanoseconds(), 10)
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, 3*time.Second, retryAfter(http.Header{"Retry-After": []string{"3"}}, now))
+	date := now.Add(time.Minute).UTC().Format(http.TimeFormat)
+	assert.InDelta(t, float64(time.Minute), float64(retryAfter(http.Header{"Retry-After": []string{date}}, now)), float64(time.Second))
+	assert.Equal(t, time.Duration(0), retryAfter(http.Header{"Retry-After": []string{"soon"}}, now))
+
+	policy, err := newRetryPolicyFromConfig(map[string]interface{}{"retry": map[string]interface{}{
+		"maxRetries": 20,
+		"backoff":    "10ms",
+		"maxBackoff": "40ms",
+		"jitter":     0,
+		"budget":     0.5,
+		"throttled":  []interface{}{429},
+	}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, policy.isThrottled(429))
+	assert.False(t, policy.isThrottled(503))
+
+	//exponential up to the max backoff, unless the platform asks for more
+	for attempt, expected := range []time.Duration{10, 20, 40, 40} {
+		wait, ok := policy.next(attempt, nil)
+		assert.True(t, ok)
+		assert.Equal(t, expected*time.Millisecond, wait)
+	}
+	wait, _ := policy.next(0, http.Header{"Retry-After": []string{"1"}})
+	assert.Equal(t, time.Second, wait)
+	_, ok := policy.next(20, nil)
+	assert.False(t, ok)
+
+	//without invocations only the floor of the budget is left
+	policy.reset()
+	for i := 0; i < retryBudgetFloor; i++ {
+		_, ok = policy.next(0, nil)
+		assert.True(t, ok)
+	}
+	_, ok = policy.next(0, nil)
+	assert.False(t, ok)
+
+	_, err = newRetryPolicyFromConfig(map[string]interface{}{"retry": map[string]interface{}{"jitter": 2}}, 0)
+	assert.Error(t, err)
+}
+
+func TestHTTPInvokerThrottled(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	config := `
+type: http
+timeout: 1s
+retry:
+  maxRetries: 3
+  backoff: 1ms
+`
+	invoker := setupInvoker(t, config, server.URL).(*HTTPInvoker)
+	rate := &outcomeRate{}
+	trace, _, err := invoker.call(context.Background(), 0, nil, rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int32(200), trace.Status)
+	assert.Equal(t, "2", trace.Tags[RetriesTag])
+	assert.Equal(t, "2", trace.Tags[ThrottledTag])
+	assert.Equal(t, 2, rate.throttled)
+
+	//throttles reach the rate of the phase through middleware
+	atomic.StoreInt32(&requests, 0)
+	wrapped := setupInvoker(t, config+"middleware:\n  - type: tag\n", server.URL)
+	rate = &outcomeRate{}
+	assert.NoError(t, wrapped.Exec(rate))
+	assert.Equal(t, 2, rate.throttled)
+	assert.Equal(t, 1, rate.success)
+
+	//by default throttles are only counted
+	atomic.StoreInt32(&requests, 0)
+	invoker = setupInvoker(t, "type: http\ntimeout: 1s\n", server.URL).(*HTTPInvoker)
+	trace = invokeOnce(t, invoker, 0)
+	assert.Equal(t, int32(http.StatusTooManyRequests), trace.Status)
+	assert.Equal(t, "0", trace.Tags[RetriesTag])
+	assert.Equal(t, "1", trace.Tags[ThrottledTag])
+}
@@ -0,0 +1,367 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+	"github.com/google/uuid"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//Tags set on scenario traces
+const (
+	ScenarioTag = "Scenario" //name of the scenario, set on the aggregate trace
+	StepTag     = "Step"     //name of the step, set on each step trace
+	AttemptTag  = "Attempt"  //attempt of a repeated step
+)
+
+//options of a step that are not passed to the invoker of the step
+var scenarioStepKeys = []string{"name", "target", "extract", "until", "interval", "attempts"}
+
+//stepInvoker performs a single call of a scenario step, vars are available as {{.Vars.name}} in templates.
+//The context cancels the request of the call, e.g. on timeouts of middleware, the rate only receives throttles.
+type stepInvoker interface {
+	Invoker
+	call(ctx context.Context, worker int, vars map[string]string, rate HatchRate) (*fact.Trace, *invocationResponse, error)
+}
+
+//ScenarioStep is a single call of a scenario.
+type ScenarioStep struct {
+	Name     string
+	Target   string            //overrides the target of the phase, paths starting with / are relative to it
+	Invoker  stepInvoker       //http or ow invoker of the step
+	Extract  map[string]string //variable name to json:path, header:Name or regex:expr
+	Until    *Assertions       //if set the step is repeated until the response passes
+	Interval time.Duration     //wait between repeated attempts
+	Attempts int               //max attempts of a repeated step
+
+	patterns map[string]*regexp.Regexp //compiled regex extractions by variable name
+}
+
+//ScenarioInvoker sends an ordered list of dependent steps, e.g. create, poll and fetch.
+//Each step is recorded as a trace, the whole scenario as an aggregate trace that is the parent of all steps.
+type ScenarioInvoker struct {
+	Name  string
+	Steps []ScenarioStep
+
+	results *ResultPipeline
+}
+
+func newScenarioInvoker(config InvokerConfig) (Invoker, error) {
+	rawSteps, ok := config.Options["steps"].([]interface{})
+	if !ok || len(rawSteps) == 0 {
+		return nil, fmt.Errorf("scenario needs a list of steps")
+	}
+
+	//all other scenario options are defaults of the steps, e.g. timeout, middleware wraps the whole scenario
+	defaults := make(map[string]interface{})
+	for k, v := range config.Options {
+		if k != "steps" && k != "name" && k != "middleware" {
+			defaults[k] = v
+		}
+	}
+
+	s := &ScenarioInvoker{
+		Name:  stringValue("name", config.Options, "scenario"),
+		Steps: make([]ScenarioStep, 0, len(rawSteps)),
+	}
+
+	for i, raw := range rawSteps {
+		options, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("step %d must be a map", i)
+		}
+		step, err := newScenarioStep(i, options, defaults)
+		if err != nil {
+			return nil, err
+		}
+		s.Steps = append(s.Steps, step)
+	}
+
+	return s, nil
+}
+
+func newScenarioStep(i int, options map[string]interface{}, defaults map[string]interface{}) (ScenarioStep, error) {
+	step := ScenarioStep{
+		Name:     stringValue("name", options, "step"+strconv.Itoa(i)),
+		Target:   stringValue("target", options, ""),
+		Attempts: 1,
+	}
+	if _, ok := options["middleware"]; ok {
+		return step, fmt.Errorf("step %s - middleware wraps the whole scenario, configure it next to the steps", step.Name)
+	}
+
+	invokerOptions := make(map[string]interface{})
+	for k, v := range defaults {
+		invokerOptions[k] = v
+	}
+	for k, v := range options {
+		invokerOptions[k] = v
+	}
+	for _, k := range scenarioStepKeys {
+		delete(invokerOptions, k)
+	}
+
+	_type := stringValue("type", invokerOptions, "http")
+	delete(invokerOptions, "type")
+	invoker, err := NewInvokerFromConfig(InvokerConfig{Type: _type, Options: invokerOptions})
+	if err != nil {
+		return step, fmt.Errorf("step %s - %+v", step.Name, err)
+	}
+	callable, ok := invoker.(stepInvoker)
+	if !ok {
+		return step, fmt.Errorf("step %s - %s can not be used in a scenario", step.Name, _type)
+	}
+	step.Invoker = callable
+
+	step.Extract, err = stringMap("extract", options)
+	if err != nil {
+		return step, err
+	}
+	step.patterns = make(map[string]*regexp.Regexp)
+	for name, source := range step.Extract {
+		if strings.HasPrefix(source, "regex:") {
+			step.patterns[name], err = regexp.Compile(strings.TrimPrefix(source, "regex:"))
+			if err != nil {
+				return step, fmt.Errorf("step %s - invalid extraction %s for %s - %+v", step.Name, source, name, err)
+			}
+		} else if !strings.HasPrefix(source, "json:") && !strings.HasPrefix(source, "header:") {
+			return step, fmt.Errorf("step %s - unknown extraction %s for %s", step.Name, source, name)
+		}
+	}
+
+	if val, ok := options["until"]; ok {
+		step.Until, err = newAssertionsFromConfig(map[string]interface{}{"assert": val})
+		if err != nil {
+			return step, err
+		}
+		step.Attempts = 10
+		step.Interval = time.Second
+	}
+	if val, ok := options["attempts"]; ok {
+		step.Attempts, ok = val.(int)
+		if !ok || step.Attempts < 1 {
+			return step, fmt.Errorf("step %s - attempts must be a positive number", step.Name)
+		}
+	}
+	if val, ok := options["interval"]; ok {
+		step.Interval, err = time.ParseDuration(fmt.Sprint(val))
+		if err != nil {
+			return step, err
+		}
+	}
+
+	return step, nil
+}
+
+func (s *ScenarioInvoker) Setup(ctx context.Context, phase *Phase, bencher *Bencher) error {
+	for _, step := range s.Steps {
+		stepPhase := *phase
+		if strings.HasPrefix(step.Target, "/") {
+			stepPhase.Target = strings.TrimRight(phase.Target, "/") + step.Target
+		} else if step.Target != "" {
+			stepPhase.Target = step.Target
+		}
+		err := step.Invoker.Setup(ctx, &stepPhase, bencher)
+		if err != nil {
+			return fmt.Errorf("failed to setup step %s - %+v", step.Name, err)
+		}
+	}
+	s.results = bencher.results
+	return nil
+}
+
+func (s *ScenarioInvoker) Exec(rate HatchRate) error {
+	return s.ExecAs(0, rate)
+}
+
+func (s *ScenarioInvoker) ExecAs(worker int, rate HatchRate) error {
+	err := rate.Take()
+	if err != nil {
+		return err
+	}
+
+	aggregate := s.run(context.Background(), worker, rate)
+	if isFailed(aggregate) {
+		rate.OnFailed()
+	} else {
+		rate.OnSuccess()
+	}
+	s.results.Add(aggregate)
+
+	return nil
+}
+
+//Call runs the scenario once, the traces of the steps are written directly and the aggregate trace is returned
+func (s *ScenarioInvoker) Call(ctx context.Context, worker int, rate HatchRate) (*CallResult, error) {
+	aggregate := s.run(ctx, worker, rate)
+	return &CallResult{Trace: aggregate, Status: int(aggregate.Status)}, nil
+}
+
+//run sends all steps and returns the aggregate trace
+func (s *ScenarioInvoker) run(ctx context.Context, worker int, rate HatchRate) *fact.Trace {
+	id := uuid.New().String()
+	vars := make(map[string]string)
+	start := time.Now()
+	var status int32
+	var failure error
+
+	for _, step := range s.Steps {
+		var trace *fact.Trace
+		trace, failure = s.runStep(ctx, id, step, worker, vars, rate)
+		if trace != nil {
+			status = trace.Status
+		}
+		if failure != nil {
+			failure = fmt.Errorf("step %s - %+v", step.Name, failure)
+			break
+		}
+	}
+	end := time.Now()
+
+	aggregate := &fact.Trace{
+		ID:                     id,
+		Timestamp:              timestamppb.New(start),
+		RequestStartTime:       timestamppb.New(start),
+		RequestEndTime:         timestamppb.New(end),
+		RequestResponseLatency: durationpb.New(end.Sub(start)),
+		Status:                 status,
+		Tags:                   map[string]string{ScenarioTag: s.Name},
+	}
+	if failure != nil {
+		markFailed(aggregate, failure)
+	}
+	return aggregate
+}
+
+//runStep calls the step until it passes, extracts its variables and records all attempts
+func (s *ScenarioInvoker) runStep(ctx context.Context, parent string, step ScenarioStep, worker int, vars map[string]string, rate HatchRate) (*fact.Trace, error) {
+	var trace *fact.Trace
+	var response *invocationResponse
+	var err error
+	for attempt := 1; attempt <= step.Attempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(step.Interval):
+			case <-ctx.Done():
+				return trace, ctx.Err()
+			}
+		}
+
+		trace, response, err = step.Invoker.call(ctx, worker, vars, rate)
+		if err != nil {
+			return nil, err
+		}
+		trace.ChildOf = parent
+		if trace.Tags == nil {
+			trace.Tags = make(map[string]string)
+		}
+		trace.Tags[StepTag] = step.Name
+		if step.Attempts > 1 {
+			trace.Tags[AttemptTag] = strconv.Itoa(attempt)
+		}
+		s.results.Add(trace)
+
+		if step.Until == nil {
+			if err := stepFailure(trace); err != nil {
+				return trace, err
+			}
+			break
+		}
+		//failed polls are retried until the attempts are exhausted
+		err = stepFailure(trace)
+		if err == nil {
+			err = step.Until.Check(response.Status, response.Header, response.Body)
+		}
+		if err == nil {
+			break
+		}
+		if attempt == step.Attempts {
+			return trace, fmt.Errorf("not done after %d attempts - %+v", attempt, err)
+		}
+	}
+
+	for name, source := range step.Extract {
+		value, err := extractValue(source, step.patterns[name], response)
+		if err != nil {
+			return trace, fmt.Errorf("failed to extract %s - %+v", name, err)
+		}
+		vars[name] = value
+	}
+	return trace, nil
+}
+
+//stepFailure reports failed assertions, transport errors and error status codes of a step
+func stepFailure(t *fact.Trace) error {
+	if isFailed(t) {
+		return fmt.Errorf("%s", t.Tags[ErrorTag])
+	}
+	if t.Status == 0 || t.Status >= 400 {
+		return fmt.Errorf("status %d", t.Status)
+	}
+	return nil
+}
+
+//extractValue reads a value from the response, source is json:path, header:Name or regex:expr with the compiled pattern
+func extractValue(source string, pattern *regexp.Regexp, response *invocationResponse) (string, error) {
+	parts := strings.SplitN(source, ":", 2)
+	switch parts[0] {
+	case "json":
+		var doc interface{}
+		if err := json.Unmarshal(response.Body, &doc); err != nil {
+			return "", err
+		}
+		value, ok := jsonPath(doc, parts[1])
+		if !ok {
+			return "", fmt.Errorf("json path %s not found", parts[1])
+		}
+		if str, ok := value.(string); ok {
+			return str, nil
+		}
+		data, err := json.Marshal(value)
+		return string(data), err
+	case "header":
+		value := response.Header.Get(parts[1])
+		if value == "" {
+			return "", fmt.Errorf("header %s not found", parts[1])
+		}
+		return value, nil
+	case "regex":
+		if pattern == nil {
+			return "", fmt.Errorf("regex %s was not compiled", parts[1])
+		}
+		match := pattern.FindSubmatch(response.Body)
+		if match == nil {
+			return "", fmt.Errorf("%s did not match", parts[1])
+		}
+		if len(match) > 1 {
+			return string(match[1]), nil
+		}
+		return string(match[0]), nil
+	}
+	return "", fmt.Errorf("unknown extraction %s", source)
+}
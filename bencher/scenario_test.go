@@ -0,0 +1,197 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestScenarioInvoker(t *testing.T) {
+	polls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Job-Token", "secret")
+		w.WriteHeader(201)
+		_, _ = w.Write([]byte(`{"job":{"id":"j42"}}`))
+	})
+	mux.HandleFunc("/jobs/j42", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(403)
+			return
+		}
+		polls++
+		if polls < 3 {
+			_, _ = w.Write([]byte(`{"state":"running"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"state":"done","result":"r-7"}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	var cnf InvokerConfig
+	err := yaml.Unmarshal([]byte(`
+type: scenario
+name: job
+timeout: 1s
+steps:
+  - name: create
+    method: post
+    target: /jobs
+    extract:
+      id: json:job.id
+      token: header:X-Job-Token
+  - name: poll
+    target: "/jobs/{{.Vars.id}}"
+    headers:
+      X-Token: "{{.Vars.token}}"
+    until:
+      json:
+        state: done
+    interval: 1ms
+    attempts: 5
+    extract:
+      result: regex:"result":"([^"]+)"
+`), &cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invoker, err := NewInvokerFromConfig(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &collectingWriter{}
+	results, err := NewResultPipeline(PipelineConfig{}, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = invoker.Setup(context.Background(), &Phase{Threads: 1, Target: server.URL}, &Bencher{results: results})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rate := &outcomeRate{}
+	assert.NoError(t, invoker.Exec(rate))
+	results.Close()
+
+	assert.Equal(t, 1, rate.success)
+	assert.Equal(t, 0, rate.failed)
+	//create, three polls and the aggregate
+	assert.Len(t, writer.traces, 5)
+	aggregate := writer.traces[4]
+	assert.Equal(t, "job", aggregate.Tags[ScenarioTag])
+	assert.False(t, isFailed(aggregate))
+	for _, trace := range writer.traces[:4] {
+		assert.Equal(t, aggregate.ID, trace.ChildOf)
+	}
+	assert.Equal(t, "create", writer.traces[0].Tags[StepTag])
+	assert.Equal(t, "3", writer.traces[3].Tags[AttemptTag])
+
+	//a missing extraction stops the scenario
+	polls = 0
+	step := invoker.(*ScenarioInvoker).Steps[0]
+	step.Extract = map[string]string{"id": "json:job.missing"}
+	invoker.(*ScenarioInvoker).Steps = []ScenarioStep{step}
+	results, _ = NewResultPipeline(PipelineConfig{}, writer)
+	invoker.(*ScenarioInvoker).results = results
+	assert.NoError(t, invoker.Exec(rate))
+	results.Close()
+	assert.Equal(t, 1, rate.failed)
+	assert.True(t, isFailed(writer.traces[len(writer.traces)-1]))
+
+	//the wait between attempts ends with the phase
+	step.Extract = nil
+	step.Until = &Assertions{JSON: map[string]interface{}{"state": "done"}}
+	step.Interval = time.Hour
+	step.Attempts = 2
+	invoker.(*ScenarioInvoker).Steps = []ScenarioStep{step}
+	results, _ = NewResultPipeline(PipelineConfig{}, writer)
+	invoker.(*ScenarioInvoker).results = results
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	result, err := invoker.(*ScenarioInvoker).Call(ctx, 0, nil)
+	results.Close()
+	assert.NoError(t, err)
+	assert.True(t, isFailed(result.Trace))
+
+	//invalid expressions fail when the scenario is loaded
+	cnf.Options["steps"] = []interface{}{map[string]interface{}{"name": "create", "extract": map[string]interface{}{"id": "regex:("}}}
+	_, err = NewInvokerFromConfig(cnf)
+	assert.Error(t, err)
+}
+
+func TestScenarioMiddleware(t *testing.T) {
+	server, _ := newRecordingServer(t, 200, "{}")
+
+	var cnf InvokerConfig
+	err := yaml.Unmarshal([]byte(`
+type: scenario
+name: wrapped
+timeout: 1s
+middleware:
+  - type: tag
+    tags:
+      experiment: baseline
+steps:
+  - name: first
+  - name: second
+`), &cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invoker, err := NewInvokerFromConfig(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &collectingWriter{}
+	results, err := NewResultPipeline(PipelineConfig{}, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = invoker.Setup(context.Background(), &Phase{Threads: 1, Target: server.URL}, &Bencher{results: results})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate := &outcomeRate{}
+	assert.NoError(t, invoker.(WorkerInvoker).ExecAs(0, rate))
+	results.Close()
+
+	//the middleware wraps the scenario, not its steps
+	assert.Equal(t, 1, rate.success)
+	if assert.Len(t, writer.traces, 3) {
+		assert.Empty(t, writer.traces[0].Tags["experiment"])
+		assert.Equal(t, "wrapped", writer.traces[2].Tags[ScenarioTag])
+		assert.Equal(t, "baseline", writer.traces[2].Tags["experiment"])
+	}
+
+	cnf.Options["steps"] = []interface{}{map[string]interface{}{
+		"name":       "tagged",
+		"middleware": []interface{}{map[string]interface{}{"type": "tag"}},
+	}}
+	_, err = NewInvokerFromConfig(cnf)
+	assert.Error(t, err)
+}
@@ -0,0 +1,514 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/faas-facts/fact/fact"
+	"github.com/google/uuid"
+	"golang.org/x/net/websocket"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//Stream protocols
+const (
+	StreamWebSocket = "websocket" //one connection per worker, each request is a message
+	StreamSSE       = "sse"       //each request opens a server-sent event stream
+	StreamChunked   = "chunked"   //each request reads a chunked response, each chunk is a message
+)
+
+//Tags set on traces of the stream invoker, durations are in ns
+const (
+	StreamConnectTag      = "StreamConnect"      //time to open the websocket, only set on the first request of a connection
+	StreamFirstMessageTag = "StreamFirstMessage" //time from sending the request to the first message
+	StreamMeanGapTag      = "StreamMeanGap"      //mean time between two messages
+	StreamMaxGapTag       = "StreamMaxGap"       //max time between two messages
+	StreamMessagesTag     = "StreamMessages"     //number of messages received
+)
+
+//StreamInvoker benchmarks streamed responses, RequestResponseLatency is the time until the stream completed.
+type StreamInvoker struct {
+	Protocol string
+	//Message is send as websocket message or request body
+	Message []byte
+	//Method of sse and chunked requests, defaults to GET without and POST with a message
+	Method string
+	Header http.Header
+	//Origin of websocket handshakes, derived from the target by default
+	Origin string
+	//Messages completes a stream after this many messages, 0 waits for the end of the stream or the first websocket reply
+	Messages int
+	//Until completes a stream at the first message containing it, e.g. [DONE]
+	Until string
+	//Timeout of a single request including all its messages
+	Timeout time.Duration
+	TLS     *TLSConfig
+	//Retry decides if throttled sse and chunked requests are retried, by default they are only counted.
+	//The websocket client does not expose the status of a refused handshake, throttled websockets fail to connect.
+	Retry *RetryPolicy
+
+	payload         *payloadTemplate
+	messageTemplate *template.Template
+
+	target  string
+	client  *http.Client
+	conns   map[int]*websocket.Conn
+	ctx     context.Context
+	results *ResultPipeline
+	sync.Mutex
+}
+
+//streamStats collects the arrival of messages of a single request
+type streamStats struct {
+	start    time.Time
+	last     time.Time
+	first    time.Duration
+	gaps     time.Duration
+	maxGap   time.Duration
+	messages int
+}
+
+func (s *streamStats) add() {
+	now := time.Now()
+	if s.messages == 0 {
+		s.first = now.Sub(s.start)
+	} else {
+		gap := now.Sub(s.last)
+		s.gaps += gap
+		if gap > s.maxGap {
+			s.maxGap = gap
+		}
+	}
+	s.last = now
+	s.messages++
+}
+
+func newStreamInvoker(config InvokerConfig) (Invoker, error) {
+	if !checkFields(config.Options, "timeout") {
+		return nil, fmt.Errorf("missing key in config")
+	}
+	timeout, err := time.ParseDuration(stringValue("timeout", config.Options, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := strings.ToLower(stringValue("protocol", config.Options, StreamWebSocket))
+	switch protocol {
+	case StreamWebSocket, StreamSSE, StreamChunked:
+	default:
+		return nil, fmt.Errorf("unknown stream protocol %s", protocol)
+	}
+
+	headers, err := stringMap("headers", config.Options)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	for k, v := range headers {
+		header.Set(k, v)
+	}
+
+	messages := 0
+	if val, ok := config.Options["messages"]; ok {
+		messages, ok = val.(int)
+		if !ok || messages < 0 {
+			return nil, fmt.Errorf("messages must be a positive number")
+		}
+	}
+
+	tlsConfig, err := newTLSConfigFromConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+	retry, err := newRetryPolicyFromConfig(config.Options, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	message := []byte(stringValue("message", config.Options, ""))
+	method := http.MethodGet
+	if len(message) > 0 {
+		method = http.MethodPost
+	}
+
+	s := &StreamInvoker{
+		Protocol: protocol,
+		Message:  message,
+		Method:   strings.ToUpper(stringValue("method", config.Options, method)),
+		Header:   header,
+		Origin:   stringValue("origin", config.Options, ""),
+		Messages: messages,
+		Until:    stringValue("until", config.Options, ""),
+		Timeout:  timeout,
+		TLS:      tlsConfig,
+		Retry:    retry,
+	}
+
+	if isTemplate(string(message)) {
+		s.messageTemplate, err = parseTemplate("message", string(message))
+		if err != nil {
+			return nil, err
+		}
+		s.payload, err = newPayloadTemplate(config.Options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *StreamInvoker) Setup(ctx context.Context, phase *Phase, bencher *Bencher) error {
+	tlsConfig, err := s.TLS.Build(phase.Threads)
+	if err != nil {
+		return err
+	}
+	s.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: min(phase.Threads, maxIdleConn),
+		},
+		Timeout: s.Timeout,
+	}
+	if s.messageTemplate != nil {
+		s.payload.setup(phase)
+	}
+	if s.Retry == nil {
+		s.Retry, _ = newRetryPolicyFromConfig(nil, 0)
+	}
+	s.Retry.reset()
+
+	s.Lock()
+	s.target = phase.Target
+	s.conns = make(map[int]*websocket.Conn)
+	s.ctx = ctx
+	s.results = bencher.results
+	s.Unlock()
+
+	//websockets stay open for the whole phase
+	go func(conns map[int]*websocket.Conn) {
+		<-ctx.Done()
+		s.Lock()
+		defer s.Unlock()
+		for worker, conn := range conns {
+			_ = conn.Close()
+			delete(conns, worker)
+		}
+	}(s.conns)
+	return nil
+}
+
+func (s *StreamInvoker) Exec(rate HatchRate) error {
+	return s.ExecAs(0, rate)
+}
+
+func (s *StreamInvoker) ExecAs(worker int, rate HatchRate) error {
+	err := rate.Take()
+	if err != nil {
+		return err
+	}
+
+	result, _, err := s.call(s.ctx, worker, nil, rate)
+	if err != nil {
+		rate.OnFailed()
+		return err
+	}
+
+	if isFailed(result) || result.Status >= 400 {
+		rate.OnFailed()
+	} else {
+		rate.OnSuccess()
+	}
+	s.results.Add(result)
+
+	return nil
+}
+
+//call renders the message and makes a single request, throttled sse and chunked requests are retried as the retry policy allows
+func (s *StreamInvoker) call(ctx context.Context, worker int, vars map[string]string, rate HatchRate) (*fact.Trace, *invocationResponse, error) {
+	message := s.Message
+	if s.messageTemplate != nil {
+		tpl := s.payload.next(worker)
+		tpl.Vars = vars
+		rendered, err := renderTemplate(s.messageTemplate, tpl)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to render message - %+v", err)
+		}
+		message = rendered
+	}
+
+	id := uuid.New().String()
+	if s.Protocol == StreamWebSocket {
+		result := s.sendMessage(worker, id, message)
+		return result, &invocationResponse{Status: int(result.Status)}, nil
+	}
+
+	//streams end with the phase, also if the call itself is not bound to it
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	throttles := signalThrottles(rate)
+	retry := s.Retry.start(s.ctx)
+	for {
+		result, header := s.openStream(ctx, id, message)
+		if !s.Retry.isThrottled(int(result.Status)) || ctx.Err() != nil || !retry.retry(throttles, int(result.Status), header) {
+			retry.tag(result)
+			return result, &invocationResponse{Status: int(result.Status), Header: header}, nil
+		}
+	}
+}
+
+//websocketOrigin derives the origin of a handshake from the websocket target
+func websocketOrigin(target string) string {
+	origin, err := url.Parse(target)
+	if err != nil || origin.Host == "" {
+		return "http://localhost"
+	}
+	switch origin.Scheme {
+	case "wss", "https":
+		origin.Scheme = "https"
+	default:
+		origin.Scheme = "http"
+	}
+	return (&url.URL{Scheme: origin.Scheme, Host: origin.Host}).String()
+}
+
+//connection returns the open websocket of the worker or dials a new one
+func (s *StreamInvoker) connection(worker int) (*websocket.Conn, time.Duration, error) {
+	s.Lock()
+	conn, ok := s.conns[worker]
+	s.Unlock()
+	if ok {
+		return conn, 0, nil
+	}
+
+	origin := s.Origin
+	if origin == "" {
+		origin = websocketOrigin(s.target)
+	}
+	config, err := websocket.NewConfig(s.target, origin)
+	if err != nil {
+		return nil, 0, err
+	}
+	config.Header = s.Header.Clone()
+	config.TlsConfig = s.client.Transport.(*http.Transport).TLSClientConfig
+	config.Dialer = &net.Dialer{Timeout: s.Timeout}
+
+	start := time.Now()
+	conn, err = websocket.DialConfig(config)
+	if err != nil {
+		return nil, 0, err
+	}
+	connect := time.Since(start)
+
+	s.Lock()
+	defer s.Unlock()
+	if s.ctx.Err() != nil {
+		_ = conn.Close()
+		return nil, 0, s.ctx.Err()
+	}
+	s.conns[worker] = conn
+	return conn, connect, nil
+}
+
+func (s *StreamInvoker) closeConnection(worker int) {
+	s.Lock()
+	defer s.Unlock()
+	if conn, ok := s.conns[worker]; ok {
+		_ = conn.Close()
+		delete(s.conns, worker)
+	}
+}
+
+//sendMessage sends the message over the websocket of the worker and reads the replies
+func (s *StreamInvoker) sendMessage(worker int, id string, message []byte) *fact.Trace {
+	result := &fact.Trace{ID: id, Tags: make(map[string]string)}
+	stats := &streamStats{start: time.Now()}
+
+	conn, connect, err := s.connection(worker)
+	if err != nil {
+		return s.finish(result, stats, 0, fmt.Errorf("failed to connect - %+v", err))
+	}
+	if connect > 0 {
+		result.Tags[StreamConnectTag] = strconv.FormatInt(connect.Nanoseconds(), 10)
+	}
+
+	stats.start = time.Now()
+	_ = conn.SetDeadline(stats.start.Add(s.Timeout))
+	if err := websocket.Message.Send(conn, string(message)); err != nil {
+		s.closeConnection(worker)
+		return s.finish(result, stats, 0, err)
+	}
+	for {
+		var reply []byte
+		if err := websocket.Message.Receive(conn, &reply); err != nil {
+			//a broken connection is replaced on the next request
+			s.closeConnection(worker)
+			if err == io.EOF && stats.messages > 0 {
+				return s.finish(result, stats, http.StatusOK, nil)
+			}
+			return s.finish(result, stats, 0, err)
+		}
+		stats.add()
+		if s.complete(stats, reply, true) {
+			return s.finish(result, stats, http.StatusOK, nil)
+		}
+	}
+}
+
+//openStream sends a request and reads the events (sse) or chunks of the response, the stream is closed with the context
+func (s *StreamInvoker) openStream(ctx context.Context, id string, message []byte) (*fact.Trace, http.Header) {
+	result := &fact.Trace{ID: id, Tags: make(map[string]string)}
+	stats := &streamStats{start: time.Now()}
+
+	var body io.Reader
+	if len(message) > 0 {
+		body = bytes.NewReader(message)
+	}
+	req, err := http.NewRequestWithContext(ctx, s.Method, s.target, body)
+	if err != nil {
+		return s.finish(result, stats, 0, err), nil
+	}
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Request-ID", id)
+	if s.Protocol == StreamSSE {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+
+	stats.start = time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return s.finish(result, stats, 0, err), nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return s.finish(result, stats, resp.StatusCode, nil), resp.Header
+	}
+
+	if s.Protocol == StreamSSE {
+		err = s.readEvents(resp.Body, stats)
+	} else {
+		err = s.readChunks(resp.Body, stats)
+	}
+	return s.finish(result, stats, resp.StatusCode, err), resp.Header
+}
+
+//readEvents reads server-sent events, each event is a message
+func (s *StreamInvoker) readEvents(body io.Reader, stats *streamStats) error {
+	reader := bufio.NewReader(body)
+	var data bytes.Buffer
+	for {
+		line, err := reader.ReadBytes('\n')
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 && data.Len() > 0 {
+			event := append([]byte{}, bytes.TrimSuffix(data.Bytes(), []byte("\n"))...)
+			data.Reset()
+			stats.add()
+			if s.complete(stats, event, false) {
+				return nil
+			}
+		} else if bytes.HasPrefix(line, []byte("data:")) {
+			data.Write(bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" ")))
+			data.WriteByte('\n')
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+//readChunks reads the response as it arrives, each read is a message
+func (s *StreamInvoker) readChunks(body io.Reader, stats *streamStats) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			chunk := append([]byte{}, buf[:n]...)
+			stats.add()
+			if s.complete(stats, chunk, false) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+//complete reports if the stream is done, websockets without an end condition complete with the first reply
+func (s *StreamInvoker) complete(stats *streamStats, message []byte, single bool) bool {
+	if s.Until != "" && bytes.Contains(message, []byte(s.Until)) {
+		return true
+	}
+	if s.Messages > 0 {
+		return stats.messages >= s.Messages
+	}
+	return single && s.Until == ""
+}
+
+func (s *StreamInvoker) finish(result *fact.Trace, stats *streamStats, status int, err error) *fact.Trace {
+	end := time.Now()
+	result.Timestamp = timestamppb.New(stats.start)
+	result.RequestStartTime = timestamppb.New(stats.start)
+	result.RequestEndTime = timestamppb.New(end)
+	result.RequestResponseLatency = durationpb.New(end.Sub(stats.start))
+	result.Status = int32(status)
+
+	result.Tags[StreamMessagesTag] = strconv.Itoa(stats.messages)
+	if stats.messages > 0 {
+		result.Tags[StreamFirstMessageTag] = strconv.FormatInt(stats.first.Nanoseconds(), 10)
+	}
+	if stats.messages > 1 {
+		mean := stats.gaps / time.Duration(stats.messages-1)
+		result.Tags[StreamMeanGapTag] = strconv.FormatInt(mean.Nanoseconds(), 10)
+		result.Tags[StreamMaxGapTag] = strconv.FormatInt(stats.maxGap.Nanoseconds(), 10)
+	}
+	if err != nil {
+		markFailed(result, err)
+	}
+	return result
+}
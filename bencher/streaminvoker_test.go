@@ -0,0 +1,265 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+//newStreamServer streams three parts for each request, as websocket replies, events or chunks
+func newStreamServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		for {
+			var msg string
+			if err := websocket.Message.Receive(conn, &msg); err != nil {
+				return
+			}
+			for i := 0; i < 3; i++ {
+				time.Sleep(5 * time.Millisecond)
+				_ = websocket.Message.Send(conn, fmt.Sprintf("%s-%d", msg, i))
+			}
+			_ = websocket.Message.Send(conn, "[DONE]")
+		}
+	}))
+	mux.HandleFunc("/sse", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			time.Sleep(5 * time.Millisecond)
+			_, _ = fmt.Fprintf(w, "event: part\ndata: part %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/chunked", func(w http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 3; i++ {
+			time.Sleep(5 * time.Millisecond)
+			_, _ = fmt.Fprintf(w, "chunk %d;", i)
+			w.(http.Flusher).Flush()
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestStreamInvoker(t *testing.T) {
+	server := newStreamServer(t)
+	writer := &collectingWriter{}
+
+	run := func(config string, target string) {
+		invoker := setupInvoker(t, config, target).(*StreamInvoker)
+		results, err := NewResultPipeline(PipelineConfig{}, writer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		invoker.results = results
+		rate := &outcomeRate{}
+		for i := 0; i < 2; i++ {
+			assert.NoError(t, invoker.ExecAs(0, rate))
+		}
+		results.Close()
+		assert.Equal(t, 2, rate.success)
+	}
+
+	run(`
+type: stream
+protocol: websocket
+timeout: 5s
+message: "msg-{{.Seq}}"
+until: "[DONE]"
+`, "ws"+strings.TrimPrefix(server.URL, "http")+"/ws")
+	assert.Len(t, writer.traces, 2)
+	//the connection is reused by the second request
+	assert.NotEmpty(t, writer.traces[0].Tags[StreamConnectTag])
+	assert.Empty(t, writer.traces[1].Tags[StreamConnectTag])
+	for _, trace := range writer.traces {
+		assert.Equal(t, "4", trace.Tags[StreamMessagesTag])
+		first, _ := strconv.ParseInt(trace.Tags[StreamFirstMessageTag], 10, 64)
+		gap, _ := strconv.ParseInt(trace.Tags[StreamMeanGapTag], 10, 64)
+		assert.GreaterOrEqual(t, first, int64(5*time.Millisecond))
+		assert.Greater(t, gap, int64(0))
+		assert.GreaterOrEqual(t, trace.RequestResponseLatency.AsDuration(), 15*time.Millisecond)
+	}
+
+	writer.traces = nil
+	run(`
+type: stream
+protocol: sse
+timeout: 5s
+`, server.URL+"/sse")
+	assert.Equal(t, "3", writer.traces[0].Tags[StreamMessagesTag])
+	assert.Equal(t, int32(200), writer.traces[0].Status)
+
+	//chunks that arrive together are read at once
+	writer.traces = nil
+	run(`
+type: stream
+protocol: chunked
+timeout: 5s
+`, server.URL+"/chunked")
+	assert.NotEqual(t, "0", writer.traces[0].Tags[StreamMessagesTag])
+
+	invoker := &StreamInvoker{Messages: 2}
+	stats := &streamStats{start: time.Now()}
+	assert.NoError(t, invoker.readChunks(iotest.OneByteReader(strings.NewReader("abc")), stats))
+	assert.Equal(t, 2, stats.messages)
+
+	//throttled streams are signaled and retried
+	var requests int32
+	throttling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = fmt.Fprint(w, "data: done\n\n")
+	}))
+	defer throttling.Close()
+	writer.traces = nil
+	run(`
+type: stream
+protocol: sse
+timeout: 5s
+retry:
+  maxRetries: 3
+  backoff: 1ms
+`, throttling.URL)
+	assert.Equal(t, "1", writer.traces[0].Tags[ThrottledTag])
+	assert.Equal(t, "1", writer.traces[0].Tags[RetriesTag])
+	assert.Empty(t, writer.traces[1].Tags[ThrottledTag])
+}
+
+func TestStreamPhaseEnd(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+	}))
+	defer server.Close()
+
+	var cnf InvokerConfig
+	cnf.Type = "stream"
+	cnf.Options = map[string]interface{}{"protocol": StreamSSE, "timeout": "5s"}
+	invoker, err := NewInvokerFromConfig(cnf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &collectingWriter{}
+	results, err := NewResultPipeline(PipelineConfig{}, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	err = invoker.Setup(ctx, &Phase{Threads: 1, Target: server.URL}, &Bencher{results: results})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//an open stream is closed with the phase instead of the client timeout
+	done := make(chan error, 1)
+	go func() {
+		done <- invoker.(*StreamInvoker).ExecAs(0, &outcomeRate{})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream outlived its phase")
+	}
+	results.Close()
+	assert.Len(t, writer.traces, 1)
+}
+
+func TestStreamOrigin(t *testing.T) {
+	origins := make(chan string, 2)
+	server := httptest.NewServer(websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			origins <- req.Header.Get("Origin")
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			var msg string
+			for websocket.Message.Receive(conn, &msg) == nil {
+				_ = websocket.Message.Send(conn, msg)
+			}
+		},
+	})
+	defer server.Close()
+	target := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	//the origin is derived from the target
+	invoker := setupInvoker(t, `
+type: stream
+protocol: websocket
+timeout: 5s
+message: ping
+`, target).(*StreamInvoker)
+	trace, _, err := invoker.call(context.Background(), 0, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(200), trace.Status)
+	assert.Equal(t, server.URL, <-origins)
+	invoker.closeConnection(0)
+
+	invoker = setupInvoker(t, `
+type: stream
+protocol: websocket
+timeout: 5s
+message: ping
+origin: https://bench.example
+`, target).(*StreamInvoker)
+	_, _, err = invoker.call(context.Background(), 0, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://bench.example", <-origins)
+	invoker.closeConnection(0)
+
+	assert.Equal(t, "https://example.com:8443", websocketOrigin("wss://example.com:8443/chat"))
+}
+
+func TestStreamMiddleware(t *testing.T) {
+	server := newStreamServer(t)
+
+	invoker := setupInvoker(t, `
+type: stream
+protocol: sse
+timeout: 5s
+message: "msg-{{.Seq}}"
+middleware:
+  - type: tag
+    tags:
+      run: stream
+`, server.URL+"/sse").(*MiddlewareInvoker)
+	result, err := invoker.call(context.Background(), 0, &outcomeRate{})
+	assert.NoError(t, err)
+	assert.Equal(t, 200, result.Status)
+	assert.Equal(t, "3", result.Trace.Tags[StreamMessagesTag])
+	assert.Equal(t, "stream", result.Trace.Tags["run"])
+}
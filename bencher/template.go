@@ -0,0 +1,255 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//Feeder modes, how rows of a feeder file are handed to the requests
+const (
+	FeedSequential = "sequential" //all workers share one cursor over the rows
+	FeedRandom     = "random"     //each request picks a random row
+	FeedWorker     = "worker"     //each worker walks its own partition of the rows
+)
+
+const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+var templateFuncs = template.FuncMap{
+	"uuid": func() string { return uuid.New().String() },
+	"randInt": func(min, max int) int {
+		if max <= min {
+			return min
+		}
+		return min + rand.Intn(max-min)
+	},
+	"randString": func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = letters[rand.Intn(len(letters))]
+		}
+		return string(b)
+	},
+	"now":       time.Now,
+	"unix":      func() int64 { return time.Now().Unix() },
+	"unixMilli": func() int64 { return time.Now().UnixNano() / int64(time.Millisecond) },
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+//TemplateContext holds the per request variables available in payload templates, e.g. {{.Seq}} or {{.Row.name}}.
+type TemplateContext struct {
+	Seq       uint64                 //sequence number of the request within the phase
+	Worker    int                    //thread that sends the request
+	UUID      string                 //unique id of the request
+	Time      time.Time              //time the request is created
+	Timestamp int64                  //unix time in milliseconds
+	Row       map[string]interface{} //row of the feeder, if configured
+	Vars      map[string]string      //values extracted by earlier steps of a scenario
+
+	CorrelationID string //id the callback of the request is matched with, if a callback is configured
+	CallbackURL   string //url the function calls back to, if a callback is configured
+}
+
+//isTemplate reports if a value needs to be rendered per request
+func isTemplate(value string) bool {
+	return strings.Contains(value, "{{")
+}
+
+func parseTemplate(name string, value string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(value)
+}
+
+func renderTemplate(tpl *template.Template, ctx *TemplateContext) ([]byte, error) {
+	var buf bytes.Buffer
+	err := tpl.Execute(&buf, ctx)
+	return buf.Bytes(), err
+}
+
+//payloadTemplate creates the per request variables for all templates of an invoker
+type payloadTemplate struct {
+	feeder  *Feeder
+	seq     uint64
+	threads int
+}
+
+func newPayloadTemplate(options map[string]interface{}) (*payloadTemplate, error) {
+	feeder, err := newFeederFromConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	return &payloadTemplate{feeder: feeder}, nil
+}
+
+func (p *payloadTemplate) setup(phase *Phase) {
+	p.threads = phase.Threads
+	atomic.StoreUint64(&p.seq, 0)
+}
+
+func (p *payloadTemplate) next(worker int) *TemplateContext {
+	now := time.Now()
+	ctx := &TemplateContext{
+		Seq:       atomic.AddUint64(&p.seq, 1) - 1,
+		Worker:    worker,
+		UUID:      uuid.New().String(),
+		Time:      now,
+		Timestamp: now.UnixNano() / int64(time.Millisecond),
+	}
+	if p.feeder != nil {
+		ctx.Row = p.feeder.Next(worker, p.threads)
+	}
+	return ctx
+}
+
+//Feeder hands rows of a csv (with header) or jsonl file to the requests.
+type Feeder struct {
+	Rows    []map[string]interface{}
+	Mode    string
+	cursor  uint64
+	workers map[int]int
+	sync.Mutex
+}
+
+func newFeederFromConfig(options map[string]interface{}) (*Feeder, error) {
+	val, ok := options["feeder"]
+	if !ok || val == nil {
+		return nil, nil
+	}
+	config, ok := val.(map[string]interface{})
+	if !ok || !checkFields(config, "file") {
+		return nil, fmt.Errorf("feeder needs a file")
+	}
+
+	mode := strings.ToLower(stringValue("mode", config, FeedSequential))
+	switch mode {
+	case FeedSequential, FeedRandom, FeedWorker:
+	default:
+		return nil, fmt.Errorf("unknown feeder mode %s", mode)
+	}
+
+	return NewFeeder(stringValue("file", config, ""), mode)
+}
+
+//NewFeeder reads all rows of the file, .csv files need a header row, all other files are read as jsonl.
+func NewFeeder(filename string, mode string) (*Feeder, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rows []map[string]interface{}
+	if strings.ToLower(filepath.Ext(filename)) == ".csv" {
+		rows, err = readCSVRows(file)
+	} else {
+		rows, err = readJSONRows(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feeder %s - %+v", filename, err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("feeder %s is empty", filename)
+	}
+
+	return &Feeder{
+		Rows:    rows,
+		Mode:    mode,
+		workers: make(map[int]int),
+	}, nil
+}
+
+func readCSVRows(in io.Reader) ([]map[string]interface{}, error) {
+	records, err := csv.NewReader(in).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 1 {
+		return nil, nil
+	}
+	header := records[0]
+	rows := make([]map[string]interface{}, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(header))
+		for i, name := range header {
+			if i < len(record) {
+				row[name] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func readJSONRows(in io.Reader) ([]map[string]interface{}, error) {
+	rows := make([]map[string]interface{}, 0)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var row map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+//Next returns the row for the next request of the worker.
+func (f *Feeder) Next(worker int, threads int) map[string]interface{} {
+	switch f.Mode {
+	case FeedRandom:
+		return f.Rows[rand.Intn(len(f.Rows))]
+	case FeedWorker:
+		if threads < 1 {
+			threads = 1
+		}
+		f.Lock()
+		defer f.Unlock()
+		//worker w owns the rows w, w+threads, w+2*threads, ...
+		idx, ok := f.workers[worker]
+		if !ok || idx >= len(f.Rows) {
+			idx = worker % len(f.Rows)
+		}
+		f.workers[worker] = idx + threads
+		return f.Rows[idx]
+	default:
+		idx := atomic.AddUint64(&f.cursor, 1) - 1
+		return f.Rows[idx%uint64(len(f.Rows))]
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+//Tags set on traces of requests that performed a TLS handshake
+const (
+	TLSHandshakeTag = "TLSHandshake" //duration of the handshake in ns
+	TLSResumedTag   = "TLSResumed"   //true if the session was resumed
+)
+
+var _tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//TLSConfig of an invoker, configured under tls:, certificates are verified unless Insecure is set.
+type TLSConfig struct {
+	Insecure          bool   //skip the verification of the server certificate
+	CA                string //pem bundle used instead of the system roots
+	Cert              string //client certificate for mTLS
+	Key               string //key of the client certificate
+	ServerName        string //overrides the SNI and the name the certificate is verified against
+	MinVersion        string //minimum TLS version, e.g. 1.2
+	SessionResumption bool   //cache sessions so that new connections can resume them
+}
+
+func newTLSConfigFromConfig(options map[string]interface{}) (*TLSConfig, error) {
+	config := &TLSConfig{}
+	val, ok := options["tls"]
+	if !ok || val == nil {
+		return config, nil
+	}
+	values, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tls must be a map")
+	}
+
+	config.Insecure = flagValue("insecure", values, false)
+	config.CA = stringValue("ca", values, "")
+	config.Cert = stringValue("cert", values, "")
+	config.Key = stringValue("key", values, "")
+	config.ServerName = stringValue("serverName", values, "")
+	config.MinVersion = stringValue("minVersion", values, "")
+	config.SessionResumption = flagValue("sessionResumption", values, false)
+
+	if (config.Cert == "") != (config.Key == "") {
+		return nil, fmt.Errorf("tls needs both cert and key for client authentication")
+	}
+	if _, ok := _tlsVersions[config.MinVersion]; config.MinVersion != "" && !ok {
+		return nil, fmt.Errorf("unknown tls minVersion %s, use one of 1.0, 1.1, 1.2 or 1.3", config.MinVersion)
+	}
+	return config, nil
+}
+
+//Build creates the tls.Config, sessions are cached for up to sessions connections if resumption is enabled
+func (c *TLSConfig) Build(sessions int) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: c.Insecure,
+		ServerName:         c.ServerName,
+	}
+	if c.Insecure {
+		log.Warn("tls certificates are not verified")
+	}
+
+	if c.CA != "" {
+		pem, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca bundle - %+v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CA)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate - %+v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.MinVersion != "" {
+		config.MinVersion = _tlsVersions[strings.TrimSpace(c.MinVersion)]
+	}
+
+	if c.SessionResumption {
+		if sessions < 1 {
+			sessions = 1
+		}
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(sessions)
+	} else {
+		//without a cache every connection does a full handshake, so tickets are not requested either
+		config.SessionTicketsDisabled = true
+	}
+
+	return config, nil
+}
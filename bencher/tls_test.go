@@ -0,0 +1,125 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//writeClientCert creates a self signed client certificate and returns the cert and key files
+func writeClientCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bench"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	_ = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestHTTPInvokerTLS(t *testing.T) {
+	var clients int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clients = len(req.TLS.PeerCertificates)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	_ = ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	//certificates are verified by default
+	invoker := setupInvoker(t, `
+type: http
+timeout: 5s
+`, server.URL).(*HTTPInvoker)
+	trace := invokeOnce(t, invoker, 0)
+	assert.Equal(t, int32(0), trace.Status)
+
+	invoker = setupInvoker(t, `
+type: http
+timeout: 5s
+tls:
+  ca: `+ca+`
+  minVersion: "1.2"
+  sessionResumption: true
+`, server.URL).(*HTTPInvoker)
+	trace = invokeOnce(t, invoker, 0)
+	assert.Equal(t, int32(200), trace.Status)
+	assert.Equal(t, "false", trace.Tags[TLSResumedTag])
+	assert.NotEmpty(t, trace.Tags[TLSHandshakeTag])
+	assert.Equal(t, 0, clients)
+
+	//keep alive is off, so the next request resumes the session on a new connection
+	trace = invokeOnce(t, invoker, 0)
+	assert.Equal(t, "true", trace.Tags[TLSResumedTag])
+
+	cert, key := writeClientCert(t)
+	invoker = setupInvoker(t, `
+type: http
+timeout: 5s
+tls:
+  insecure: true
+  cert: `+cert+`
+  key: `+key+`
+`, server.URL).(*HTTPInvoker)
+	trace = invokeOnce(t, invoker, 0)
+	assert.Equal(t, int32(200), trace.Status)
+	assert.Equal(t, 1, clients)
+
+	_, err := newTLSConfigFromConfig(map[string]interface{}{"tls": map[string]interface{}{"cert": cert}})
+	assert.Error(t, err)
+	_, err = newTLSConfigFromConfig(map[string]interface{}{"tls": map[string]interface{}{"minVersion": "2.0"}})
+	assert.Error(t, err)
+}
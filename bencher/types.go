@@ -18,6 +18,7 @@
 package bencher
 
 import (
+	"fmt"
 	"time"
 )
 
@@ -31,7 +32,7 @@ type Phase struct {
 	Timeout     time.Duration //max duration of this phase
 	Target      string        //the target of this workload, can be an url or platfrom identifier (e.g. function name)
 	PayloadFunc PayloadFunc   //if set this function is called during _each_ invocation to generate a payload, use for authentication
-	PreRun      PreRunFunc   //if set this function will be called _once_ before running the phase
+	PreRun      PreRunFunc   //if set this function will be called _once_ before running the phase, the phase is skipped if it fails
 	PostRun     PostRunFunc  //if set this function will be called _once_ after running the phase
 	Invocation  Invoker       //the invocation of this phase, e.g. HTTP or CLI
 }
@@ -53,6 +54,9 @@ type PayloadFunc func(Invoker) []byte
 
 type BenchmarkConfig struct {
 	OutputFile string `json:"output" yaml:"output"`
+	NTP NTPConfig `json:"ntp" yaml:"ntp"`
+	Seed int64 `json:"seed" yaml:"seed"`
+	Pipeline PipelineConfig `json:"pipeline" yaml:"pipeline"`
 	Workload WorkloadConfig `json:"workload" yaml:"workload"`
 }
 
@@ -71,20 +75,56 @@ func (c WorkloadConfig) Unmarshal() (Workload,error) {
 		return Workload{}, err
 	}
 
-	for _, phase := range c.Phases {
-		p,err := phase.Unmarshal(c.Target,invoker)
-		if err != nil {
-			return Workload{}, err
+	steps := []string{""}
+	sweeper, sweep := invoker.(PhaseSweeper)
+	if sweep && len(sweeper.SweepSteps()) > 0 {
+		steps = sweeper.SweepSteps()
+	} else {
+		sweep = false
+	}
+
+	for i, step := range steps {
+		//all phases of a step are skipped if its configuration could not be applied
+		var applied error
+		for j, phase := range c.Phases {
+			p,err := phase.Unmarshal(c.Target,invoker)
+			if err != nil {
+				return Workload{}, err
+			}
+			if sweep {
+				p.Name = fmt.Sprintf("%s-%s", p.Name, step)
+				if j == 0 {
+					//the configuration is applied before the first phase of each step
+					step, target := i, p.Target
+					p.PreRun = func() error {
+						applied = sweeper.ApplySweep(step, target)
+						return applied
+					}
+				} else {
+					name := step
+					p.PreRun = func() error {
+						if applied != nil {
+							return fmt.Errorf("sweep step %s was not applied - %+v", name, applied)
+						}
+						return nil
+					}
+				}
+			}
+			phases = append(phases,p)
 		}
-		phases = append(phases,p)
 	}
 
-	return Workload{
+	workload := Workload{
 		Name:    c.Name,
 		Target:  c.Target,
 		Phases:  phases,
+	}
+	if lifecycle, ok := invoker.(LifecycleInvoker); ok {
+		workload.PreRun = lifecycle.PreRun
+		workload.PostRun = lifecycle.PostRun
+	}
 
-	},nil
+	return workload, nil
 }
 
 type PhaseConfig struct {
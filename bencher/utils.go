@@ -17,6 +17,7 @@
 
 package bencher
 
+import "fmt"
 
 func flagValue(key string, options map[string]interface{}, defaultValue bool) bool {
 	if val,ok := options[key]; ok {
@@ -35,5 +36,26 @@ func checkFields(options map[string]interface{}, keys ... string) bool {
 	return true
 }
 
+func stringValue(key string, options map[string]interface{}, defaultValue string) string {
+	if val, ok := options[key]; ok && val != nil {
+		return fmt.Sprint(val)
+	}
+	return defaultValue
+}
 
-
+//stringMap reads a nested map such as headers from the options
+func stringMap(key string, options map[string]interface{}) (map[string]string, error) {
+	result := make(map[string]string)
+	val, ok := options[key]
+	if !ok || val == nil {
+		return result, nil
+	}
+	values, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a map", key)
+	}
+	for k, v := range values {
+		result[k] = fmt.Sprint(v)
+	}
+	return result, nil
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/apache/openwhisk-client-go/whisk"
+	"github.com/faas-facts/fact/fact"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//Tags set from OpenWhisk activation records
+const (
+	WhiskNamespaceTag   = "Namespace"
+	WhiskWaitTimeTag    = "WaitTime"     //time the activation was queued, in ns
+	WhiskInitTimeTag    = "InitTime"     //time to initialize the container, in ns
+	WhiskColdStartTag   = "ColdStart"    //true if the activation had an init time
+	WhiskTimeoutTag     = "TimeoutLimit" //timeout limit of the action, in ns
+	WhiskConcurrencyTag = "Concurrency"  //concurrency limit of the action
+	WhiskCausedByTag    = "CausedBy"     //e.g. sequence for components of a sequence
+	WhiskStatusTag      = "ActivationStatus"
+)
+
+//readActivation decodes the activation record returned by a blocking invocation
+func readActivation(invoke map[string]interface{}) (*whisk.Activation, error) {
+	data, err := json.Marshal(invoke)
+	if err != nil {
+		return nil, err
+	}
+	var activation whisk.Activation
+	if err := json.Unmarshal(data, &activation); err != nil {
+		return nil, fmt.Errorf("failed to read activation record - %+v", err)
+	}
+	return &activation, nil
+}
+
+//activationStatus maps the status of an activation to the http status OpenWhisk answers with
+func activationStatus(statusCode int) int {
+	switch statusCode {
+	case 0:
+		return 200
+	case 1, 2:
+		//application and action developer errors
+		return 502
+	default:
+		return 500
+	}
+}
+
+//activationTrace maps an activation record onto a trace, the result is parsed as the trace of instrumented actions.
+//Values reported by the action itself are kept.
+func activationTrace(activation *whisk.Activation) (fact.Trace, []byte) {
+	var result fact.Trace
+	body, err := json.Marshal(activation.Result)
+	if err == nil {
+		if err := json.Unmarshal(body, &result); err != nil {
+			log.Debugf("no trace in the result of %s - %+v", activation.ActivationID, err)
+		}
+	}
+
+	result.ID = activation.ActivationID
+	result.Status = int32(activationStatus(activation.StatusCode))
+	result.CodeVersion = activation.Version
+	result.ExecutionLatency = durationpb.New(time.Duration(activation.Duration) * time.Millisecond)
+	if result.Platform == "" {
+		result.Platform = "openwhisk"
+	}
+	if result.StartTime == nil && activation.Start > 0 {
+		result.StartTime = timestamppb.New(fromMillis(activation.Start))
+	}
+	if result.EndTime == nil && activation.End > 0 {
+		result.EndTime = timestamppb.New(fromMillis(activation.End))
+	}
+	//components of sequences and rule fired activations point to their cause
+	if result.ChildOf == "" && activation.Cause != "" {
+		result.ChildOf = activation.Cause
+	}
+
+	if result.Tags == nil {
+		result.Tags = make(map[string]string)
+	}
+	result.Tags[WhiskNamespaceTag] = activation.Namespace
+	if activation.Response.Status != "" {
+		result.Tags[WhiskStatusTag] = activation.Response.Status
+	}
+
+	annotations := activation.Annotations
+	if kind, ok := annotations.GetValue("kind").(string); ok && result.Runtime == "" {
+		result.Runtime = kind
+	}
+	if wait, ok := annotationMillis(annotations.GetValue("waitTime")); ok {
+		result.Tags[WhiskWaitTimeTag] = strconv.FormatInt(wait.Nanoseconds(), 10)
+		if result.ExecutionDelay == nil {
+			result.ExecutionDelay = durationpb.New(wait)
+		}
+	}
+	initTime, coldStart := annotationMillis(annotations.GetValue("initTime"))
+	result.Tags[WhiskColdStartTag] = strconv.FormatBool(coldStart)
+	if coldStart {
+		result.Tags[WhiskInitTimeTag] = strconv.FormatInt(initTime.Nanoseconds(), 10)
+	}
+	if limits, ok := annotations.GetValue("limits").(map[string]interface{}); ok {
+		if memory, ok := annotationNumber(limits["memory"]); ok && result.Memory == 0 {
+			result.Memory = int32(memory)
+		}
+		if timeout, ok := annotationMillis(limits["timeout"]); ok {
+			result.Tags[WhiskTimeoutTag] = strconv.FormatInt(timeout.Nanoseconds(), 10)
+		}
+		if concurrency, ok := annotationNumber(limits["concurrency"]); ok {
+			result.Tags[WhiskConcurrencyTag] = strconv.Itoa(int(concurrency))
+		}
+	}
+	if causedBy, ok := annotations.GetValue("causedBy").(string); ok {
+		result.Tags[WhiskCausedByTag] = causedBy
+	}
+
+	return result, body
+}
+
+//annotationMillis reads a number of milliseconds from an annotation value
+func annotationMillis(value interface{}) (time.Duration, bool) {
+	millis, ok := annotationNumber(value)
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(millis * float64(time.Millisecond)), true
+}
+
+//annotationNumber reads a number from an annotation value, records fetched by the client contain json numbers
+func annotationNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case json.Number:
+		f, err := number.Float64()
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func fromMillis(millis int64) time.Time {
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
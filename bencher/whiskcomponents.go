@@ -0,0 +1,267 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/openwhisk-client-go/whisk"
+	"github.com/faas-facts/fact/fact"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//Entities the ow invoker can invoke, sequences are invoked like actions
+const (
+	WhiskActionEntity   = "action"
+	WhiskSequenceEntity = "sequence"
+	WhiskTriggerEntity  = "trigger"
+)
+
+//Tags set on the traces of sequences and fired triggers and on the traces of their components
+const (
+	WhiskComponentsTag            = "Components"            //number of fetched component activations
+	WhiskMissingComponentsTag     = "MissingComponents"     //components that failed to start or could not be fetched
+	WhiskComponentLatencyTag      = "ComponentLatency"      //sum of the durations of all components, in ns
+	WhiskOrchestrationOverheadTag = "OrchestrationOverhead" //time the platform spent outside of the components, in ns
+	WhiskComponentIndexTag        = "ComponentIndex"        //position of the component in its sequence
+	WhiskRuleTag                  = "Rule"                  //rule that fired the component
+	WhiskDispatchDelayTag         = "DispatchDelay"         //time from the trigger activation to the start of the component, in ns
+)
+
+//whiskComponent references an activation caused by a sequence or a rule
+type whiskComponent struct {
+	ActivationID string `json:"activationId"`
+	Rule         string `json:"rule"`
+	Error        string `json:"error"`
+}
+
+//componentsOf reads the components from the logs of a sequence or trigger activation,
+//sequences log the ids of their components and triggers one json record per fired rule.
+func componentsOf(activation *whisk.Activation) ([]whiskComponent, bool) {
+	kind, ok := activation.Annotations.GetValue("kind").(string)
+	if ok && kind != "sequence" {
+		//logs of actions are not components
+		return nil, false
+	}
+	sequence := ok
+	components := make([]whiskComponent, 0, len(activation.Logs))
+	for _, line := range activation.Logs {
+		if sequence {
+			components = append(components, whiskComponent{ActivationID: strings.TrimSpace(line)})
+			continue
+		}
+		var component whiskComponent
+		if err := json.Unmarshal([]byte(line), &component); err != nil {
+			log.Debugf("no rule in the log of %s - %+v", activation.ActivationID, err)
+			continue
+		}
+		components = append(components, component)
+	}
+	return components, sequence
+}
+
+//followComponents fetches the component activations of a sequence or fired trigger and writes their traces.
+//The parent is tagged with the latency of its components and the orchestration overhead of the platform,
+//the runtime of a sequence not spent in its components or the longest dispatch delay of the rules of a trigger.
+func (l *WhiskInvoker) followComponents(ctx context.Context, parent *fact.Trace, activation *whisk.Activation) {
+	if !l.Components {
+		return
+	}
+	components, sequence := componentsOf(activation)
+	if len(components) == 0 {
+		return
+	}
+
+	var latency, dispatch time.Duration
+	fetched, missing := 0, 0
+	for i, c := range components {
+		if c.ActivationID == "" {
+			log.Debugf("rule %s of %s did not fire - %s", c.Rule, activation.ActivationID, c.Error)
+			missing++
+			continue
+		}
+		component, err := l.fetchActivation(ctx, c.ActivationID)
+		if err != nil {
+			log.Debugf("failed to fetch component %s of %s - %+v", c.ActivationID, activation.ActivationID, err)
+			missing++
+			continue
+		}
+
+		trace, _ := activationTrace(component)
+		if trace.ChildOf == "" {
+			trace.ChildOf = parent.ID
+		}
+		if trace.Timestamp == nil {
+			trace.Timestamp = trace.StartTime
+		}
+		duration := time.Duration(component.Duration) * time.Millisecond
+		latency += duration
+		if sequence {
+			trace.Tags[WhiskComponentIndexTag] = strconv.Itoa(i)
+		} else {
+			trace.Tags[WhiskRuleTag] = c.Rule
+			if component.Start > 0 && activation.Start > 0 {
+				delay := fromMillis(component.Start).Sub(fromMillis(activation.Start))
+				trace.Tags[WhiskDispatchDelayTag] = strconv.FormatInt(delay.Nanoseconds(), 10)
+				if delay > dispatch {
+					dispatch = delay
+				}
+			}
+		}
+		if !component.Response.Success {
+			markFailed(&trace, fmt.Errorf("component failed with %s", component.Response.Status))
+		}
+		if l.Sweep != nil {
+			l.Sweep.tag(&trace)
+		}
+		l.results.Add(&trace)
+		fetched++
+	}
+
+	if parent.Tags == nil {
+		parent.Tags = make(map[string]string)
+	}
+	parent.Tags[WhiskComponentsTag] = strconv.Itoa(fetched)
+	parent.Tags[WhiskComponentLatencyTag] = strconv.FormatInt(latency.Nanoseconds(), 10)
+	if missing > 0 {
+		parent.Tags[WhiskMissingComponentsTag] = strconv.Itoa(missing)
+	}
+	overhead := dispatch
+	if sequence {
+		overhead = time.Duration(activation.Duration)*time.Millisecond - latency
+		if overhead < 0 {
+			//durations are rounded to milliseconds
+			overhead = 0
+		}
+	}
+	if missing == 0 {
+		parent.Tags[WhiskOrchestrationOverheadTag] = strconv.FormatInt(overhead.Nanoseconds(), 10)
+	}
+}
+
+//fireAsync fires the trigger without waiting for its activation record, the request is cancelled with the context
+func (l *WhiskInvoker) fireAsync(ctx context.Context, invocation interface{}) (string, *http.Response, error) {
+	name := (&url.URL{Path: l.FunctionName}).String()
+	req, err := l.client.NewRequest(http.MethodPost, "triggers/"+name, invocation, whisk.IncludeNamespaceInUrl)
+	if err != nil {
+		return "", nil, err
+	}
+	trigger := new(whisk.Trigger)
+	response, err := l.client.Do(req.WithContext(ctx), trigger, whisk.ExitWithSuccessOnTimeout)
+	if err != nil {
+		//as Triggers.Fire of the client
+		trigger = nil
+	}
+	if response == nil {
+		if err == nil {
+			err = fmt.Errorf("no response")
+		}
+		return "", nil, err
+	}
+	if response.StatusCode == http.StatusNoContent {
+		return "", response, nil
+	}
+	if trigger == nil || trigger.ActivationId == "" {
+		return "", response, fmt.Errorf("no activation for %s - %d %+v", l.FunctionName, response.StatusCode, err)
+	}
+	//the client reports accepted requests as timeouts
+	return trigger.ActivationId, response, nil
+}
+
+//fire fires the trigger and waits until its activation record lists the fired rules
+func (l *WhiskInvoker) fire(ctx context.Context, invocation interface{}, rate HatchRate) (*fact.Trace, *invocationResponse, error) {
+	retry := l.Retry.start(ctx)
+	for i := 0; ; i++ {
+		err := rate.Take()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		RStart := time.Now()
+		id, response, err := l.fireAsync(ctx, invocation)
+		REnd := time.Now()
+		if err != nil {
+			rate.OnFailed()
+			log.Debugf("failed [%d/%d] to fire %s - %+v", i, l.Retry.MaxRetries, l.FunctionName, err)
+			var status int
+			var header http.Header
+			if response != nil {
+				status, header = response.StatusCode, response.Header
+			}
+			if !retry.retry(rate, status, header) {
+				return nil, nil, fmt.Errorf("failed to fire %s after %d tries", l.FunctionName, i+1)
+			}
+			continue
+		}
+
+		if id == "" {
+			//no active rule, nothing was activated
+			rate.OnSuccess()
+			result := &fact.Trace{
+				Timestamp:              timestamppb.New(RStart),
+				Status:                 int32(response.StatusCode),
+				Platform:               "openwhisk",
+				RequestStartTime:       timestamppb.New(RStart),
+				RequestEndTime:         timestamppb.New(REnd),
+				RequestResponseLatency: durationpb.New(REnd.Sub(RStart)),
+				Tags:                   map[string]string{WhiskComponentsTag: "0"},
+			}
+			retry.tag(result)
+			return result, &invocationResponse{response.StatusCode, response.Header, nil}, nil
+		}
+
+		activation, err := l.fetchActivation(ctx, id)
+		REnd = time.Now()
+		if err != nil {
+			//firing again would activate the rules twice
+			rate.OnFailed()
+			result := &fact.Trace{
+				ID:                     id,
+				Timestamp:              timestamppb.New(RStart),
+				Status:                 int32(response.StatusCode),
+				RequestStartTime:       timestamppb.New(RStart),
+				RequestEndTime:         timestamppb.New(REnd),
+				RequestResponseLatency: durationpb.New(REnd.Sub(RStart)),
+			}
+			markFailed(result, err)
+			retry.tag(result)
+			return result, &invocationResponse{response.StatusCode, response.Header, nil}, nil
+		}
+
+		result, body := activationTrace(activation)
+		l.followComponents(ctx, &result, activation)
+		if l.check(&result, response, body) {
+			rate.OnSuccess()
+		} else {
+			rate.OnFailed()
+		}
+		result.RequestStartTime = timestamppb.New(RStart)
+		result.RequestEndTime = timestamppb.New(REnd)
+		result.RequestResponseLatency = durationpb.New(REnd.Sub(RStart))
+		retry.tag(&result)
+		return &result, &invocationResponse{response.StatusCode, response.Header, body}, nil
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apache/openwhisk-client-go/whisk"
+)
+
+//WhiskAction is an action the workload deploys before the first phase, configured as a list under actions: of the ow invoker.
+type WhiskAction struct {
+	Name        string                 //name of the action, packaged actions (pkg/action) need an existing package
+	Kind        string                 //runtime, e.g. nodejs:14, use blackbox with an Image for docker actions
+	Code        string                 //source file or zip archive of the action
+	Image       string                 //docker image of blackbox actions
+	Main        string                 //entry point, if not main
+	Memory      int                    //memory limit in MB, platform default if 0
+	Timeout     time.Duration          //timeout limit, platform default if 0
+	Concurrency int                    //max concurrent activations per container, platform default if 0
+	Params      map[string]interface{} //default parameters of the action
+	Web         bool                   //export the action as web action
+}
+
+func newWhiskActionsFromConfig(options map[string]interface{}) ([]WhiskAction, error) {
+	actions := make([]WhiskAction, 0)
+	for _, val := range listValue("actions", options) {
+		config, ok := val.(map[string]interface{})
+		if !ok || !checkFields(config, "name") {
+			return nil, fmt.Errorf("actions must be a list of maps with a name")
+		}
+
+		action := WhiskAction{
+			Name:  stringValue("name", config, ""),
+			Kind:  stringValue("kind", config, ""),
+			Code:  stringValue("code", config, ""),
+			Image: stringValue("image", config, ""),
+			Main:  stringValue("main", config, ""),
+			Web:   flagValue("web", config, false),
+		}
+		if action.Image != "" && action.Kind == "" {
+			action.Kind = "blackbox"
+		}
+		if action.Kind == "" {
+			return nil, fmt.Errorf("action %s needs a kind or an image", action.Name)
+		}
+		if action.Code == "" && action.Image == "" {
+			return nil, fmt.Errorf("action %s needs code or an image", action.Name)
+		}
+
+		for key, target := range map[string]*int{"memory": &action.Memory, "concurrency": &action.Concurrency} {
+			if val, ok := config[key]; ok {
+				*target, ok = val.(int)
+				if !ok || *target < 1 {
+					return nil, fmt.Errorf("action %s - %s must be a positive number", action.Name, key)
+				}
+			}
+		}
+		if val, ok := config["timeout"]; ok {
+			timeout, err := time.ParseDuration(fmt.Sprint(val))
+			if err != nil {
+				return nil, fmt.Errorf("action %s - invalid timeout %+v", action.Name, err)
+			}
+			action.Timeout = timeout
+		}
+		if val, ok := config["params"]; ok {
+			action.Params, ok = val.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("action %s - params must be a map", action.Name)
+			}
+		}
+
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+//whiskAction creates the api representation of the action, zip archives are uploaded as binary code
+func (a WhiskAction) whiskAction() (*whisk.Action, error) {
+	exec := &whisk.Exec{
+		Kind:  a.Kind,
+		Image: a.Image,
+		Main:  a.Main,
+	}
+	if a.Code != "" {
+		data, err := ioutil.ReadFile(a.Code)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read code of %s - %+v", a.Name, err)
+		}
+		code := string(data)
+		binary := strings.ToLower(filepath.Ext(a.Code)) == ".zip"
+		if binary {
+			code = base64.StdEncoding.EncodeToString(data)
+		}
+		exec.Code = &code
+		exec.Binary = &binary
+	}
+
+	limits := &whisk.Limits{}
+	if a.Memory > 0 {
+		limits.Memory = &a.Memory
+	}
+	if a.Timeout > 0 {
+		timeout := int(a.Timeout / time.Millisecond)
+		limits.Timeout = &timeout
+	}
+	if a.Concurrency > 0 {
+		limits.Concurrency = &a.Concurrency
+	}
+
+	action := &whisk.Action{
+		Name:   a.Name,
+		Exec:   exec,
+		Limits: limits,
+	}
+	for key, value := range a.Params {
+		action.Parameters = append(action.Parameters, whisk.KeyValue{Key: key, Value: value})
+	}
+	if a.Web {
+		action.Annotations = whisk.KeyValueArr{
+			{Key: "web-export", Value: true},
+			{Key: "raw-http", Value: false},
+			{Key: "final", Value: true},
+		}
+	}
+	return action, nil
+}
+
+//PreRun creates or updates all actions of the workload
+func (l *WhiskInvoker) PreRun() error {
+	if len(l.Actions) == 0 {
+		return nil
+	}
+	if l.client == nil {
+		if err := l.setWhiskClient(); err != nil {
+			return err
+		}
+	}
+	for _, a := range l.Actions {
+		action, err := a.whiskAction()
+		if err != nil {
+			return err
+		}
+		_, response, err := l.client.Actions.Insert(action, true)
+		if err != nil {
+			return fmt.Errorf("failed to deploy action %s - %+v", a.Name, err)
+		}
+		log.Infof("deployed action %s - %d", a.Name, response.StatusCode)
+	}
+	return nil
+}
+
+//PostRun restores the limits changed by a sweep and deletes all actions of the workload if cleanup is enabled
+func (l *WhiskInvoker) PostRun() error {
+	restored := l.restoreSweep()
+	if !l.Cleanup || len(l.Actions) == 0 || l.client == nil {
+		return restored
+	}
+	var failed []string
+	for _, a := range l.Actions {
+		if _, err := l.client.Actions.Delete(a.Name); err != nil {
+			log.Errorf("failed to delete action %s - %+v", a.Name, err)
+			failed = append(failed, a.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to delete actions %s", strings.Join(failed, ", "))
+	}
+	return restored
+}
@@ -29,9 +29,12 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 )
 
@@ -50,16 +53,56 @@ func init() {
 type WhiskInvoker struct {
 	FunctionName string
 
+	//Entity is the kind of FunctionName, an action, a sequence or a trigger that is fired
+	Entity string
+	//Components fetches the activations of sequence components and fired rules as traces of their own
+	Components bool
+
 	RequestPerMinute int64
 
-	Host  string
-	Token string
+	Host      string
+	Token     string
+	Namespace string //namespace of the api client, read from the props if not set
 
 	Request interface{}
 
-	results *fact.ResultCollector
+	payload         *payloadTemplate
+	payloadTemplate *template.Template
+
+	//Assertions validate each activation result, failed assertions mark the trace as failed
+	Assertions *Assertions
+
+	//TLS of the api connections, certificates are verified by default
+	TLS *TLSConfig
+
+	//Blocking waits for the result of each invocation, otherwise activations are fetched in batches by a poller
+	Blocking     bool
+	PollInterval time.Duration //wait between two polls of the activations list
+	PollBatch    int           //activations fetched per list call
+	PollTimeout  time.Duration //activations not found within this time are failed
+
+	//Actions are deployed before the workload and deleted afterwards if Cleanup is set
+	Actions []WhiskAction
+	Cleanup bool
+
+	//Web calls the action as web action through /api/v1/web/<namespace>/<package>/<action>.json
+	Web bool
+	//WebRecords fetches the activation record of each web action request, otherwise only its id is recorded
+	WebRecords bool
+
+	//Retry decides how failed and throttled api requests are retried
+	Retry *RetryPolicy
+
+	//Sweep repeats the phases for each configuration of the action, traces are tagged with the configuration in effect
+	Sweep *WhiskSweep
+
+	results *ResultPipeline
 
 	client       *whisk.Client
+	poller       *whisk.Client //the list api resets the namespace of its client, so polling uses its own
+	activations  *activationPoller
+	web          *HTTPInvoker
+	namespace    string
 	apiRateLimit *rate.Limiter
 	ctx          context.Context
 }
@@ -88,10 +131,110 @@ func newOpenWhiskInvoker(config InvokerConfig) (Invoker, error) {
 		function = val.(string)
 	}
 
+	pollInterval, err := time.ParseDuration(stringValue("pollInterval", config.Options, "1s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pollInterval - %+v", err)
+	}
+	pollTimeout, err := time.ParseDuration(stringValue("pollTimeout", config.Options, "5m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pollTimeout - %+v", err)
+	}
+	pollBatch := 100
+	if val, ok := config.Options["pollBatch"]; ok {
+		pollBatch, ok = val.(int)
+		if !ok || pollBatch < 1 || pollBatch > 200 {
+			return nil, fmt.Errorf("pollBatch must be between 1 and 200")
+		}
+	}
+
+	entity := stringValue("entity", config.Options, WhiskActionEntity)
+	switch entity {
+	case WhiskActionEntity, WhiskSequenceEntity, WhiskTriggerEntity:
+	default:
+		return nil, fmt.Errorf("unknown entity %s, use action, sequence or trigger", entity)
+	}
+
 	w := &WhiskInvoker{
 		FunctionName:     function,
+		Entity:           entity,
+		Components:       flagValue("components", config.Options, true),
 		RequestPerMinute: rps,
 		Request:          nil,
+		Blocking:         flagValue("blocking", config.Options, true),
+		PollInterval:     pollInterval,
+		PollBatch:        pollBatch,
+		PollTimeout:      pollTimeout,
+	}
+
+	var raw string
+	if val, ok := config.Options["payload"]; ok {
+		//the payload is either a map or a json string, both can contain templates
+		if str, ok := val.(string); ok {
+			raw = str
+		} else {
+			data, err := json.Marshal(val)
+			if err != nil {
+				return nil, fmt.Errorf("could not read payload %+v form config", val)
+			}
+			raw = string(data)
+		}
+
+		if isTemplate(raw) {
+			tpl, err := parseTemplate("payload", raw)
+			if err != nil {
+				return nil, err
+			}
+			w.payloadTemplate = tpl
+			w.payload, err = newPayloadTemplate(config.Options)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			var payload map[string]interface{}
+			if err := json.Unmarshal([]byte(raw), &payload); err != nil {
+				return nil, fmt.Errorf("payload must be a json object - %+v", err)
+			}
+			w.Request = payload
+		}
+	}
+
+	w.Assertions, err = newAssertionsFromConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	w.TLS, err = newTLSConfigFromConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	w.Actions, err = newWhiskActionsFromConfig(config.Options)
+	if err != nil {
+		return nil, err
+	}
+	w.Cleanup = flagValue("cleanup", config.Options, false)
+
+	w.Web = flagValue("web", config.Options, false)
+	w.WebRecords = flagValue("records", config.Options, false)
+	if w.Web {
+		if w.Entity == WhiskTriggerEntity {
+			return nil, fmt.Errorf("triggers can not be called as web actions")
+		}
+		w.web, err = newWhiskWebInvoker(config.Options, raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//invocations are tried maxRetries times unless configured otherwise
+	w.Retry, err = newRetryPolicyFromConfig(config.Options, maxRetries-1)
+	if err != nil {
+		return nil, err
+	}
+
+	w.Sweep, err = newWhiskSweepFromConfig(config.Options)
+	if err != nil {
+		return nil, err
 	}
 
 	if val, ok := config.Options["host"]; ok {
@@ -100,6 +243,7 @@ func newOpenWhiskInvoker(config InvokerConfig) (Invoker, error) {
 	if val, ok := config.Options["token"]; ok {
 		w.Token = val.(string)
 	}
+	w.Namespace = stringValue("namespace", config.Options, "")
 	return w, nil
 
 }
@@ -112,12 +256,23 @@ func (l *WhiskInvoker) Setup(ctx context.Context, phase *Phase, bencher *Bencher
 		return err
 	}
 
+	if l.Retry == nil {
+		l.Retry, _ = newRetryPolicyFromConfig(nil, maxRetries-1)
+	}
+	l.Retry.reset()
+
 	l.apiRateLimit = rate.NewLimiter(rate.Every(time.Minute/time.Duration(l.RequestPerMinute)), int(l.RequestPerMinute/60))
 
 	if l.FunctionName == "" {
 		l.FunctionName = phase.Target
 	}
 
+	if l.web != nil {
+		if err := l.setupWeb(ctx, phase, bencher); err != nil {
+			return err
+		}
+	}
+
 	if phase.PayloadFunc != nil {
 		var payload map[string]interface{}
 		err = json.Unmarshal(phase.PayloadFunc(l), &payload)
@@ -128,16 +283,51 @@ func (l *WhiskInvoker) Setup(ctx context.Context, phase *Phase, bencher *Bencher
 		l.Request = payload
 	}
 
+	if l.payload != nil {
+		l.payload.setup(phase)
+	}
+
 	l.results = bencher.results
 
+	if !l.Blocking || (l.web != nil && l.WebRecords) {
+		if l.activations == nil {
+			l.activations = &activationPoller{
+				invoker:  l,
+				interval: l.PollInterval,
+				batch:    l.PollBatch,
+				timeout:  l.PollTimeout,
+			}
+		}
+		l.activations.start(ctx, bencher)
+	}
+
 	return nil
 }
 
+//newInvocation renders the payload template for the worker, if configured, vars are set by scenarios
+func (l *WhiskInvoker) newInvocation(worker int, vars map[string]string) (interface{}, error) {
+	if l.payloadTemplate == nil {
+		return l.Request, nil
+	}
+	ctx := l.payload.next(worker)
+	ctx.Vars = vars
+	raw, err := renderTemplate(l.payloadTemplate, ctx)
+	if err != nil {
+		return nil, err
+	}
+	var payload map[string]interface{}
+	err = json.Unmarshal(raw, &payload)
+	if err != nil {
+		return nil, fmt.Errorf("rendered payload is not a json object - %+v", err)
+	}
+	return payload, nil
+}
+
 func (l *WhiskInvoker) setWhiskClient() error {
 	// lets first check the config
 	host := l.Host
 	token := l.Token
-	var namespace = "_"
+	var namespace = l.Namespace
 
 	if token == "" {
 		//2. check if wskprops exsist
@@ -150,12 +340,33 @@ func (l *WhiskInvoker) setWhiskClient() error {
 		} else {
 			host, token, namespace = setAtuhFromProps(readEnviron())
 		}
+		if l.Namespace != "" {
+			namespace = l.Namespace
+		}
+	}
+	if namespace == "" {
+		namespace = "_"
 	}
 
 	if token == "" {
 		log.Warn("did not find a token for the whisk client!")
 	}
 
+	if l.TLS == nil {
+		l.TLS = &TLSConfig{}
+	}
+	tlsConfig, err := l.TLS.Build(1)
+	if err != nil {
+		return err
+	}
+	//the whisk client would replace the transport of http.DefaultClient if we let it handle tls
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
 	baseurl, _ := whisk.GetURLBase(host, "/api")
 	clientConfig := &whisk.Config{
 		Namespace:        namespace,
@@ -164,22 +375,56 @@ func (l *WhiskInvoker) setWhiskClient() error {
 		BaseURL:          baseurl,
 		Version:          "v1",
 		Verbose:          true,
-		Insecure:         true,
+		Insecure:         false,
 		UserAgent:        "Golang/Smile cli",
 		ApigwAccessToken: "Dummy Token",
 	}
 
-	client, err := whisk.NewClient(http.DefaultClient, clientConfig)
+	client, err := whisk.NewClient(httpClient, clientConfig)
+	if err != nil {
+		return err
+	}
+	pollerConfig := *clientConfig
+	poller, err := whisk.NewClient(httpClient, &pollerConfig)
 	if err != nil {
 		return err
 	}
 
 	l.client = client
+	l.poller = poller
+	l.namespace = namespace
 	return nil
 }
 
 func (l *WhiskInvoker) Exec(rate HatchRate) error {
-	invoke, err := l.tryInvoke(l.Request, rate)
+	return l.ExecAs(0, rate)
+}
+
+func (l *WhiskInvoker) ExecAs(worker int, rate HatchRate) error {
+	if l.web != nil {
+		return l.execWeb(worker, rate)
+	}
+	invocation, err := l.newInvocation(worker, nil)
+	if err != nil {
+		//nothing was taken from the rate yet
+		return err
+	}
+
+	if !l.Blocking {
+		submitted, err := l.submit(invocation, rate)
+		if err != nil {
+			return err
+		}
+		if submitted.ID == "" {
+			//triggers without active rules have no activation
+			l.results.Add(submitted)
+			return nil
+		}
+		l.activations.submit(submitted)
+		return nil
+	}
+
+	invoke, _, err := l.tryInvoke(context.Background(), invocation, rate)
 
 	if err != nil {
 		return err
@@ -189,74 +434,217 @@ func (l *WhiskInvoker) Exec(rate HatchRate) error {
 	return nil
 }
 
-func (l *WhiskInvoker) tryInvoke(invocation interface{}, rate HatchRate) (*fact.Trace, error) {
+//submit fires a non-blocking invocation, the trace only covers the submission until the activation is fetched
+func (l *WhiskInvoker) submit(invocation interface{}, rate HatchRate) (*fact.Trace, error) {
+	retry := l.Retry.start(l.ctx)
+	for i := 0; ; i++ {
+		err := rate.Take()
+		if err != nil {
+			return nil, err
+		}
+
+		RStart := time.Now()
+		var id string
+		var response *http.Response
+		if l.Entity == WhiskTriggerEntity {
+			id, response, err = l.fireAsync(context.Background(), invocation)
+		} else {
+			var invoke map[string]interface{}
+			invoke, response, err = l.client.Actions.Invoke(l.FunctionName, invocation, false, false)
+			id, _ = invoke["activationId"].(string)
+		}
+		REnd := time.Now()
+		var status int
+		var header http.Header
+		if response != nil {
+			status, header = response.StatusCode, response.Header
+		}
+		if err == nil && response != nil {
+			//triggers without active rules are answered without an activation
+			if id != "" || response.StatusCode == http.StatusNoContent {
+				rate.OnSuccess()
+				submitted := &fact.Trace{
+					ID:                     id,
+					Timestamp:              timestamppb.New(RStart),
+					Status:                 int32(response.StatusCode),
+					RequestStartTime:       timestamppb.New(RStart),
+					RequestEndTime:         timestamppb.New(REnd),
+					RequestResponseLatency: durationpb.New(REnd.Sub(RStart)),
+					Tags: map[string]string{
+						SubmitLatencyTag: strconv.FormatInt(REnd.Sub(RStart).Nanoseconds(), 10),
+					},
+				}
+				retry.tag(submitted)
+				if l.Sweep != nil {
+					l.Sweep.tag(submitted)
+				}
+				return submitted, nil
+			}
+		}
+		rate.OnFailed()
+		log.Debugf("failed [%d/%d] to submit %s - %+v", i, l.Retry.MaxRetries, l.FunctionName, err)
+		if !retry.retry(rate, status, header) {
+			return nil, fmt.Errorf("failed to submit activation after %d tries", i+1)
+		}
+	}
+}
+
+//completesLater reports if traces are written after the call, see CallInvoker
+func (l *WhiskInvoker) completesLater() bool {
+	return !l.Blocking || (l.web != nil && l.WebRecords)
+}
+
+//call invokes the action once without waiting on a hatch rate, throttles are signaled to the rate
+func (l *WhiskInvoker) call(ctx context.Context, worker int, vars map[string]string, rate HatchRate) (*fact.Trace, *invocationResponse, error) {
+	if l.web != nil {
+		result, response, err := l.web.call(ctx, worker, vars, rate)
+		if err == nil && l.Sweep != nil {
+			l.Sweep.tag(result)
+		}
+		return result, response, err
+	}
+	invocation, err := l.newInvocation(worker, vars)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l.tryInvoke(ctx, invocation, signalThrottles(rate))
+}
+
+//invokeAction is Actions.Invoke of the client, the request is cancelled with the context
+func (l *WhiskInvoker) invokeAction(ctx context.Context, invocation interface{}, blocking bool) (map[string]interface{}, *http.Response, error) {
+	name := (&url.URL{Path: l.FunctionName}).String()
+	req, err := l.client.NewRequest(http.MethodPost, fmt.Sprintf("actions/%s?blocking=%t&result=false", name, blocking), invocation, whisk.IncludeNamespaceInUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	var invoke map[string]interface{}
+	response, err := l.client.Do(req.WithContext(ctx), &invoke, blocking)
+	return invoke, response, err
+}
+
+//tryInvoke makes a blocking invocation, the trace is tagged with the sweep configuration in effect
+func (l *WhiskInvoker) tryInvoke(ctx context.Context, invocation interface{}, rate HatchRate) (*fact.Trace, *invocationResponse, error) {
+	var result *fact.Trace
+	var response *invocationResponse
+	var err error
+	if l.Entity == WhiskTriggerEntity {
+		result, response, err = l.fire(ctx, invocation, rate)
+	} else {
+		result, response, err = l.invoke(ctx, invocation, rate)
+	}
+	if err == nil && l.Sweep != nil {
+		l.Sweep.tag(result)
+	}
+	return result, response, err
+}
+
+func (l *WhiskInvoker) invoke(ctx context.Context, invocation interface{}, rate HatchRate) (*fact.Trace, *invocationResponse, error) {
 	failures := make([]error, 0)
 	RStart := time.Now()
 	var REnd time.Time
-	for i := 0; i < maxRetries; i++ {
+	retry := l.Retry.start(ctx)
+	for i := 0; ; i++ {
 		err := rate.Take()
 		if err != nil {
 			//wait canceld form the outside
-			return nil, err
+			return nil, nil, err
 		}
 
-		invoke, response, err := l.client.Actions.Invoke(l.FunctionName, invocation, true, true)
+		invoke, response, err := l.invokeAction(ctx, invocation, true)
 
+		var status int
+		var header http.Header
 		if response == nil && err != nil {
 			failures = append(failures, err)
-			log.Warnf("failed [%d/%d]", i, maxRetries)
-			log.Debugf("%+v %d %+v", invoke, response.StatusCode, err)
+			log.Warnf("failed [%d/%d]", i, l.Retry.MaxRetries)
+			log.Debugf("%+v %+v", invoke, err)
 			rate.OnFailed()
-			continue
-		}
-		REnd = time.Now()
-		if response != nil {
+		} else if response != nil {
+			REnd = time.Now()
+			status, header = response.StatusCode, response.Header
 			log.Debugf("invoked %s - %d", l.FunctionName, response.StatusCode)
 			log.Debugf("%+v", invoke)
 			if response.StatusCode == 200 {
-				rate.OnSuccess()
-				result := readTraceFromHttpResponse(response)
-				result.RequestStartTime = timestamppb.New(RStart)
-				result.Status = int32(response.StatusCode)
-				result.RequestEndTime = timestamppb.New(REnd)
-				result.RequestResponseLatency = durationpb.New(REnd.Sub(RStart))
-				return &result, nil
+				activation, err := readActivation(invoke)
+				if err != nil {
+					failures = append(failures, err)
+				} else {
+					result, body := activationTrace(activation)
+					l.followComponents(ctx, &result, activation)
+					if l.check(&result, response, body) {
+						rate.OnSuccess()
+					} else {
+						rate.OnFailed()
+					}
+					result.RequestStartTime = timestamppb.New(RStart)
+					result.Status = int32(response.StatusCode)
+					result.RequestEndTime = timestamppb.New(REnd)
+					result.RequestResponseLatency = durationpb.New(REnd.Sub(RStart))
+					retry.tag(&result)
+					return &result, &invocationResponse{response.StatusCode, response.Header, body}, nil
+				}
 			} else if response.StatusCode == 202 {
 				if id, ok := invoke["activationId"]; ok {
-					result, err := l.pollActivation(id.(string))
+					activation, err := l.fetchActivation(ctx, id.(string))
 					REnd = time.Now()
 					if err != nil {
 						failures = append(failures, err)
 					} else {
+						//the blocking wait timed out, the outcome is the one of the fetched activation
+						result, body := activationTrace(activation)
+						l.followComponents(ctx, &result, activation)
+						if l.checkActivation(&result, activation, body) {
+							rate.OnSuccess()
+						} else {
+							rate.OnFailed()
+						}
 						result.RequestStartTime = timestamppb.New(RStart)
 						result.RequestEndTime = timestamppb.New(REnd)
 						result.RequestResponseLatency = durationpb.New(REnd.Sub(RStart))
-						return &result, nil
+						retry.tag(&result)
+						return &result, &invocationResponse{response.StatusCode, response.Header, body}, nil
 					}
 				}
 			} else {
 				failures = append(failures, fmt.Errorf("failed to invoke %d %+v", response.StatusCode, response.Body))
-				log.Debugf("failed [%d/%d ] times to invoke %s with %+v  %+v %+v", i, maxRetries,
+				log.Debugf("failed [%d/%d ] times to invoke %s with %+v  %+v %+v", i, l.Retry.MaxRetries,
 					l.FunctionName, invocation, invoke, response)
 			}
 		} else {
-			log.Debugf("failed [%d/%d]", i, maxRetries)
+			log.Debugf("failed [%d/%d]", i, l.Retry.MaxRetries)
+		}
+
+		//throttled invocations wait for the platform, all other failures are retried after the backoff
+		if !retry.retry(rate, status, header) {
+			break
 		}
 	}
-	REnd = time.Now()
 
 	for _, err := range failures {
 		log.Debugf(err.Error())
 	}
 
-	return nil, fmt.Errorf("failed request after multiple tries")
+	return nil, nil, fmt.Errorf("failed request after %d tries", retry.retries+1)
 
 }
 
-func (l *WhiskInvoker) pollActivation(activationID string) (fact.Trace, error) {
+//check runs the assertions against the activation result and marks failed traces
+func (l *WhiskInvoker) check(result *fact.Trace, response *http.Response, body []byte) bool {
+	if l.Assertions == nil {
+		return true
+	}
+	err := l.Assertions.Check(response.StatusCode, response.Header, body)
+	if err != nil {
+		markFailed(result, err)
+		return false
+	}
+	return true
+}
+
+//fetchActivation gets the record of an activation, waiting with an exponential backoff until it is available
+func (l *WhiskInvoker) fetchActivation(ctx context.Context, activationID string) (*whisk.Activation, error) {
 	//might want to configuer the backof rate?
 	backoff := 4
-	var result fact.Trace
 	wait := func(backoff int) int {
 		//results not here yet... keep wating
 		<-time.After(time.Second * time.Duration(backoff))
@@ -268,11 +656,11 @@ func (l *WhiskInvoker) pollActivation(activationID string) (fact.Trace, error) {
 
 	log.Debugf("polling Activation %s", activationID)
 	for x := 0; x < maxPullRetries; x++ {
-		err := l.apiRateLimit.Wait(l.ctx)
+		err := l.apiRateLimit.Wait(ctx)
 		if err != nil {
-			return result, err
+			return nil, err
 		}
-		invoke, response, err := l.client.Activations.Get(activationID)
+		invoke, response, err := l.poller.Activations.Get(activationID)
 		if err != nil || response.StatusCode == 404 {
 			backoff = wait(backoff)
 			if err != nil {
@@ -280,21 +668,10 @@ func (l *WhiskInvoker) pollActivation(activationID string) (fact.Trace, error) {
 			}
 		} else if response.StatusCode == 200 {
 			log.Debugf("polled %s successfully", activationID)
-			marshal, err := json.Marshal(invoke.Result)
-
-			err = json.Unmarshal(marshal, &result)
-			if err == nil {
-				result.Status = int32(invoke.StatusCode)
-				result.ExecutionLatency = durationpb.New(time.Duration(invoke.Duration))
-				result.CodeVersion = invoke.Version
-				result.ID = invoke.ActivationID
-				return result, nil
-			} else {
-				return result, fmt.Errorf("failed to fetch activation %s due to %f", activationID, err)
-			}
+			return invoke, nil
 		}
 	}
-	return result, fmt.Errorf("could not fetch activation after %d ties in %s", maxPullRetries, time.Second*time.Duration(backoff+backoff-1))
+	return nil, fmt.Errorf("could not fetch activation after %d ties in %s", maxPullRetries, time.Second*time.Duration(backoff+backoff-1))
 }
 
 //check props and env vars for relevant infomation ;)
@@ -333,6 +710,7 @@ func readProps(in io.ReadCloser) map[string]string {
 		if len(data) < 2 {
 			//XXX: This might leek user private data into a log...
 			log.Errorf("could not read prop line %s", line)
+			continue
 		}
 		props[data[0]] = data[1]
 	}
@@ -0,0 +1,754 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/openwhisk-client-go/whisk"
+	"github.com/faas-facts/fact/fact"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+//fakeWhisk serves the parts of the OpenWhisk api used by the invoker
+type fakeWhisk struct {
+	activations []whisk.Activation
+	invocations int
+	lists       int
+	actions     map[string]*whisk.Action
+	web         []string
+	throttle    int //invocations answered with 429 before the next one is accepted
+	accept      int //blocking invocations answered with 202, as if they ran into the blocking timeout
+	sync.Mutex
+}
+
+func (f *fakeWhisk) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	path := strings.TrimPrefix(req.URL.Path, "/api/v1/namespaces/_/")
+	switch {
+	case strings.HasPrefix(path, "actions/") && req.Method == http.MethodPut:
+		var action whisk.Action
+		_ = json.NewDecoder(req.Body).Decode(&action)
+		if f.actions == nil {
+			f.actions = make(map[string]*whisk.Action)
+		}
+		name := strings.TrimPrefix(path, "actions/")
+		//updates without exec keep the code
+		if existing, ok := f.actions[name]; ok && action.Exec == nil {
+			action.Exec = existing.Exec
+		}
+		f.actions[name] = &action
+		_ = json.NewEncoder(w).Encode(action)
+	case strings.HasPrefix(path, "actions/") && req.Method == http.MethodGet:
+		action, ok := f.actions[strings.TrimPrefix(path, "actions/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(action)
+	case strings.HasPrefix(path, "actions/") && req.Method == http.MethodDelete:
+		delete(f.actions, strings.TrimPrefix(path, "actions/"))
+		_ = json.NewEncoder(w).Encode(map[string]string{})
+	case strings.HasPrefix(path, "actions/") && req.Method == http.MethodPost && f.throttle > 0:
+		f.throttle--
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "Too many requests in the last minute"})
+	case strings.HasPrefix(path, "actions/") && req.Method == http.MethodPost:
+		var payload map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&payload)
+		activation := f.activation(strings.TrimPrefix(path, "actions/"))
+		if activation.Name == "seq" {
+			//sequences of two components, 6ms of the sequence are spent between them
+			activation.Annotations = whisk.KeyValueArr{{Key: "kind", Value: "sequence"}}
+			activation.Duration = 30
+			for i := 0; i < 2; i++ {
+				component := f.activation("step")
+				component.Cause = activation.ActivationID
+				component.Annotations = append(component.Annotations, whisk.KeyValue{Key: "causedBy", Value: "sequence"})
+				f.activations = append(f.activations, component)
+				activation.Logs = append(activation.Logs, component.ActivationID)
+			}
+		}
+		if payload["fail"] == true {
+			activation.Response.Success = false
+			activation.Response.Status = "application error"
+		}
+		if req.URL.Query().Get("blocking") == "true" && f.accept > 0 {
+			f.accept--
+			f.activations = append(f.activations, activation)
+			w.WriteHeader(http.StatusAccepted)
+			_ = json.NewEncoder(w).Encode(map[string]string{"activationId": activation.ActivationID})
+			return
+		}
+		if req.URL.Query().Get("blocking") == "true" {
+			if req.URL.Query().Get("result") == "true" {
+				_ = json.NewEncoder(w).Encode(activation.Result)
+			} else {
+				_ = json.NewEncoder(w).Encode(activation)
+			}
+			return
+		}
+		if payload["lost"] == nil {
+			f.activations = append(f.activations, activation)
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]string{"activationId": activation.ActivationID})
+	case strings.HasPrefix(path, "triggers/") && req.Method == http.MethodPost:
+		name := strings.TrimPrefix(path, "triggers/")
+		if name == "idle" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		trigger := f.activation(name)
+		trigger.Annotations = nil
+		trigger.Duration = 0
+		//one rule fires an action 5ms later, the other one is disabled
+		component := f.activation("hello")
+		component.Cause = trigger.ActivationID
+		component.Start = trigger.Start + 5
+		f.activations = append(f.activations, trigger, component)
+		rules, _ := json.Marshal(map[string]interface{}{
+			"statusCode": 0, "success": true, "activationId": component.ActivationID,
+			"rule": "guest/fire-hello", "action": "guest/hello",
+		})
+		disabled, _ := json.Marshal(map[string]interface{}{
+			"statusCode": 1, "success": false, "rule": "guest/disabled", "error": "Rule 'guest/disabled' is inactive",
+		})
+		f.activations[len(f.activations)-2].Logs = []string{string(rules), string(disabled)}
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(map[string]string{"activationId": trigger.ActivationID})
+	case strings.HasPrefix(path, "activations/") && req.Method == http.MethodGet:
+		for _, activation := range f.activations {
+			if activation.ActivationID == strings.TrimPrefix(path, "activations/") {
+				_ = json.NewEncoder(w).Encode(activation)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+	case strings.HasPrefix(path, "/api/v1/web/"):
+		//web actions answer with the result and the activation id in a header
+		name := strings.TrimSuffix(path[strings.LastIndex(path, "/")+1:], ".json")
+		activation := f.activation(name)
+		f.activations = append(f.activations, activation)
+		f.web = append(f.web, path)
+		w.Header().Set("X-Openwhisk-Activation-Id", activation.ActivationID)
+		_ = json.NewEncoder(w).Encode(activation.Result)
+	case path == "activations" && req.Method == http.MethodGet:
+		f.lists++
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		skip, _ := strconv.Atoi(req.URL.Query().Get("skip"))
+		page := []whisk.Activation{}
+		for i := len(f.activations) - 1 - skip; i >= 0 && len(page) < limit; i-- {
+			page = append(page, f.activations[i])
+		}
+		_ = json.NewEncoder(w).Encode(page)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+//activation creates the record of a successful activation of the action
+func (f *fakeWhisk) activation(name string) whisk.Activation {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	f.invocations++
+	return whisk.Activation{
+		Namespace:    "guest",
+		Name:         name,
+		Version:      "0.0.1",
+		ActivationID: fmt.Sprintf("a%d", f.invocations-1),
+		Start:        now,
+		End:          now + 12,
+		Duration:     12,
+		Response: whisk.Response{
+			Status:  "success",
+			Success: true,
+			Result:  &whisk.Result{"ContainerID": "c1"},
+		},
+		Annotations: whisk.KeyValueArr{
+			{Key: "kind", Value: "nodejs:14"},
+			{Key: "waitTime", Value: 40},
+			{Key: "initTime", Value: 310},
+			{Key: "limits", Value: map[string]interface{}{"memory": 256, "timeout": 60000, "concurrency": 1}},
+		},
+	}
+}
+
+func fakeWhiskOptions(server *httptest.Server, options map[string]interface{}) map[string]interface{} {
+	config := map[string]interface{}{
+		"host":  server.URL,
+		"token": "user:secret",
+		"rps":   int64(6000),
+	}
+	for k, v := range options {
+		config[k] = v
+	}
+	return config
+}
+
+func newFakeWhiskInvoker(t *testing.T, server *httptest.Server, options map[string]interface{}) *WhiskInvoker {
+	invoker, err := NewInvokerFromConfig(InvokerConfig{Type: "ow", Options: fakeWhiskOptions(server, options)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return invoker.(*WhiskInvoker)
+}
+
+func TestWhiskNonBlocking(t *testing.T) {
+	fake := &fakeWhisk{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	writer := &collectingWriter{}
+	results, err := NewResultPipeline(PipelineConfig{}, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bencher := &Bencher{results: results}
+
+	invoker := newFakeWhiskInvoker(t, server, map[string]interface{}{
+		"blocking":     false,
+		"pollInterval": "20ms",
+		"pollTimeout":  "2s",
+		"pollBatch":    2,
+		"payload":      `{"lost":{{if eq .Seq 2}}true{{else}}null{{end}}}`,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, invoker.Setup(ctx, &Phase{Threads: 1, Target: "echo"}, bencher))
+
+	rate := &outcomeRate{}
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, invoker.Exec(rate))
+	}
+	cancel()
+	bencher.pending.Wait()
+	results.Close()
+
+	assert.Equal(t, 5, rate.success)
+	assert.Len(t, writer.traces, 5)
+	failed := 0
+	for _, trace := range writer.traces {
+		assert.NotEmpty(t, trace.Tags[SubmitLatencyTag])
+		assert.NotNil(t, trace.RequestStartTime)
+		if isFailed(trace) {
+			failed++
+			assert.Equal(t, "a2", trace.ID)
+			continue
+		}
+		assert.Equal(t, "c1", trace.ContainerID)
+		assert.Equal(t, "0.0.1", trace.CodeVersion)
+		assert.NotEmpty(t, trace.Tags[CompletionLatencyTag])
+	}
+	assert.Equal(t, 1, failed)
+	//batches of two need more than one list call
+	fake.Lock()
+	assert.Greater(t, fake.lists, 1)
+	fake.Unlock()
+}
+
+func TestWhiskPollerOlderActivations(t *testing.T) {
+	fake := &fakeWhisk{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	writer := &collectingWriter{}
+	results, err := NewResultPipeline(PipelineConfig{}, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bencher := &Bencher{results: results}
+
+	invoker := newFakeWhiskInvoker(t, server, map[string]interface{}{
+		"blocking":     false,
+		"pollInterval": "1h",
+		"pollTimeout":  "1h",
+		"pollBatch":    2,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, invoker.Setup(ctx, &Phase{Threads: 1, Target: "echo"}, bencher))
+	assert.NoError(t, invoker.Exec(&outcomeRate{}))
+
+	//more newer activations than the list pages of a poll cover
+	time.Sleep(5 * time.Millisecond)
+	fake.Lock()
+	for i := 0; i < 3*maxPollPages; i++ {
+		fake.activations = append(fake.activations, fake.activation("echo"))
+	}
+	fake.Unlock()
+
+	invoker.activations.poll(ctx, time.Now())
+	fake.Lock()
+	assert.Equal(t, maxPollPages, fake.lists)
+	fake.Unlock()
+	invoker.activations.Lock()
+	missing := len(invoker.activations.pending)
+	invoker.activations.Unlock()
+	if missing > 0 {
+		t.Fatalf("%d activations still pending", missing)
+	}
+
+	cancel()
+	bencher.pending.Wait()
+	results.Close()
+	if assert.Len(t, writer.traces, 1) {
+		assert.Equal(t, "a0", writer.traces[0].ID)
+		assert.False(t, isFailed(writer.traces[0]))
+	}
+}
+
+func TestWhiskPayloadError(t *testing.T) {
+	fake := &fakeWhisk{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	invoker := newFakeWhiskInvoker(t, server, map[string]interface{}{
+		"payload": `not json {{.Seq}}`,
+	})
+	assert.NoError(t, invoker.Setup(context.Background(), &Phase{Threads: 1, Target: "echo"}, &Bencher{}))
+
+	//the rate is not signaled for invocations that were never taken
+	rate := &outcomeRate{}
+	assert.Error(t, invoker.Exec(rate))
+	assert.Equal(t, 0, rate.failed)
+}
+
+func TestWhiskBlockingTimeout(t *testing.T) {
+	fake := &fakeWhisk{accept: 2}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	invoker := newFakeWhiskInvoker(t, server, map[string]interface{}{
+		"payload": `{"fail":{{if eq .Seq 1}}true{{else}}false{{end}}}`,
+		"assert":  map[string]interface{}{"status": []interface{}{200}, "contains": []interface{}{"c1"}},
+	})
+	assert.NoError(t, invoker.Setup(context.Background(), &Phase{Threads: 1, Target: "echo"}, &Bencher{}))
+
+	//the assertions run against the fetched activation, not the 202 of the invocation
+	rate := &outcomeRate{}
+	trace, _, err := invoker.tryInvoke(context.Background(), mustInvocation(t, invoker), rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, isFailed(trace))
+	assert.Equal(t, 1, rate.success)
+
+	trace, _, err = invoker.tryInvoke(context.Background(), mustInvocation(t, invoker), rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, isFailed(trace))
+	assert.Equal(t, 1, rate.failed)
+}
+
+func mustInvocation(t *testing.T, invoker *WhiskInvoker) interface{} {
+	invocation, err := invoker.newInvocation(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return invocation
+}
+
+func TestWhiskActivationRecord(t *testing.T) {
+	fake := &fakeWhisk{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	invoker := newFakeWhiskInvoker(t, server, nil)
+	results, err := NewResultPipeline(PipelineConfig{}, &collectingWriter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer results.Close()
+	assert.NoError(t, invoker.Setup(context.Background(), &Phase{Threads: 1, Target: "echo"}, &Bencher{results: results}))
+
+	trace, response, err := invoker.call(context.Background(), 0, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"ContainerID":"c1"}`, string(response.Body))
+	assert.Equal(t, "a0", trace.ID)
+	assert.Equal(t, int32(200), trace.Status)
+	assert.Equal(t, "c1", trace.ContainerID)
+	assert.Equal(t, "openwhisk", trace.Platform)
+	assert.Equal(t, "nodejs:14", trace.Runtime)
+	assert.Equal(t, int32(256), trace.Memory)
+	assert.Equal(t, 12*time.Millisecond, trace.ExecutionLatency.AsDuration())
+	assert.Equal(t, 40*time.Millisecond, trace.ExecutionDelay.AsDuration())
+	assert.Equal(t, trace.StartTime.AsTime().Add(12*time.Millisecond), trace.EndTime.AsTime())
+	assert.Equal(t, "guest", trace.Tags[WhiskNamespaceTag])
+	assert.Equal(t, "true", trace.Tags[WhiskColdStartTag])
+	assert.Equal(t, "310000000", trace.Tags[WhiskInitTimeTag])
+	assert.Equal(t, "60000000000", trace.Tags[WhiskTimeoutTag])
+	assert.Equal(t, "1", trace.Tags[WhiskConcurrencyTag])
+
+	//records fetched by the client decode annotations as json numbers
+	fake.Lock()
+	record := fake.activation("echo")
+	fake.activations = append(fake.activations, record)
+	fake.Unlock()
+	fetched, _, err := invoker.poller.Activations.Get(record.ActivationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, isNumber := fetched.Annotations.GetValue("waitTime").(json.Number)
+	assert.True(t, isNumber)
+	polled, _ := activationTrace(fetched)
+	assert.Equal(t, int32(256), polled.Memory)
+	assert.Equal(t, 40*time.Millisecond, polled.ExecutionDelay.AsDuration())
+	assert.Equal(t, "40000000", polled.Tags[WhiskWaitTimeTag])
+	assert.Equal(t, "310000000", polled.Tags[WhiskInitTimeTag])
+	assert.Equal(t, "60000000000", polled.Tags[WhiskTimeoutTag])
+	assert.Equal(t, "1", polled.Tags[WhiskConcurrencyTag])
+
+	//components of a sequence
+	component, _ := activationTrace(&whisk.Activation{
+		ActivationID: "c",
+		Cause:        "s",
+		StatusCode:   1,
+		Annotations:  whisk.KeyValueArr{{Key: "causedBy", Value: "sequence"}},
+	})
+	assert.Equal(t, "s", component.ChildOf)
+	assert.Equal(t, int32(502), component.Status)
+	assert.Equal(t, "sequence", component.Tags[WhiskCausedByTag])
+	assert.Equal(t, "false", component.Tags[WhiskColdStartTag])
+}
+
+func TestWhiskDeployment(t *testing.T) {
+	fake := &fakeWhisk{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "echo.js")
+	archive := filepath.Join(dir, "echo.zip")
+	assert.NoError(t, ioutil.WriteFile(source, []byte("function main(args) { return args }"), 0644))
+	assert.NoError(t, ioutil.WriteFile(archive, []byte("PK\x03\x04"), 0644))
+
+	var config map[string]interface{}
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+cleanup: true
+actions:
+  - name: echo
+    kind: nodejs:14
+    code: `+source+`
+    memory: 512
+    timeout: 30s
+    concurrency: 4
+    web: true
+    params:
+      greeting: hello
+  - name: zipped
+    kind: python:3
+    code: `+archive+`
+    main: handler
+`), &config))
+	workload, err := WorkloadConfig{Invocation: InvokerConfig{Type: "ow", Options: fakeWhiskOptions(server, config)}}.Unmarshal()
+	if err != nil || workload.PreRun == nil || workload.PostRun == nil {
+		t.Fatalf("workload has no lifecycle - %+v", err)
+	}
+
+	assert.NoError(t, workload.PreRun())
+	fake.Lock()
+	echo := fake.actions["echo"]
+	zipped := fake.actions["zipped"]
+	fake.Unlock()
+	if assert.NotNil(t, echo) && assert.NotNil(t, zipped) {
+		assert.Equal(t, "nodejs:14", echo.Exec.Kind)
+		assert.Equal(t, "function main(args) { return args }", *echo.Exec.Code)
+		assert.False(t, *echo.Exec.Binary)
+		assert.Equal(t, 512, *echo.Limits.Memory)
+		assert.Equal(t, 30000, *echo.Limits.Timeout)
+		assert.Equal(t, 4, *echo.Limits.Concurrency)
+		assert.Equal(t, "hello", echo.Parameters.GetValue("greeting"))
+		assert.Equal(t, true, echo.Annotations.GetValue("web-export"))
+
+		assert.True(t, *zipped.Exec.Binary)
+		assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("PK\x03\x04")), *zipped.Exec.Code)
+		assert.Equal(t, "handler", zipped.Exec.Main)
+		assert.Nil(t, zipped.Limits.Memory)
+	}
+
+	assert.NoError(t, workload.PostRun())
+	fake.Lock()
+	assert.Empty(t, fake.actions)
+	fake.Unlock()
+
+	_, err = newWhiskActionsFromConfig(map[string]interface{}{
+		"actions": []interface{}{map[string]interface{}{"name": "echo", "kind": "nodejs:14"}},
+	})
+	assert.Error(t, err)
+}
+
+func TestWhiskSweep(t *testing.T) {
+	memory := 512
+	fake := &fakeWhisk{actions: map[string]*whisk.Action{"echo": {Name: "echo", Limits: &whisk.Limits{Memory: &memory}}}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	options := fakeWhiskOptions(server, map[string]interface{}{
+		"sweep": map[string]interface{}{
+			"memory":  []interface{}{128, 256},
+			"timeout": "30s",
+		},
+	})
+	workload, err := WorkloadConfig{
+		Target: "echo",
+		Phases: []PhaseConfig{
+			{Name: "warm", Threads: 1, HatchRate: HatchRateConfig{Type: "noop"}},
+			{Name: "steady", Threads: 1, HatchRate: HatchRateConfig{Type: "noop"}},
+		},
+		Invocation: InvokerConfig{Type: "ow", Options: options},
+	}.Unmarshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0)
+	for _, phase := range workload.Phases {
+		names = append(names, phase.Name)
+	}
+	assert.Equal(t, []string{"warm-128MB-30s", "steady-128MB-30s", "warm-256MB-30s", "steady-256MB-30s"}, names)
+	assert.NotNil(t, workload.Phases[0].PreRun)
+	assert.NoError(t, workload.Phases[1].PreRun())
+
+	assert.NoError(t, workload.Phases[2].PreRun())
+	fake.Lock()
+	limits := fake.actions["echo"].Limits
+	fake.Unlock()
+	assert.Equal(t, 256, *limits.Memory)
+	assert.Equal(t, 30000, *limits.Timeout)
+	assert.Nil(t, limits.Concurrency)
+
+	writer := &collectingWriter{}
+	results, err := NewResultPipeline(PipelineConfig{}, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phase := workload.Phases[2]
+	assert.NoError(t, phase.Invocation.Setup(context.Background(), &phase, &Bencher{results: results}))
+	assert.NoError(t, phase.Invocation.Exec(&outcomeRate{}))
+	results.Close()
+
+	if assert.Len(t, writer.traces, 1) {
+		assert.Equal(t, "256", writer.traces[0].Tags[ConfigMemoryTag])
+		assert.Equal(t, "30000000000", writer.traces[0].Tags[ConfigTimeoutTag])
+	}
+
+	//middleware keeps the sweep tags of the wrapped invoker
+	options["middleware"] = []interface{}{map[string]interface{}{"type": "tag", "tags": map[string]interface{}{"experiment": "sweep"}}}
+	invoker, err := NewInvokerFromConfig(InvokerConfig{Type: "ow", Options: options})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, invoker.(PhaseSweeper).ApplySweep(0, "echo"))
+	writer = &collectingWriter{}
+	results, err = NewResultPipeline(PipelineConfig{}, writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, invoker.Setup(context.Background(), &phase, &Bencher{results: results}))
+	assert.NoError(t, invoker.Exec(&outcomeRate{}))
+	results.Close()
+
+	if assert.Len(t, writer.traces, 1) {
+		assert.Equal(t, "128", writer.traces[0].Tags[ConfigMemoryTag])
+		assert.Equal(t, "sweep", writer.traces[0].Tags["experiment"])
+	}
+
+	//the limits before the sweep are restored after the run
+	assert.NoError(t, workload.PostRun())
+	fake.Lock()
+	limits = fake.actions["echo"].Limits
+	fake.Unlock()
+	assert.Equal(t, 512, *limits.Memory)
+	assert.Nil(t, limits.Timeout)
+
+	//a step that can not be applied skips its phases and leaves traces untagged
+	server.Close()
+	assert.Error(t, workload.Phases[0].PreRun())
+	assert.Error(t, workload.Phases[1].PreRun())
+	sweep := workload.Phases[0].Invocation.(*WhiskInvoker).Sweep
+	sweep.RLock()
+	assert.Nil(t, sweep.current)
+	sweep.RUnlock()
+
+	_, err = newWhiskSweepFromConfig(map[string]interface{}{"sweep": map[string]interface{}{"settle": "1s"}})
+	assert.Error(t, err)
+}
+
+func TestWhiskComponents(t *testing.T) {
+	fake := &fakeWhisk{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	run := func(options map[string]interface{}, target string) (*fact.Trace, []*fact.Trace) {
+		writer := &collectingWriter{}
+		results, err := NewResultPipeline(PipelineConfig{}, writer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		invoker := newFakeWhiskInvoker(t, server, options)
+		assert.NoError(t, invoker.Setup(context.Background(), &Phase{Threads: 1, Target: target}, &Bencher{results: results}))
+		assert.NoError(t, invoker.Exec(&outcomeRate{}))
+		results.Close()
+
+		var parent *fact.Trace
+		components := make([]*fact.Trace, 0)
+		for _, trace := range writer.traces {
+			if trace.ChildOf == "" {
+				parent = trace
+			} else {
+				components = append(components, trace)
+			}
+		}
+		if parent == nil {
+			t.Fatalf("no trace of %s", target)
+		}
+		return parent, components
+	}
+
+	sequence, components := run(map[string]interface{}{"entity": "sequence"}, "seq")
+	assert.Equal(t, "2", sequence.Tags[WhiskComponentsTag])
+	assert.Equal(t, "24000000", sequence.Tags[WhiskComponentLatencyTag])
+	assert.Equal(t, "6000000", sequence.Tags[WhiskOrchestrationOverheadTag])
+	if assert.Len(t, components, 2) {
+		for i, component := range components {
+			assert.Equal(t, sequence.ID, component.ChildOf)
+			assert.Equal(t, strconv.Itoa(i), component.Tags[WhiskComponentIndexTag])
+			assert.Equal(t, "sequence", component.Tags[WhiskCausedByTag])
+		}
+	}
+
+	trigger, components := run(map[string]interface{}{"entity": "trigger"}, "fire")
+	assert.False(t, isFailed(trigger))
+	assert.Equal(t, "1", trigger.Tags[WhiskComponentsTag])
+	assert.Equal(t, "1", trigger.Tags[WhiskMissingComponentsTag])
+	if assert.Len(t, components, 1) {
+		assert.Equal(t, trigger.ID, components[0].ChildOf)
+		assert.Equal(t, "guest/fire-hello", components[0].Tags[WhiskRuleTag])
+		assert.Equal(t, "5000000", components[0].Tags[WhiskDispatchDelayTag])
+	}
+
+	idle, components := run(map[string]interface{}{"entity": "trigger"}, "idle")
+	assert.Equal(t, int32(http.StatusNoContent), idle.Status)
+	assert.Empty(t, components)
+
+	_, components = run(map[string]interface{}{"components": false}, "seq")
+	assert.Empty(t, components)
+
+	_, err := NewInvokerFromConfig(InvokerConfig{Type: "ow", Options: map[string]interface{}{"entity": "package"}})
+	assert.Error(t, err)
+}
+
+func TestWhiskWebAction(t *testing.T) {
+	fake := &fakeWhisk{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	for _, records := range []bool{false, true} {
+		writer := &collectingWriter{}
+		results, err := NewResultPipeline(PipelineConfig{}, writer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bencher := &Bencher{results: results}
+		invoker := newFakeWhiskInvoker(t, server, map[string]interface{}{
+			"web":          true,
+			"records":      records,
+			"namespace":    "guest",
+			"function":     "demo/echo",
+			"payload":      map[string]interface{}{"id": "{{.Seq}}"},
+			"pollInterval": "20ms",
+			"pollTimeout":  "2s",
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		assert.NoError(t, invoker.Setup(ctx, &Phase{Threads: 1, Target: "echo"}, bencher))
+		rate := &outcomeRate{}
+		assert.NoError(t, invoker.Exec(rate))
+		cancel()
+		bencher.pending.Wait()
+		results.Close()
+
+		assert.Equal(t, 1, rate.success)
+		if assert.Len(t, writer.traces, 1) {
+			trace := writer.traces[0]
+			assert.False(t, isFailed(trace))
+			assert.Equal(t, "c1", trace.ContainerID)
+			assert.Equal(t, "openwhisk", trace.Platform)
+			assert.NotEmpty(t, trace.Tags[WhiskActivationIDTag])
+			if records {
+				//the record adds what the response does not tell
+				assert.Equal(t, trace.Tags[WhiskActivationIDTag], trace.ID)
+				assert.Equal(t, "true", trace.Tags[WhiskColdStartTag])
+				assert.NotEmpty(t, trace.Tags[CompletionLatencyTag])
+			} else {
+				assert.Empty(t, trace.Tags[WhiskColdStartTag])
+			}
+		}
+	}
+	fake.Lock()
+	assert.Equal(t, []string{"/api/v1/web/guest/demo/echo.json", "/api/v1/web/guest/demo/echo.json"}, fake.web)
+	fake.Unlock()
+
+	//the namespace can not be resolved for the default namespace
+	invoker := newFakeWhiskInvoker(t, server, map[string]interface{}{"web": true})
+	assert.Error(t, invoker.Setup(context.Background(), &Phase{Threads: 1, Target: "echo"}, &Bencher{}))
+}
+
+func TestWhiskThrottled(t *testing.T) {
+	fake := &fakeWhisk{throttle: 2}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	invoker := newFakeWhiskInvoker(t, server, map[string]interface{}{
+		"retry": map[string]interface{}{"backoff": "1ms"},
+	})
+	assert.NoError(t, invoker.Setup(context.Background(), &Phase{Threads: 1, Target: "echo"}, &Bencher{}))
+
+	rate := &outcomeRate{}
+	trace, _, err := invoker.tryInvoke(context.Background(), nil, rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "2", trace.Tags[RetriesTag])
+	assert.Equal(t, "2", trace.Tags[ThrottledTag])
+	assert.Equal(t, 2, rate.throttled)
+	assert.Equal(t, 1, rate.success)
+
+	//gives up after the configured retries
+	fake.Lock()
+	fake.throttle = 2
+	fake.Unlock()
+	invoker.Retry.MaxRetries = 1
+	_, _, err = invoker.tryInvoke(context.Background(), nil, rate)
+	assert.Error(t, err)
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apache/openwhisk-client-go/whisk"
+	"github.com/faas-facts/fact/fact"
+)
+
+//pollSkew is subtracted from the oldest pending submission when listing activations, the platform clock may be behind
+const pollSkew = time.Minute
+
+//maxPollPages bounds the list calls of one poll, older pending activations are fetched one by one
+const maxPollPages = 10
+
+//activationPoller fetches the records of non-blocking activations in batches from the activations list api.
+type activationPoller struct {
+	invoker  *WhiskInvoker
+	interval time.Duration
+	batch    int
+	timeout  time.Duration
+
+	pending map[string]*pendingActivation
+	results *ResultPipeline
+	done    chan struct{}
+	closed  bool
+	sync.Mutex
+}
+
+type pendingActivation struct {
+	trace     *fact.Trace
+	submitted time.Time
+}
+
+//start polls until the phase is done, outstanding activations are awaited for up to the timeout afterwards
+func (p *activationPoller) start(ctx context.Context, bencher *Bencher) {
+	//the previous phase hands over once its activations are drained
+	if p.done != nil {
+		<-p.done
+	}
+	done := make(chan struct{})
+
+	p.Lock()
+	p.pending = make(map[string]*pendingActivation)
+	p.results = bencher.results
+	p.done = done
+	p.closed = false
+	p.Unlock()
+
+	bencher.pending.Add(1)
+	go func() {
+		defer bencher.pending.Done()
+		defer close(done)
+
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				//outstanding activations expire after the timeout at the latest
+				drain, cancel := context.WithTimeout(context.Background(), p.timeout+p.interval)
+				for !p.drained() {
+					p.poll(drain, <-ticker.C)
+				}
+				cancel()
+				return
+			case now := <-ticker.C:
+				p.poll(ctx, now)
+			}
+		}
+	}()
+}
+
+//drained closes the poller once no activations are pending, later submits are lost
+func (p *activationPoller) drained() bool {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.pending) == 0 {
+		p.closed = true
+	}
+	return p.closed
+}
+
+//submit holds the trace of an accepted activation until its record is fetched or it times out
+func (p *activationPoller) submit(trace *fact.Trace) {
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		markFailed(trace, fmt.Errorf("activation %s submitted after the phase was drained", trace.ID))
+		p.results.Add(trace)
+		return
+	}
+	p.pending[trace.ID] = &pendingActivation{trace: trace, submitted: time.Now()}
+	p.Unlock()
+}
+
+//poll lists the latest activations of the action and completes all pending ones found
+func (p *activationPoller) poll(ctx context.Context, now time.Time) {
+	p.Lock()
+	oldest := now
+	for _, a := range p.pending {
+		if a.submitted.Before(oldest) {
+			oldest = a.submitted
+		}
+	}
+	missing := len(p.pending)
+	p.Unlock()
+	if missing == 0 {
+		return
+	}
+
+	since := oldest.Add(-pollSkew).UnixNano() / int64(time.Millisecond)
+	//the list is newest first, at high rates the oldest pending activations are beyond the last page
+	truncated := false
+	var window int64
+	for page := 0; page < maxPollPages && missing > 0; page++ {
+		//polling shares the api budget with the invocations
+		if err := p.invoker.apiRateLimit.Wait(ctx); err != nil {
+			log.Debugf("failed to wait for the api rate limit %+v", err)
+			break
+		}
+		activations, _, err := p.invoker.poller.Activations.List(&whisk.ActivationListOptions{
+			Name:  p.invoker.FunctionName,
+			Limit: p.batch,
+			Skip:  page * p.batch,
+			Since: since,
+			Docs:  true,
+		})
+		if err != nil {
+			log.Debugf("failed to list activations %+v", err)
+			break
+		}
+
+		for i := range activations {
+			if window == 0 || activations[i].Start < window {
+				window = activations[i].Start
+			}
+			missing = p.complete(&activations[i])
+		}
+		truncated = len(activations) >= p.batch
+		if !truncated {
+			break
+		}
+	}
+	if truncated && missing > 0 {
+		p.fetchOlder(ctx, fromMillis(window))
+	}
+
+	p.expire(time.Now())
+}
+
+//complete writes the trace of a pending activation and returns the number of activations still pending
+func (p *activationPoller) complete(activation *whisk.Activation) int {
+	p.Lock()
+	pending, ok := p.pending[activation.ActivationID]
+	if ok {
+		delete(p.pending, activation.ActivationID)
+	}
+	missing := len(p.pending)
+	p.Unlock()
+	if ok {
+		p.results.Add(p.invoker.completeActivation(pending.trace, activation))
+	}
+	return missing
+}
+
+//fetchOlder gets up to a batch of the oldest pending activations submitted before the listed window one by one
+func (p *activationPoller) fetchOlder(ctx context.Context, window time.Time) {
+	p.Lock()
+	older := make([]*pendingActivation, 0)
+	for _, a := range p.pending {
+		if a.submitted.Before(window) {
+			older = append(older, a)
+		}
+	}
+	p.Unlock()
+	sort.Slice(older, func(i, j int) bool {
+		return older[i].submitted.Before(older[j].submitted)
+	})
+	if len(older) > p.batch {
+		older = older[:p.batch]
+	}
+
+	for _, a := range older {
+		if err := p.invoker.apiRateLimit.Wait(ctx); err != nil {
+			log.Debugf("failed to wait for the api rate limit %+v", err)
+			return
+		}
+		activation, response, err := p.invoker.poller.Activations.Get(a.trace.ID)
+		if err != nil || response == nil || response.StatusCode != http.StatusOK {
+			//not written yet, retried in the next poll
+			log.Debugf("failed to get activation %s %+v", a.trace.ID, err)
+			continue
+		}
+		p.complete(activation)
+	}
+}
+
+func (p *activationPoller) expire(now time.Time) {
+	var lost []*fact.Trace
+	p.Lock()
+	for id, a := range p.pending {
+		if now.Sub(a.submitted) >= p.timeout {
+			delete(p.pending, id)
+			lost = append(lost, a.trace)
+		}
+	}
+	p.Unlock()
+
+	for _, trace := range lost {
+		markFailed(trace, fmt.Errorf("activation %s not found within %s", trace.ID, p.timeout))
+		p.results.Add(trace)
+	}
+}
+
+//completeActivation merges the fetched activation record into the trace of its submission
+func (l *WhiskInvoker) completeActivation(submitted *fact.Trace, activation *whisk.Activation) *fact.Trace {
+	result, body := activationTrace(activation)
+	//the phase may already be over while the poller drains
+	l.followComponents(context.Background(), &result, activation)
+	result.RequestStartTime = submitted.RequestStartTime
+	result.RequestEndTime = submitted.RequestEndTime
+	result.RequestResponseLatency = submitted.RequestResponseLatency
+	if result.Timestamp == nil || !result.Timestamp.IsValid() || result.Timestamp.GetSeconds() <= 1 {
+		result.Timestamp = submitted.Timestamp
+	}
+	if result.Tags == nil {
+		result.Tags = make(map[string]string)
+	}
+	for k, v := range submitted.Tags {
+		result.Tags[k] = v
+	}
+	if activation.End > 0 && submitted.RequestStartTime != nil {
+		//measured against the platform clock
+		result.Tags[CompletionLatencyTag] = strconv.FormatInt(fromMillis(activation.End).Sub(submitted.RequestStartTime.AsTime()).Nanoseconds(), 10)
+	}
+
+	l.checkActivation(&result, activation, body)
+	return &result
+}
+
+//checkActivation runs the assertions against a fetched activation record, it has no response of its own
+func (l *WhiskInvoker) checkActivation(result *fact.Trace, activation *whisk.Activation, body []byte) bool {
+	if !activation.Response.Success {
+		markFailed(result, fmt.Errorf("activation failed with %s", activation.Response.Status))
+		return false
+	}
+	if l.Assertions != nil {
+		if err := l.Assertions.Check(200, nil, body); err != nil {
+			markFailed(result, err)
+			return false
+		}
+	}
+	return true
+}
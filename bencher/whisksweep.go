@@ -0,0 +1,277 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/openwhisk-client-go/whisk"
+	"github.com/faas-facts/fact/fact"
+)
+
+//Tags set on traces of a sweep, the configuration the action had when it was invoked
+const (
+	ConfigMemoryTag      = "ConfigMemory"      //memory limit in MB
+	ConfigTimeoutTag     = "ConfigTimeout"     //timeout limit in ns
+	ConfigConcurrencyTag = "ConfigConcurrency" //concurrency limit
+)
+
+//sweepAttempts bounds how often the action is read back until the update is visible
+const sweepAttempts = 10
+
+//WhiskConfiguration are the limits of one step of a sweep, unset limits are left unchanged.
+type WhiskConfiguration struct {
+	Memory      int
+	Timeout     time.Duration
+	Concurrency int
+}
+
+//Name identifies the configuration in the names of the generated phases, e.g. 256MB-60s
+func (c WhiskConfiguration) Name() string {
+	parts := make([]string, 0, 3)
+	if c.Memory > 0 {
+		parts = append(parts, fmt.Sprintf("%dMB", c.Memory))
+	}
+	if c.Timeout > 0 {
+		parts = append(parts, c.Timeout.String())
+	}
+	if c.Concurrency > 0 {
+		parts = append(parts, fmt.Sprintf("c%d", c.Concurrency))
+	}
+	return strings.Join(parts, "-")
+}
+
+func (c WhiskConfiguration) limits() *whisk.Limits {
+	limits := &whisk.Limits{}
+	if c.Memory > 0 {
+		memory := c.Memory
+		limits.Memory = &memory
+	}
+	if c.Timeout > 0 {
+		timeout := int(c.Timeout / time.Millisecond)
+		limits.Timeout = &timeout
+	}
+	if c.Concurrency > 0 {
+		concurrency := c.Concurrency
+		limits.Concurrency = &concurrency
+	}
+	return limits
+}
+
+//matches reports if the limits of the action contain the configuration
+func (c WhiskConfiguration) matches(limits *whisk.Limits) bool {
+	if limits == nil {
+		return false
+	}
+	want := c.limits()
+	equal := func(want, got *int) bool {
+		return want == nil || (got != nil && *want == *got)
+	}
+	return equal(want.Memory, limits.Memory) && equal(want.Timeout, limits.Timeout) &&
+		equal(want.Concurrency, limits.Concurrency)
+}
+
+//WhiskSweep runs all phases of the workload once per configuration, configured under sweep: of the ow invoker.
+//Configurations are the combinations of all listed memory, timeout and concurrency limits.
+type WhiskSweep struct {
+	Configurations []WhiskConfiguration
+	Settle         time.Duration //wait after an update, e.g. until warm containers of the old version are gone
+
+	current  *WhiskConfiguration
+	action   string        //name of the swept action
+	original *whisk.Limits //limits of the action before the first step, restored after the run
+	sync.RWMutex
+}
+
+func newWhiskSweepFromConfig(options map[string]interface{}) (*WhiskSweep, error) {
+	val, ok := options["sweep"]
+	if !ok || val == nil {
+		return nil, nil
+	}
+	config, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("sweep must be a map")
+	}
+
+	ints := func(key string) ([]int, error) {
+		values := make([]int, 0)
+		for _, val := range listValue(key, config) {
+			value, ok := val.(int)
+			if !ok || value < 1 {
+				return nil, fmt.Errorf("sweep %s must be positive numbers", key)
+			}
+			values = append(values, value)
+		}
+		if len(values) == 0 {
+			//left unchanged
+			values = append(values, 0)
+		}
+		return values, nil
+	}
+	memories, err := ints("memory")
+	if err != nil {
+		return nil, err
+	}
+	concurrencies, err := ints("concurrency")
+	if err != nil {
+		return nil, err
+	}
+	timeouts := make([]time.Duration, 0)
+	for _, val := range listValue("timeout", config) {
+		timeout, err := time.ParseDuration(fmt.Sprint(val))
+		if err != nil {
+			return nil, fmt.Errorf("invalid sweep timeout - %+v", err)
+		}
+		timeouts = append(timeouts, timeout)
+	}
+	if len(timeouts) == 0 {
+		timeouts = append(timeouts, 0)
+	}
+
+	settle, err := time.ParseDuration(stringValue("settle", config, "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid sweep settle - %+v", err)
+	}
+
+	sweep := &WhiskSweep{Settle: settle}
+	for _, memory := range memories {
+		for _, timeout := range timeouts {
+			for _, concurrency := range concurrencies {
+				sweep.Configurations = append(sweep.Configurations, WhiskConfiguration{
+					Memory:      memory,
+					Timeout:     timeout,
+					Concurrency: concurrency,
+				})
+			}
+		}
+	}
+	if len(sweep.Configurations) == 1 && sweep.Configurations[0].Name() == "" {
+		return nil, fmt.Errorf("sweep needs memory, timeout or concurrency limits")
+	}
+	return sweep, nil
+}
+
+//tag adds the configuration in effect to the trace
+func (s *WhiskSweep) tag(trace *fact.Trace) {
+	s.RLock()
+	current := s.current
+	s.RUnlock()
+	if current == nil {
+		return
+	}
+	if trace.Tags == nil {
+		trace.Tags = make(map[string]string)
+	}
+	if current.Memory > 0 {
+		trace.Tags[ConfigMemoryTag] = strconv.Itoa(current.Memory)
+	}
+	if current.Timeout > 0 {
+		trace.Tags[ConfigTimeoutTag] = strconv.FormatInt(current.Timeout.Nanoseconds(), 10)
+	}
+	if current.Concurrency > 0 {
+		trace.Tags[ConfigConcurrencyTag] = strconv.Itoa(current.Concurrency)
+	}
+}
+
+//SweepSteps names the configurations of the sweep
+func (l *WhiskInvoker) SweepSteps() []string {
+	if l.Sweep == nil {
+		return nil
+	}
+	steps := make([]string, len(l.Sweep.Configurations))
+	for i, c := range l.Sweep.Configurations {
+		steps[i] = c.Name()
+	}
+	return steps
+}
+
+//ApplySweep updates the limits of the action to the configuration of the step and waits until the update is visible
+func (l *WhiskInvoker) ApplySweep(step int, target string) error {
+	if l.Sweep == nil || step < 0 || step >= len(l.Sweep.Configurations) {
+		return fmt.Errorf("no sweep step %d", step)
+	}
+	configuration := l.Sweep.Configurations[step]
+	if l.client == nil {
+		if err := l.setWhiskClient(); err != nil {
+			return err
+		}
+	}
+	name := l.FunctionName
+	if name == "" {
+		name = target
+	}
+
+	//traces are untagged until the update is visible, a failed update leaves them untagged
+	l.Sweep.Lock()
+	l.Sweep.current = nil
+	l.Sweep.Unlock()
+	if l.Sweep.original == nil {
+		action, _, err := l.client.Actions.Get(name, false)
+		if err != nil {
+			return fmt.Errorf("failed to read the limits of %s - %+v", name, err)
+		}
+		l.Sweep.action, l.Sweep.original = name, action.Limits
+	}
+
+	//without exec only the limits of the action are updated
+	_, _, err := l.client.Actions.Insert(&whisk.Action{Name: name, Limits: configuration.limits()}, true)
+	if err != nil {
+		return fmt.Errorf("failed to update %s to %s - %+v", name, configuration.Name(), err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		action, _, err := l.client.Actions.Get(name, false)
+		if err == nil && configuration.matches(action.Limits) {
+			break
+		}
+		if attempt >= sweepAttempts {
+			return fmt.Errorf("%s was not updated to %s", name, configuration.Name())
+		}
+		<-time.After(time.Second)
+	}
+	if l.Sweep.Settle > 0 {
+		<-time.After(l.Sweep.Settle)
+	}
+
+	l.Sweep.Lock()
+	l.Sweep.current = &configuration
+	l.Sweep.Unlock()
+	log.Infof("updated %s to %s", name, configuration.Name())
+	return nil
+}
+
+//restoreSweep sets the limits the action had before the sweep
+func (l *WhiskInvoker) restoreSweep() error {
+	if l.Sweep == nil || l.Sweep.original == nil {
+		return nil
+	}
+	name := l.Sweep.action
+	_, _, err := l.client.Actions.Insert(&whisk.Action{Name: name, Limits: l.Sweep.original}, true)
+	if err != nil {
+		return fmt.Errorf("failed to restore the limits of %s - %+v", name, err)
+	}
+	l.Sweep.Lock()
+	l.Sweep.current = nil
+	l.Sweep.Unlock()
+	log.Infof("restored the limits of %s", name)
+	return nil
+}
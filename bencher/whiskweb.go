@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2021.   Sebastian Werner, TU Berlin, Germany
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bencher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/faas-facts/fact/fact"
+)
+
+//WhiskActivationIDTag is the activation id OpenWhisk reports for web action requests
+const WhiskActivationIDTag = "ActivationID"
+
+const whiskActivationHeader = "X-Openwhisk-Activation-Id"
+
+//newWhiskWebInvoker creates the http invoker of the web mode, it shares the http options but not the api host and token
+func newWhiskWebInvoker(config map[string]interface{}, payload string) (*HTTPInvoker, error) {
+	options := make(map[string]interface{})
+	for k, v := range config {
+		options[k] = v
+	}
+	//host and token address the api, web actions are called without credentials
+	delete(options, "host")
+	delete(options, "token")
+	if _, ok := options["timeout"]; !ok {
+		options["timeout"] = "60s"
+	}
+	if _, ok := options["method"]; !ok {
+		options["method"] = http.MethodPost
+	}
+	if _, ok := options["contentType"]; !ok {
+		options["contentType"] = "application/json"
+	}
+	if _, ok := options["body"]; !ok && payload != "" {
+		options["body"] = payload
+	}
+
+	invoker, err := newHttpInvoker(InvokerConfig{Type: "http", Options: options})
+	if err != nil {
+		return nil, err
+	}
+	web := invoker.(*HTTPInvoker)
+	web.onResponse = readWhiskWebHeaders
+	return web, nil
+}
+
+//webURL is the url of the web action, actions outside of a package are in the default package
+func (l *WhiskInvoker) webURL() (string, error) {
+	if l.namespace == "" || l.namespace == "_" {
+		return "", fmt.Errorf("web actions need the namespace, set namespace or NAMESPACE in %s", whiskPropsPath)
+	}
+	name := strings.Trim(l.FunctionName, "/")
+	if !strings.Contains(name, "/") {
+		name = "default/" + name
+	}
+	base := *l.client.BaseURL
+	base.Path = strings.TrimRight(base.Path, "/") + fmt.Sprintf("/v1/web/%s/%s.json", l.namespace, name)
+	return base.String(), nil
+}
+
+//setupWeb points the http invoker of the web mode to the web action
+func (l *WhiskInvoker) setupWeb(ctx context.Context, phase *Phase, bencher *Bencher) error {
+	target, err := l.webURL()
+	if err != nil {
+		return err
+	}
+	webPhase := *phase
+	webPhase.Target = target
+	return l.web.Setup(ctx, &webPhase, bencher)
+}
+
+//readWhiskWebHeaders maps the headers of web action responses onto the trace
+func readWhiskWebHeaders(result *fact.Trace, header http.Header) {
+	if result.Tags == nil {
+		result.Tags = make(map[string]string)
+	}
+	if result.Platform == "" {
+		result.Platform = "openwhisk"
+	}
+	if id := header.Get(whiskActivationHeader); id != "" {
+		result.Tags[WhiskActivationIDTag] = id
+	}
+}
+
+//execWeb calls the web action, with WebRecords the trace is written once the activation record was fetched
+func (l *WhiskInvoker) execWeb(worker int, rate HatchRate) error {
+	err := rate.Take()
+	if err != nil {
+		return err
+	}
+
+	result, _, err := l.web.call(context.Background(), worker, nil, rate)
+	if err != nil {
+		rate.OnFailed()
+		return err
+	}
+	if isFailed(result) || result.Status >= 400 || result.Status == 0 {
+		rate.OnFailed()
+	} else {
+		rate.OnSuccess()
+	}
+	if l.Sweep != nil {
+		l.Sweep.tag(result)
+	}
+
+	id := result.Tags[WhiskActivationIDTag]
+	if !l.WebRecords || id == "" || isFailed(result) {
+		l.results.Add(result)
+		return nil
+	}
+	//the poller matches records by the id of the trace
+	result.ID = id
+	l.activations.submit(result)
+	return nil
+}
@@ -0,0 +1,3 @@
+function main(params) {
+    return { greeting: params.greeting, id: params.id };
+}
@@ -0,0 +1,75 @@
+#!/usr/bin/env python3
+# Minimal plugin for the plugin invoker, it posts the payload to the target of the phase.
+#
+# The bencher writes one json request per line to stdin and reads one json response per line from stdout:
+#   {"id": 1, "op": "setup", "protocol": 1, "phase": {"name": .., "target": .., "threads": ..}, "config": {..}}
+#   {"id": 2, "op": "exec", "worker": 0, "payload": "..", "vars": {..}}
+#   {"id": 3, "op": "close"}
+# Each response carries the id of its request and optionally trace, status, header, body and error.
+# Responses may be written in any order, logs belong on stderr.
+import json
+import sys
+import threading
+import time
+import urllib.error
+import urllib.request
+from concurrent.futures import ThreadPoolExecutor
+
+state = {}
+lock = threading.Lock()
+
+
+def respond(response):
+    line = json.dumps(response)
+    with lock:
+        sys.stdout.write(line + "\n")
+        sys.stdout.flush()
+
+
+def timestamp(t):
+    return {"seconds": int(t), "nanos": int((t % 1) * 1e9)}
+
+
+def invoke(request):
+    start = time.time()
+    req = urllib.request.Request(state["target"], data=request.get("payload", "").encode(),
+                                 method=state["config"].get("method", "POST"),
+                                 headers={"Content-Type": "application/json"})
+    response = {"id": request["id"]}
+    try:
+        with urllib.request.urlopen(req) as resp:
+            response["status"] = resp.status
+            response["body"] = resp.read().decode()
+    except urllib.error.HTTPError as e:
+        response["status"] = e.code
+    except Exception as e:
+        response["error"] = str(e)
+    end = time.time()
+    response["trace"] = {"RequestStartTime": timestamp(start), "RequestEndTime": timestamp(end)}
+    respond(response)
+
+
+def main():
+    pool = None
+    for line in sys.stdin:
+        request = json.loads(line)
+        op = request["op"]
+        if op == "setup":
+            if request.get("protocol") != 1:
+                respond({"id": request["id"], "error": "unsupported protocol"})
+                continue
+            state["target"] = request["phase"]["target"]
+            state["config"] = request.get("config") or {}
+            pool = ThreadPoolExecutor(max_workers=max(1, request["phase"]["threads"]))
+            respond({"id": request["id"]})
+        elif op == "exec":
+            pool.submit(invoke, request)
+        elif op == "close":
+            if pool:
+                pool.shutdown()
+            respond({"id": request["id"]})
+            return
+
+
+if __name__ == "__main__":
+    main()
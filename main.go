@@ -18,10 +18,8 @@
 package main
 
 import (
-	"crypto/tls"
 	"flag"
 	"fmt"
-	"net/http"
 	"os"
 	"runtime"
 	"time"
@@ -89,7 +87,6 @@ func setup() {
 
 func main() {
 	setup()
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
@@ -118,6 +115,8 @@ func main() {
 		os.Exit(-1)
 	}
 
+	bench.Build = Build
+
 	fmt.Println("Using the following workload:")
 	fmt.Println(bench.Work)
 